@@ -0,0 +1,75 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkleAccumulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const checkpointVersion byte = 1
+
+// Checkpoint serializes the accumulator's size and partials as
+//
+//	version (1 byte) | size (8 bytes) | partials (32 bytes each) | keccak of everything before it (32 bytes)
+//
+// so that a corrupted checkpoint is detected when restored
+func (acc *MerkleAccumulator) Checkpoint() ([]byte, error) {
+	size, err := acc.size.Get()
+	if err != nil {
+		return nil, err
+	}
+	partials, err := acc.Partials()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 1+8+32*len(partials)+32)
+	data = append(data, checkpointVersion)
+	data = binary.BigEndian.AppendUint64(data, size)
+	for _, partial := range partials {
+		data = append(data, partial.Bytes()...)
+	}
+	return append(data, crypto.Keccak256(data)...), nil
+}
+
+// RestoreCheckpoint loads a non-persistent accumulator from a checkpoint, after validating its checksum
+func RestoreCheckpoint(data []byte) (*MerkleAccumulator, error) {
+	if len(data) < 1+8+32 {
+		return nil, errors.New("checkpoint is too short")
+	}
+	body, checksum := data[:len(data)-32], data[len(data)-32:]
+	if !bytes.Equal(crypto.Keccak256(body), checksum) {
+		return nil, errors.New("checkpoint checksum mismatch")
+	}
+	if body[0] != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %v", body[0])
+	}
+	size := binary.BigEndian.Uint64(body[1:9])
+	raw := body[9:]
+	numPartials := CalcNumPartials(size)
+	if uint64(len(raw)) != 32*numPartials {
+		return nil, fmt.Errorf("checkpoint has %v bytes of partials but size %v needs %v", len(raw), size, 32*numPartials)
+	}
+	partials := make(Partials, numPartials)
+	for i := range partials {
+		partials[i] = common.BytesToHash(raw[32*i : 32*(i+1)])
+	}
+	acc, err := NewNonpersistentMerkleAccumulatorFromPartials(partials)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := acc.Size()
+	if err != nil {
+		return nil, err
+	}
+	if restored != size {
+		return nil, fmt.Errorf("checkpoint partials imply size %v rather than %v", restored, size)
+	}
+	return acc, nil
+}
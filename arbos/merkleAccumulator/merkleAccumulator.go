@@ -4,9 +4,17 @@
 package merkleAccumulator
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/offchainlabs/nitro/arbos/storage"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
 	"github.com/offchainlabs/nitro/util/arbmath"
 )
 
@@ -14,6 +22,16 @@ type MerkleAccumulator struct {
 	backingStorage *storage.Storage
 	size           storage.WrappedUint64
 	partials       []*common.Hash // nil if we are using backingStorage (in that case we access partials in backingStorage
+	hasher         Hasher         // nil for Keccak256, which is charged to the backingStorage's burner if there is one
+	journal        *rewindJournal // nil unless RetainRewinds was called
+}
+
+// Hasher combines two child nodes into their parent
+type Hasher func(left, right common.Hash) common.Hash
+
+// Keccak256Hasher is the Hasher ArbSys and the outbox use
+func Keccak256Hasher(left, right common.Hash) common.Hash {
+	return crypto.Keccak256Hash(left.Bytes(), right.Bytes())
 }
 
 func InitializeMerkleAccumulator(sto *storage.Storage) {
@@ -22,30 +40,42 @@ func InitializeMerkleAccumulator(sto *storage.Storage) {
 
 func OpenMerkleAccumulator(sto *storage.Storage) *MerkleAccumulator {
 	size := sto.OpenStorageBackedUint64(0)
-	return &MerkleAccumulator{sto, &size, nil}
+	return &MerkleAccumulator{sto, &size, nil, nil, nil}
 }
 
+// NewNonpersistentMerkleAccumulator makes an empty accumulator kept in memory, with no storage to charge or write,
+// whose roots are those of one backed by storage with the same leaves
 func NewNonpersistentMerkleAccumulator() *MerkleAccumulator {
-	return &MerkleAccumulator{nil, &storage.MemoryBackedUint64{}, make([]*common.Hash, 0)}
+	return NewNonpersistentMerkleAccumulatorWithHasher(Keccak256Hasher)
+}
+
+// NewNonpersistentMerkleAccumulatorWithHasher makes an empty accumulator that combines nodes with the given
+// hasher. Leaves are still hashed with Keccak256 before being included in the tree.
+func NewNonpersistentMerkleAccumulatorWithHasher(hasher Hasher) *MerkleAccumulator {
+	return &MerkleAccumulator{nil, &storage.MemoryBackedUint64{}, make([]*common.Hash, 0), hasher, nil}
 }
 
 func CalcNumPartials(size uint64) uint64 {
 	return arbmath.Log2ceil(size)
 }
 
-func NewNonpersistentMerkleAccumulatorFromPartials(partials []*common.Hash) (*MerkleAccumulator, error) {
-	size := uint64(0)
-	levelSize := uint64(1)
-	for i := range partials {
-		if *partials[i] != (common.Hash{}) {
-			size += levelSize
-		}
-		levelSize *= 2
+// NewNonpersistentMerkleAccumulatorFromPartials loads the partials into memory, erroring if they fail Validate
+func NewNonpersistentMerkleAccumulatorFromPartials(partials Partials) (*MerkleAccumulator, error) {
+	return NewNonpersistentMerkleAccumulatorFromPartialsWithHasher(partials, Keccak256Hasher)
+}
+
+// NewNonpersistentMerkleAccumulatorFromPartialsWithHasher is like NewNonpersistentMerkleAccumulatorFromPartials,
+// for partials made with the given hasher
+func NewNonpersistentMerkleAccumulatorFromPartialsWithHasher(partials Partials, hasher Hasher) (*MerkleAccumulator, error) {
+	if err := partials.Validate(); err != nil {
+		return nil, err
 	}
-	mbu := &storage.MemoryBackedUint64{}
-	return &MerkleAccumulator{nil, mbu, partials}, mbu.Set(size)
+	return newNonpersistentFromPartials(partials, hasher), nil
 }
 
+// NonPersistentClone copies the accumulator into memory. The clone shares nothing with the original, so
+// appending to it never changes the original, and cloning only reads the original, so accumulators that aren't
+// being appended to can be cloned from several goroutines at once.
 func (acc *MerkleAccumulator) NonPersistentClone() (*MerkleAccumulator, error) {
 	size, err := acc.size.Get()
 	if err != nil {
@@ -54,14 +84,30 @@ func (acc *MerkleAccumulator) NonPersistentClone() (*MerkleAccumulator, error) {
 	numPartials := CalcNumPartials(size)
 	partials := make([]*common.Hash, numPartials)
 	for i := uint64(0); i < numPartials; i++ {
-		partial, err := acc.getPartial(i)
+		partial, err := acc.peekPartial(i)
 		if err != nil {
 			return nil, err
 		}
-		partials[i] = partial
+		partials[i] = &partial
 	}
 	mbu := &storage.MemoryBackedUint64{}
-	return &MerkleAccumulator{nil, mbu, partials}, mbu.Set(size)
+	return &MerkleAccumulator{nil, mbu, partials, acc.hasher, nil}, mbu.Set(size)
+}
+
+// Hasher returns the hasher the accumulator combines nodes with
+func (acc *MerkleAccumulator) Hasher() Hasher {
+	if acc.hasher == nil {
+		return Keccak256Hasher
+	}
+	return acc.hasher
+}
+
+// hashNodes combines two nodes, charging for it if the accumulator is backed by storage
+func (acc *MerkleAccumulator) hashNodes(left, right common.Hash) (common.Hash, error) {
+	if acc.hasher != nil {
+		return acc.hasher(left, right), nil
+	}
+	return acc.KeccakHash(left.Bytes(), right.Bytes())
 }
 
 func (acc *MerkleAccumulator) Keccak(data ...[]byte) ([]byte, error) {
@@ -78,6 +124,17 @@ func (acc *MerkleAccumulator) KeccakHash(data ...[]byte) (common.Hash, error) {
 	return crypto.Keccak256Hash(data...), nil
 }
 
+// peekPartial reads a partial by value, unlike getPartial without filling in missing ones
+func (acc *MerkleAccumulator) peekPartial(level uint64) (common.Hash, error) {
+	if acc.backingStorage == nil {
+		if level >= uint64(len(acc.partials)) || acc.partials[level] == nil {
+			return common.Hash{}, nil
+		}
+		return *acc.partials[level], nil
+	}
+	return acc.backingStorage.GetByUint64(2 + level)
+}
+
 func (acc *MerkleAccumulator) getPartial(level uint64) (*common.Hash, error) {
 	if acc.backingStorage == nil {
 		if acc.partials[level] == nil {
@@ -90,6 +147,11 @@ func (acc *MerkleAccumulator) getPartial(level uint64) (*common.Hash, error) {
 	return &ret, err
 }
 
+// GetPartials returns a partial for every level up to the highest, from the bottom up. Levels not in the size's
+// binary representation hold the zero hash, but an empty accumulator has no levels, so its result is empty.
+// The pointers of an in-memory accumulator are into its state, so writing through them changes it.
+//
+// Deprecated: use Partials, which returns copies.
 func (acc *MerkleAccumulator) GetPartials() ([]*common.Hash, error) {
 	size, err := acc.size.Get()
 	if err != nil {
@@ -106,6 +168,22 @@ func (acc *MerkleAccumulator) GetPartials() ([]*common.Hash, error) {
 	return partials, nil
 }
 
+// Partials returns copies of the partials, as GetPartials does, so changing them never changes the accumulator
+func (acc *MerkleAccumulator) Partials() (Partials, error) {
+	size, err := acc.size.Get()
+	if err != nil {
+		return nil, err
+	}
+	partials := make(Partials, CalcNumPartials(size))
+	for i := range partials {
+		partials[i], err = acc.peekPartial(uint64(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return partials, nil
+}
+
 func (acc *MerkleAccumulator) setPartial(level uint64, val *common.Hash) error {
 	if acc.backingStorage != nil {
 		err := acc.backingStorage.SetByUint64(2+level, *val)
@@ -122,57 +200,301 @@ func (acc *MerkleAccumulator) setPartial(level uint64, val *common.Hash) error {
 
 // Note: itemHash is hashed before being included in the tree, to prevent confusing leafs with branches.
 func (acc *MerkleAccumulator) Append(itemHash common.Hash) ([]MerkleTreeNodeEvent, error) {
+	events, _, _, _, err := acc.appendLeaf(crypto.Keccak256Hash(itemHash.Bytes()))
+	return events, err
+}
+
+// AppendWithRoot appends the item like Append, also returning the new root. Append leaves the partials below
+// the one it sets empty, so the root is found from that partial up, without reading the levels it cleared.
+func (acc *MerkleAccumulator) AppendWithRoot(itemHash common.Hash) (common.Hash, []MerkleTreeNodeEvent, error) {
+	events, size, level, partial, err := acc.appendLeaf(crypto.Keccak256Hash(itemHash.Bytes()))
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	root, err := acc.rootFrom(size, level, &partial)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	return root, events, nil
+}
+
+// appendLeaf implements Append for an item already hashed into a leaf, also returning the new size and the
+// level and value of the partial it set, which is the lowest that isn't empty
+func (acc *MerkleAccumulator) appendLeaf(leafHash common.Hash) ([]MerkleTreeNodeEvent, uint64, uint64, common.Hash, error) {
 	size, err := acc.size.Increment()
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, common.Hash{}, err
 	}
 	events := []MerkleTreeNodeEvent{}
+	var consumed []common.Hash
 
 	level := uint64(0)
-	soFar := crypto.Keccak256(itemHash.Bytes())
+	soFar := leafHash
 	for {
 		if level == CalcNumPartials(size-1) { // -1 to counteract the acc.size++ at top of this function
-			h := common.BytesToHash(soFar)
-			err := acc.setPartial(level, &h)
-			return events, err
+			acc.journal.record(consumed)
+			err := acc.setPartial(level, &soFar)
+			return events, size, level, soFar, err
 		}
 		thisLevel, err := acc.getPartial(level)
 		if err != nil {
-			return nil, err
+			return nil, 0, 0, common.Hash{}, err
 		}
 		if *thisLevel == (common.Hash{}) {
-			h := common.BytesToHash(soFar)
-			err := acc.setPartial(level, &h)
-			return events, err
+			acc.journal.record(consumed)
+			err := acc.setPartial(level, &soFar)
+			return events, size, level, soFar, err
 		}
-		soFar, err = acc.Keccak(thisLevel.Bytes(), soFar)
+		if acc.journal != nil {
+			consumed = append(consumed, *thisLevel)
+		}
+		soFar, err = acc.hashNodes(*thisLevel, soFar)
 		if err != nil {
-			return nil, err
+			return nil, 0, 0, common.Hash{}, err
 		}
 		h := common.Hash{}
 		err = acc.setPartial(level, &h)
 		if err != nil {
-			return nil, err
+			return nil, 0, 0, common.Hash{}, err
 		}
 		level += 1
-		events = append(events, MerkleTreeNodeEvent{level, size - 1, common.BytesToHash(soFar)})
+		events = append(events, MerkleTreeNodeEvent{level, size - 1, soFar})
+	}
+}
+
+// AppendMulti appends the items in order, returning the node events Append would have for each of them.
+// The partials are read once and only those that end up changed are written back, along with the size, so
+// this is cheaper than appending one at a time when the accumulator is backed by storage.
+func (acc *MerkleAccumulator) AppendMulti(itemHashes []common.Hash) ([]MerkleTreeNodeEvent, error) {
+	size, err := acc.size.Get()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := acc.Partials()
+	if err != nil {
+		return nil, err
+	}
+	partials := append([]common.Hash{}, stored...)
+	events := []MerkleTreeNodeEvent{}
+
+	for _, itemHash := range itemHashes {
+		size += 1
+		level := uint64(0)
+		soFar := crypto.Keccak256Hash(itemHash.Bytes())
+		var consumed []common.Hash
+		for {
+			if level == CalcNumPartials(size-1) {
+				partials = append(partials, soFar)
+				break
+			}
+			if partials[level] == (common.Hash{}) {
+				partials[level] = soFar
+				break
+			}
+			if acc.journal != nil {
+				consumed = append(consumed, partials[level])
+			}
+			soFar, err = acc.hashNodes(partials[level], soFar)
+			if err != nil {
+				return nil, err
+			}
+			partials[level] = common.Hash{}
+			level += 1
+			events = append(events, MerkleTreeNodeEvent{level, size - 1, soFar})
+		}
+		acc.journal.record(consumed)
+	}
+
+	if err := acc.size.Set(size); err != nil {
+		return nil, err
+	}
+	for level := range partials {
+		if level < len(stored) && stored[level] == partials[level] {
+			continue
+		}
+		if err := acc.setPartial(uint64(level), &partials[level]); err != nil {
+			return nil, err
+		}
 	}
+	return events, nil
 }
 
+// AppendWithSiblings appends the item like Append, also returning what's needed to prove it was appended:
+// its index, its siblings bottom-up, and the new root. The siblings are the partials from before the append,
+// read as it goes rather than by cloning the accumulator. The node events are discarded.
+func (acc *MerkleAccumulator) AppendWithSiblings(itemHash common.Hash) (uint64, []common.Hash, common.Hash, error) {
+	index, err := acc.size.Get()
+	if err != nil {
+		return 0, nil, common.Hash{}, err
+	}
+	siblings, err := acc.Partials()
+	if err != nil {
+		return 0, nil, common.Hash{}, err
+	}
+	root, _, err := acc.AppendWithRoot(itemHash)
+	if err != nil {
+		return 0, nil, common.Hash{}, err
+	}
+	return index, siblings, root, nil
+}
+
+// ArbSysEventIDs returns the IDs of ArbSys's SendMerkleUpdate and L2ToL1Tx events
+func ArbSysEventIDs() (common.Hash, common.Hash, error) {
+	arbSys, err := precompilesgen.ArbSysMetaData.GetAbi()
+	if err != nil {
+		return common.Hash{}, common.Hash{}, err
+	}
+	return arbSys.Events["SendMerkleUpdate"].ID, arbSys.Events["L2ToL1Tx"].ID, nil
+}
+
+// PositionFromHash decodes a node's position as it appears in the position topic of ArbSys logs: the level in
+// the first 8 bytes and the leaf in the last 8. Bytes 8 through 23 are zero in any position ArbSys emits, and
+// are ignored, as a leaf beyond a uint64 is unsupported.
+func PositionFromHash(hash common.Hash) (level uint64, numLeaves uint64) {
+	return binary.BigEndian.Uint64(hash[:8]), binary.BigEndian.Uint64(hash[24:])
+}
+
+// ApplyLog updates the accumulator from one of ArbSys's L2ToL1Tx or SendMerkleUpdate logs, returning whether it
+// advanced the state. Only the L2ToL1Tx log of the next leaf can; duplicate, stale, and out-of-order leaves are
+// skipped. Internal nodes are recomputed by Append, so SendMerkleUpdate logs never advance the state, but those
+// of the last leaf appended are checked against the partial at their level, as ApplyEvent does. ArbSys emits a
+// leaf's SendMerkleUpdate logs before its L2ToL1Tx log, so those of the next leaf are only checked for their
+// position, and older ones are skipped. Logs of other events or from other contracts are rejected.
+func (acc *MerkleAccumulator) ApplyLog(log types.Log) (bool, error) {
+	if log.Address != types.ArbSysAddress {
+		return false, errors.New("log wasn't emitted by ArbSys")
+	}
+	if len(log.Topics) < 4 {
+		return false, errors.New("log is missing the hash and position topics")
+	}
+	merkleID, withdrawID, err := ArbSysEventIDs()
+	if err != nil {
+		return false, err
+	}
+	level, numLeaves := PositionFromHash(log.Topics[3])
+	event := MerkleTreeNodeEvent{Level: level, NumLeaves: numLeaves, Hash: log.Topics[2]}
+	size, err := acc.size.Get()
+	if err != nil {
+		return false, err
+	}
+	switch log.Topics[0] {
+	case withdrawID:
+		if event.Level != 0 {
+			return false, fmt.Errorf("L2ToL1Tx log is at level %v rather than that of a leaf", event.Level)
+		}
+		if event.NumLeaves != size {
+			return false, nil
+		}
+		_, err = acc.Append(event.Hash)
+		return err == nil, err
+	case merkleID:
+		if event.Level == 0 {
+			return false, errors.New("SendMerkleUpdate log is at the level of a leaf")
+		}
+		if err := event.CheckPosition(); err != nil {
+			return false, err
+		}
+		if event.NumLeaves+1 != size {
+			return false, nil
+		}
+		return false, acc.ApplyEvent(event)
+	}
+	return false, fmt.Errorf("log is of event %v rather than SendMerkleUpdate or L2ToL1Tx", log.Topics[0])
+}
+
+// ApplyEvent folds the next event of a stream of node events into the accumulator, where leaves are level 0
+// events with the hash they have in the tree, followed by the events Append made when appending them, as ArbSys's
+// L2ToL1Tx and SendMerkleUpdate logs are. A leaf is appended if it's the next one. Every other event must be for
+// the last leaf appended, so NumLeaves never decreases, and is checked against the partial at its level, which
+// makes redelivering the latest event harmless. Nodes below the lowest partial were combined into it by the
+// append, so those can only be checked for their position. Events regressing to earlier leaves, leaves skipping
+// ahead, and nodes for leaves not yet appended are rejected.
+func (acc *MerkleAccumulator) ApplyEvent(event MerkleTreeNodeEvent) error {
+	size, err := acc.size.Get()
+	if err != nil {
+		return err
+	}
+	if event.Level == 0 && event.NumLeaves == size {
+		_, _, _, _, err := acc.appendLeaf(event.Hash)
+		return err
+	}
+	if err := event.CheckPosition(); err != nil {
+		return err
+	}
+	if event.NumLeaves+1 != size {
+		return fmt.Errorf("event at level %v for leaf %v is out of order for an accumulator of size %v",
+			event.Level, event.NumLeaves, size)
+	}
+	lowest := uint64(bits.TrailingZeros64(size))
+	if event.Level < lowest {
+		return nil // already combined into the lowest partial
+	}
+	partial, err := acc.getPartial(event.Level)
+	if err != nil {
+		return err
+	}
+	if *partial != event.Hash {
+		return fmt.Errorf("event at level %v leaf %v conflicts with the accumulator's partial", event.Level, event.NumLeaves)
+	}
+	return nil
+}
+
+// Size returns the number of leaves appended. It only reads the stored count, so unlike Root it does no hashing.
 func (acc *MerkleAccumulator) Size() (uint64, error) {
 	return acc.size.Get()
 }
 
+// IsBalanced returns whether the size is 0 or a power of 2, in which case the tree is complete and has no
+// frontier to walk. The empty tree counts as balanced, as it does when the outbox builds proofs.
+func (acc *MerkleAccumulator) IsBalanced() (bool, error) {
+	size, err := acc.size.Get()
+	return size == 0 || arbmath.IsPowerOf2(size), err
+}
+
+// Equal returns whether the accumulators have the same size and partials, and so committed to the same history.
+// Roots alone aren't compared, as they don't determine the size. The hashers can't be compared, so accumulators
+// made with different ones are only equal if all their partials happen to be.
+func (acc *MerkleAccumulator) Equal(other *MerkleAccumulator) (bool, error) {
+	size, err := acc.size.Get()
+	if err != nil {
+		return false, err
+	}
+	otherSize, err := other.size.Get()
+	if err != nil || size != otherSize {
+		return false, err
+	}
+	for level := uint64(0); level < CalcNumPartials(size); level++ {
+		partial, err := acc.peekPartial(level)
+		if err != nil {
+			return false, err
+		}
+		otherPartial, err := other.peekPartial(level)
+		if err != nil || partial != otherPartial {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 func (acc *MerkleAccumulator) Root() (common.Hash, error) {
 	size, err := acc.size.Get()
 	if size == 0 || err != nil {
 		return common.Hash{}, err
 	}
 
-	var hashSoFar *common.Hash
-	var capacityInHash uint64
-	capacity := uint64(1)
-	for level := uint64(0); level < CalcNumPartials(size); level++ {
+	return acc.rootFrom(size, 0, nil)
+}
+
+// rootFrom combines the partials into the root, starting from the given level. If lowest isn't nil, it's the
+// partial at that level and the partials below it are empty, so only those above it are read.
+func (acc *MerkleAccumulator) rootFrom(size, level uint64, lowest *common.Hash) (common.Hash, error) {
+	hashSoFar := lowest
+	capacityInHash := uint64(1) << level
+	if lowest != nil {
+		level++
+	}
+	capacity := uint64(1) << level
+	for ; level < CalcNumPartials(size); level++ {
 		partial, err := acc.getPartial(level)
 		if err != nil {
 			return common.Hash{}, err
@@ -183,14 +505,14 @@ func (acc *MerkleAccumulator) Root() (common.Hash, error) {
 				capacityInHash = capacity
 			} else {
 				for capacityInHash < capacity {
-					h, err := acc.KeccakHash(hashSoFar.Bytes(), make([]byte, 32))
+					h, err := acc.hashNodes(*hashSoFar, common.Hash{})
 					if err != nil {
 						return common.Hash{}, err
 					}
 					hashSoFar = &h
 					capacityInHash *= 2
 				}
-				h, err := acc.KeccakHash(partial.Bytes(), hashSoFar.Bytes())
+				h, err := acc.hashNodes(*partial, *hashSoFar)
 				if err != nil {
 					return common.Hash{}, err
 				}
@@ -212,14 +534,9 @@ func (acc *MerkleAccumulator) StateForExport() (uint64, common.Hash, []common.Ha
 	if err != nil {
 		return 0, common.Hash{}, nil, err
 	}
-	numPartials := CalcNumPartials(size)
-	partials := make([]common.Hash, numPartials)
-	for i := uint64(0); i < numPartials; i++ {
-		partial, err := acc.getPartial(i)
-		if err != nil {
-			return 0, common.Hash{}, nil, err
-		}
-		partials[i] = *partial
+	partials, err := acc.Partials()
+	if err != nil {
+		return 0, common.Hash{}, nil, err
 	}
 	return size, root, partials, nil
 }
@@ -229,3 +546,20 @@ type MerkleTreeNodeEvent struct {
 	NumLeaves uint64
 	Hash      common.Hash
 }
+
+// MaxLevel is the highest level a node can be at. A size can count at most 1<<64 - 1 leaves, which a subtree
+// at this level and one of each below it cover, so higher levels come only from corrupt or malicious events.
+const MaxLevel = 63
+
+// CheckPosition checks the event is of a node a tree can have: at most MaxLevel, and ending where a subtree of
+// its level can, short of the leaf past the last a size can count. Shifting by an unchecked level would
+// silently wrap, so events from untrusted sources should be checked before their positions are used.
+func (event MerkleTreeNodeEvent) CheckPosition() error {
+	if event.Level > MaxLevel {
+		return fmt.Errorf("event at level %v is above the highest level of %v", event.Level, MaxLevel)
+	}
+	if event.NumLeaves == math.MaxUint64 || (event.NumLeaves+1)%(1<<event.Level) != 0 {
+		return fmt.Errorf("event at level %v can't end at leaf %v", event.Level, event.NumLeaves)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkleAccumulator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/storage"
+)
+
+// Partials are the partials of an accumulator by value, indexed by level from the bottom up.
+// A level's partial is the root of a complete subtree of 1<<level leaves, or the zero hash if the size has no
+// such subtree, and there are partials up to the highest level the size needs, as MerkleAccumulator.Partials returns them.
+type Partials []common.Hash
+
+// Size returns the number of leaves the partials cover
+func (partials Partials) Size() uint64 {
+	size := uint64(0)
+	for level, partial := range partials {
+		if partial != (common.Hash{}) {
+			size += 1 << level
+		}
+	}
+	return size
+}
+
+// Root returns the root of the tree the partials are of, combining them with Keccak256 as ArbSys does
+func (partials Partials) Root() common.Hash {
+	acc := newNonpersistentFromPartials(partials, Keccak256Hasher)
+	root, _ := acc.Root() // in memory, so this can't fail
+	return root
+}
+
+// Validate checks the partials could be an accumulator's. A size has no levels above MaxLevel, and an
+// accumulator has none above its size's highest bit, so the highest level's partial must not be empty.
+func (partials Partials) Validate() error {
+	if len(partials) > MaxLevel+1 {
+		return fmt.Errorf("%v levels of partials exceed the %v a size can have", len(partials), MaxLevel+1)
+	}
+	if len(partials) != 0 && partials[len(partials)-1] == (common.Hash{}) {
+		return errors.New("the highest level's partial is empty")
+	}
+	return nil
+}
+
+// newNonpersistentFromPartials loads the partials into memory without validating them
+func newNonpersistentFromPartials(partials Partials, hasher Hasher) *MerkleAccumulator {
+	pointers := make([]*common.Hash, len(partials))
+	for i := range partials {
+		partial := partials[i]
+		pointers[i] = &partial
+	}
+	size := &storage.MemoryBackedUint64{}
+	_ = size.Set(partials.Size()) // in memory, so this can't fail
+	return &MerkleAccumulator{nil, size, pointers, hasher, nil}
+}
@@ -0,0 +1,109 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkleAccumulator
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrCannotRewind is returned by Rewind for sizes whose partials the accumulator neither has nor retained
+var ErrCannotRewind = errors.New("the accumulator doesn't retain the partials needed to rewind that far")
+
+// rewindJournal remembers, for each recent append, the partials it combined into the one it set
+type rewindJournal struct {
+	limit    uint64
+	consumed [][]common.Hash // by append, oldest first, each from the bottom level up
+}
+
+func (journal *rewindJournal) record(consumed []common.Hash) {
+	if journal == nil {
+		return
+	}
+	if uint64(len(journal.consumed)) == journal.limit {
+		journal.consumed = journal.consumed[1:]
+	}
+	journal.consumed = append(journal.consumed, consumed)
+}
+
+// RetainRewinds makes the accumulator remember the partials each of its next appends combines, for up to the
+// last limit of them, so that Rewind can undo those appends, as when a reorg drops recent sends. They're kept in
+// memory by this instance only, so neither storage nor clones have them, and a limit of 0 stops retaining them.
+func (acc *MerkleAccumulator) RetainRewinds(limit uint64) {
+	if limit == 0 {
+		acc.journal = nil
+		return
+	}
+	journal := &rewindJournal{limit: limit}
+	if acc.journal != nil {
+		kept := acc.journal.consumed
+		if uint64(len(kept)) > limit {
+			kept = kept[uint64(len(kept))-limit:]
+		}
+		journal.consumed = kept
+	}
+	acc.journal = journal
+}
+
+// Rewind rolls the accumulator back to an earlier size, restoring the partials it had then, so its root is again
+// the one it had at that size. Undoing an append needs the partials it combined, which are only known for the
+// appends retained since RetainRewinds. Beyond those, the accumulator can rewind to any size whose partials are
+// all among its own, which are the sizes made by clearing its lowest set bits, including 0. ErrCannotRewind is
+// returned for other sizes, and the accumulator is left unchanged.
+func (acc *MerkleAccumulator) Rewind(toSize uint64) error {
+	size, err := acc.size.Get()
+	if err != nil {
+		return err
+	}
+	if toSize > size {
+		return fmt.Errorf("can't rewind an accumulator of size %v forward to %v", size, toSize)
+	}
+	retained := uint64(0)
+	if acc.journal != nil {
+		retained = min(uint64(len(acc.journal.consumed)), size-toSize)
+	}
+	undone := size - retained
+	if !isPrefixSize(toSize, undone) {
+		return fmt.Errorf("%w: from size %v to %v", ErrCannotRewind, size, toSize)
+	}
+
+	// each partial gets its own hash, as GetPartials hands out the pointers it holds
+	for ; size > undone; size-- {
+		last := len(acc.journal.consumed) - 1
+		consumed := acc.journal.consumed[last]
+		acc.journal.consumed = acc.journal.consumed[:last]
+		if err := acc.setPartial(uint64(bits.TrailingZeros64(size)), &common.Hash{}); err != nil {
+			return err
+		}
+		for level := range consumed {
+			partial := consumed[level]
+			if err := acc.setPartial(uint64(level), &partial); err != nil {
+				return err
+			}
+		}
+	}
+	for level := uint64(0); level < CalcNumPartials(size); level++ {
+		if size&(1<<level) != 0 && toSize&(1<<level) == 0 {
+			if err := acc.setPartial(level, &common.Hash{}); err != nil {
+				return err
+			}
+		}
+	}
+	if acc.backingStorage == nil {
+		acc.partials = acc.partials[:CalcNumPartials(toSize)]
+	}
+	return acc.size.Set(toSize)
+}
+
+// isPrefixSize returns whether the partials of a tree of the smaller size are all partials of the larger one,
+// which is when the smaller size is the larger with its lowest set bits cleared
+func isPrefixSize(smaller, larger uint64) bool {
+	if smaller == 0 {
+		return true
+	}
+	return smaller&larger == smaller && larger-smaller < smaller&-smaller
+}
@@ -234,7 +234,7 @@ func (n NodeInterface) ConstructOutboxProof(c ctx, evm mech, size, leaf uint64)
 		return hash0, hash0, nil, errors.New("leaf does not exist")
 	}
 
-	balanced := size == arbmath.NextPowerOf2(size)/2
+	balanced := size == 0 || arbmath.IsPowerOf2(size)
 	treeLevels := int(arbmath.Log2ceil(size)) // the # of levels in the tree
 	proofLevels := treeLevels - 1             // the # of levels where a hash is needed (all but root)
 	walkLevels := treeLevels                  // the # of levels we need to consider when building walks
@@ -282,7 +282,10 @@ func (n NodeInterface) ConstructOutboxProof(c ctx, evm mech, size, leaf uint64)
 		}
 	}
 	sort.Slice(query, func(i, j int) bool {
-		return query[i].Leaf < query[j].Leaf
+		if query[i].Leaf != query[j].Leaf {
+			return query[i].Leaf < query[j].Leaf
+		}
+		return query[i].Level < query[j].Level
 	})
 
 	// collect the logs
@@ -291,7 +294,7 @@ func (n NodeInterface) ConstructOutboxProof(c ctx, evm mech, size, leaf uint64)
 	var searchErr error
 	var searchPositions = make(map[hash]struct{})
 	for _, item := range query {
-		hash := common.BigToHash(item.ToBigInt())
+		hash := item.ToHash()
 		searchPositions[hash] = struct{}{}
 	}
 	search = func(lo, hi uint64, find []merkletree.LevelAndLeaf) {
@@ -370,10 +373,10 @@ func (n NodeInterface) ConstructOutboxProof(c ctx, evm mech, size, leaf uint64)
 	for _, log := range searchLogs {
 
 		hash := log.Topics[2]
-		position := log.Topics[3]
+		position := merkletree.PositionTopic(log.Topics[3])
 
-		level := new(big.Int).SetBytes(position[:8]).Uint64()
-		leafAdded := new(big.Int).SetBytes(position[8:]).Uint64()
+		level := position.Level()
+		leafAdded := position.Leaf()
 
 		if level == 0 && leafAdded == leaf {
 			send = hash
@@ -441,6 +444,7 @@ func (n NodeInterface) ConstructOutboxProof(c ctx, evm mech, size, leaf uint64)
 		}
 	}
 
+	// the proof follows the order of the walk, not of the maps, so it's deterministic
 	hashes := make([]hash, len(nodes))
 	for i, place := range nodes {
 		hash, ok := known[place]
@@ -146,10 +146,7 @@ func (con *ArbSys) SendTxToL1(c ctx, evm mech, value huge, destination addr, cal
 	}
 
 	for _, merkleUpdateEvent := range merkleUpdateEvents {
-		position := merkletree.LevelAndLeaf{
-			Level: merkleUpdateEvent.Level,
-			Leaf:  merkleUpdateEvent.NumLeaves,
-		}
+		position := merkletree.EventPosition(merkleUpdateEvent)
 		err := con.SendMerkleUpdate(
 			c,
 			evm,
@@ -13,21 +13,33 @@ import (
 	"github.com/ethereum/go-ethereum/params"
 )
 
-// NextPowerOf2 the smallest power of two greater than the input
+// NextPowerOf2 the smallest power of two greater than the input, and 1 for 0.
+// No power of 2 above 1<<63 fits, so larger inputs return MaxUint64 rather than wrapping to 0. MaxUint64 isn't a
+// power of 2, so callers that can be given such inputs must check for it as a sentinel.
 func NextPowerOf2(value uint64) uint64 {
+	if value >= 1<<63 {
+		return math.MaxUint64
+	}
 	return 1 << Log2ceil(value)
 }
 
-// NextOrCurrentPowerOf2 the smallest power of no less than the input
+// NextOrCurrentPowerOf2 the smallest power of no less than the input, returning the MaxUint64 sentinel for inputs
+// above 1<<63 like NextPowerOf2
 func NextOrCurrentPowerOf2(value uint64) uint64 {
-	power := NextPowerOf2(value)
-	if power == 2*value {
-		power /= 2
+	if IsPowerOf2(value) {
+		return value
 	}
-	return power
+	return NextPowerOf2(value)
+}
+
+// IsPowerOf2 whether the input is a power of 2, which 0 isn't
+func IsPowerOf2(value uint64) bool {
+	return value != 0 && value&(value-1) == 0
 }
 
-// Log2ceil the log2 of the int, rounded up
+// Log2ceil the log2 of the int, rounded up, or rather the number of bits needed to represent it.
+// Powers of 2 thus round up to the next log (Log2ceil(4) is 3), and Log2ceil(0) is 0.
+// NextPowerOf2(v) is 1 << Log2ceil(v) for v below 1<<63, which the outbox proof code relies on.
 func Log2ceil(value uint64) uint64 {
 	return uint64(64 - bits.LeadingZeros64(value))
 }
@@ -97,6 +97,63 @@ func TestMath(t *testing.T) {
 	assert(uint16(math.MaxUint16) == SaturatingUUCast[uint16, uint16](math.MaxUint16))
 }
 
+func TestPowersOf2Consistency(t *testing.T) {
+	for value := uint64(0); value <= 10000; value++ {
+		power := NextPowerOf2(value)
+		if power != 1<<Log2ceil(value) {
+			Fail(t, "NextPowerOf2 and Log2ceil disagree for", value)
+		}
+		if power <= value || power/2 > value {
+			Fail(t, "NextPowerOf2 isn't the smallest power of 2 greater than", value, power)
+		}
+		isPower := value != 0 && value&(value-1) == 0
+		if IsPowerOf2(value) != isPower {
+			Fail(t, "IsPowerOf2 is wrong for", value)
+		}
+		if balanced := value == power/2; balanced != (isPower || value == 0) {
+			Fail(t, "balanced-tree check is wrong for", value)
+		}
+		current := NextOrCurrentPowerOf2(value)
+		if (isPower && current != value) || (!isPower && current != power) {
+			Fail(t, "NextOrCurrentPowerOf2 is wrong for", value, current)
+		}
+	}
+}
+
+func TestPowersOf2Boundaries(t *testing.T) {
+	for _, test := range []struct {
+		value, next, nextOrCurrent, log uint64
+		isPower                         bool
+	}{
+		{0, 1, 1, 0, false},
+		{1<<62 - 1, 1 << 62, 1 << 62, 62, false},
+		{1 << 62, 1 << 63, 1 << 62, 63, true},
+		{1<<62 + 1, 1 << 63, 1 << 63, 63, false},
+		{1<<63 - 1, 1 << 63, 1 << 63, 63, false},
+		{1 << 63, math.MaxUint64, 1 << 63, 64, true},
+		{1<<63 + 1, math.MaxUint64, math.MaxUint64, 64, false},
+		{math.MaxUint64, math.MaxUint64, math.MaxUint64, 64, false},
+	} {
+		if next := NextPowerOf2(test.value); next != test.next {
+			Fail(t, "NextPowerOf2 of", test.value, "is", next, "rather than", test.next)
+		}
+		if next := NextOrCurrentPowerOf2(test.value); next != test.nextOrCurrent {
+			Fail(t, "NextOrCurrentPowerOf2 of", test.value, "is", next, "rather than", test.nextOrCurrent)
+		}
+		if log := Log2ceil(test.value); log != test.log {
+			Fail(t, "Log2ceil of", test.value, "is", log, "rather than", test.log)
+		}
+		if IsPowerOf2(test.value) != test.isPower {
+			Fail(t, "IsPowerOf2 is wrong for", test.value)
+		}
+	}
+	for i := 0; i < 64; i++ {
+		if !IsPowerOf2(1<<i) || (i > 1 && IsPowerOf2(1<<i-1)) || (i > 0 && IsPowerOf2(1<<i+1)) {
+			Fail(t, "IsPowerOf2 is wrong near 2^", i)
+		}
+	}
+}
+
 func TestSlices(t *testing.T) {
 	assert_eq := func(left, right []uint8) {
 		t.Helper()
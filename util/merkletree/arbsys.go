@@ -0,0 +1,79 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+// SendRoot fetches the root and size of the send tree from ArbSys as of the given block, or the latest if nil
+func SendRoot(ctx context.Context, client bind.ContractCaller, arbSysAddress common.Address, blockNum *big.Int) (common.Hash, uint64, error) {
+	arbSys, err := precompilesgen.NewArbSysCaller(arbSysAddress, client)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	state, err := arbSys.SendMerkleTreeState(&bind.CallOpts{Context: ctx, BlockNumber: blockNum})
+	if err != nil {
+		return common.Hash{}, 0, fmt.Errorf("failed to get the send merkle tree state: %w", err)
+	}
+	if state.Size == nil || !state.Size.IsUint64() {
+		return common.Hash{}, 0, errors.New("ArbSys returned an invalid send tree size")
+	}
+	return state.Root, state.Size.Uint64(), nil
+}
+
+// RootCommittedInBlock checks whether ArbSys's send root was the given root as of the given block,
+// so a proof's claimed root can be tied to the chain rather than trusted from whoever supplied it
+func RootCommittedInBlock(ctx context.Context, client bind.ContractCaller, root common.Hash, blockNum uint64) (bool, error) {
+	sendRoot, _, err := SendRoot(ctx, client, types.ArbSysAddress, new(big.Int).SetUint64(blockNum))
+	if err != nil {
+		return false, err
+	}
+	return sendRoot == root, nil
+}
+
+// MonitorRoot compares a snapshot of the local send tree to the chain's latest send tree every interval,
+// calling onDivergence whenever their roots or sizes differ, until the context is done.
+// The snapshot should be taken under whatever lock guards appends to the local tree, so its root and size agree.
+// Failing to read the chain's root is logged and retried on the next tick.
+func MonitorRoot(
+	ctx context.Context,
+	client bind.ContractCaller,
+	arbSysAddress common.Address,
+	snapshot func() (root common.Hash, size uint64, err error),
+	interval time.Duration,
+	onDivergence func(chainRoot common.Hash, chainSize uint64, localRoot common.Hash, localSize uint64),
+) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		chainRoot, chainSize, err := SendRoot(ctx, client, arbSysAddress, nil)
+		if err != nil {
+			log.Warn("failed to get the send root from chain", "err", err)
+		} else {
+			localRoot, localSize, err := snapshot()
+			if err != nil {
+				return err
+			}
+			if chainRoot != localRoot || chainSize != localSize {
+				onDivergence(chainRoot, chainSize, localRoot, localSize)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
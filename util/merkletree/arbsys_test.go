@@ -0,0 +1,165 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+// arbSysSimulator answers sendMerkleTreeState calls with the state recorded for each block
+type arbSysSimulator struct {
+	t      *testing.T
+	mutex  sync.Mutex
+	states []SendMerkleTreeStateResult // the state as of each block
+}
+
+func (s *arbSysSimulator) setState(block uint64, state SendMerkleTreeStateResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for uint64(len(s.states)) <= block {
+		s.states = append(s.states, state)
+	}
+	s.states[block] = state
+}
+
+func (s *arbSysSimulator) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{0xfe}, nil
+}
+
+func (s *arbSysSimulator) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if call.To == nil || *call.To != types.ArbSysAddress {
+		return nil, errors.New("call isn't to ArbSys")
+	}
+	if len(s.states) == 0 {
+		return nil, errors.New("no blocks")
+	}
+	block := uint64(len(s.states) - 1)
+	if blockNumber != nil {
+		block = blockNumber.Uint64()
+	}
+	if block >= uint64(len(s.states)) {
+		return nil, errors.New("block not found")
+	}
+	arbSysAbi, err := precompilesgen.ArbSysMetaData.GetAbi()
+	Require(s.t, err)
+	state := s.states[block]
+	return arbSysAbi.Methods["sendMerkleTreeState"].Outputs.Pack(state.Size, state.Root, state.Partials)
+}
+
+func TestSendRoot(t *testing.T) {
+	ctx := context.Background()
+	simulator := &arbSysSimulator{t: t}
+	acc := initializedMerkleAccumulatorForTesting()
+	roots := []common.Hash{}
+	for block := uint64(0); block < 6; block++ {
+		simulator.setState(block, sendTreeStateForTesting(t, acc))
+		roots = append(roots, root(t, acc))
+		accAppend(t, acc, pseudorandomForTesting(block))
+	}
+
+	for block, expected := range roots {
+		root, size, err := SendRoot(ctx, simulator, types.ArbSysAddress, big.NewInt(int64(block)))
+		Require(t, err)
+		if root != expected || size != uint64(block) {
+			Fail(t, "wrong state at block", block, root, size)
+		}
+	}
+	root, size, err := SendRoot(ctx, simulator, types.ArbSysAddress, nil)
+	Require(t, err)
+	if root != roots[len(roots)-1] || size != uint64(len(roots)-1) {
+		Fail(t, "wrong latest state", root, size)
+	}
+	if _, _, err := SendRoot(ctx, simulator, types.ArbSysAddress, big.NewInt(100)); err == nil {
+		Fail(t, "got a root for a block that doesn't exist")
+	}
+}
+
+func TestRootCommittedInBlock(t *testing.T) {
+	ctx := context.Background()
+	simulator := &arbSysSimulator{t: t}
+	acc := initializedMerkleAccumulatorForTesting()
+	roots := []common.Hash{}
+	for block := uint64(0); block < 5; block++ {
+		accAppend(t, acc, pseudorandomForTesting(block))
+		simulator.setState(block, sendTreeStateForTesting(t, acc))
+		roots = append(roots, root(t, acc))
+	}
+	for block := range roots {
+		for i, root := range roots {
+			committed, err := RootCommittedInBlock(ctx, simulator, root, uint64(block))
+			Require(t, err)
+			if committed != (i == block) {
+				Fail(t, "root", i, "committed in block", block, "is", committed)
+			}
+		}
+	}
+	if _, err := RootCommittedInBlock(ctx, simulator, roots[0], 100); err == nil {
+		Fail(t, "checked a root in a block that doesn't exist")
+	}
+}
+
+func TestMonitorRoot(t *testing.T) {
+	simulator := &arbSysSimulator{t: t}
+	chain := initializedMerkleAccumulatorForTesting()
+	local := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 5; i++ {
+		accAppend(t, chain, pseudorandomForTesting(i))
+		if i < 3 {
+			accAppend(t, local, pseudorandomForTesting(i))
+		}
+	}
+	simulator.setState(0, sendTreeStateForTesting(t, chain))
+	var mutex sync.Mutex
+	snapshot := func() (common.Hash, uint64, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		size, root, _, err := local.StateForExport()
+		return root, size, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	divergences := 0
+	err := MonitorRoot(ctx, simulator, types.ArbSysAddress, snapshot, time.Millisecond, func(chainRoot common.Hash, chainSize uint64, localRoot common.Hash, localSize uint64) {
+		if chainRoot != root(t, chain) || localRoot != root(t, local) {
+			Fail(t, "wrong roots reported", chainRoot, localRoot)
+		}
+		if chainSize != 5 || localSize != 3 {
+			Fail(t, "wrong sizes reported", chainSize, localSize)
+		}
+		divergences++
+		if divergences == 2 {
+			cancel()
+		}
+	})
+	Require(t, err)
+	if divergences != 2 {
+		Fail(t, "expected the divergence to be reported on consecutive ticks, got", divergences)
+	}
+
+	// once the local accumulator catches up, there's nothing to report
+	mutex.Lock()
+	for i := uint64(3); i < 5; i++ {
+		accAppend(t, local, pseudorandomForTesting(i))
+	}
+	mutex.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = MonitorRoot(ctx, simulator, types.ArbSysAddress, snapshot, time.Millisecond, func(chainRoot common.Hash, chainSize uint64, localRoot common.Hash, localSize uint64) {
+		Fail(t, "reported a divergence for matching trees", chainRoot, chainSize, localRoot, localSize)
+	})
+	Require(t, err)
+}
@@ -4,6 +4,10 @@
 package merkletree
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/offchainlabs/nitro/util/testhelpers"
@@ -18,3 +22,28 @@ func Fail(t *testing.T, printables ...interface{}) {
 	t.Helper()
 	testhelpers.FailImpl(t, printables...)
 }
+
+// CompareToGolden checks the proof serializes to the contents of the golden file.
+// Run with UPDATE_GOLDEN=1 to regenerate the file instead.
+func CompareToGolden(t *testing.T, proof *MerkleProof, goldenPath string) {
+	t.Helper()
+	data, err := json.MarshalIndent(proof, "", "  ")
+	Require(t, err)
+	data = append(data, '\n')
+	compareBytesToGolden(t, data, goldenPath)
+}
+
+// compareBytesToGolden is like CompareToGolden for output that's already rendered
+func compareBytesToGolden(t *testing.T, data []byte, goldenPath string) {
+	t.Helper()
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		Require(t, os.MkdirAll(filepath.Dir(goldenPath), 0o755))
+		Require(t, os.WriteFile(goldenPath, data, 0o600))
+		return
+	}
+	golden, err := os.ReadFile(goldenPath)
+	Require(t, err, "run with UPDATE_GOLDEN=1 to create", goldenPath)
+	if !bytes.Equal(data, golden) {
+		Fail(t, "output differs from", goldenPath, "\ngot:\n", string(data), "\nwant:\n", string(golden))
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// ConsistencyProof shows the tree of OldSize leaves is a prefix of the tree of NewSize leaves, so that none of
+// the sends committed to by the old root were rewritten. Nodes holds, from left to right, the complete subtrees
+// making up the old tree followed by those covering the leaves appended since. The old tree's subtrees are its
+// partials, and if the old tree is balanced its only subtree is its root, which is left out.
+type ConsistencyProof struct {
+	OldSize uint64
+	NewSize uint64
+	Nodes   []common.Hash
+	hasher  Hasher // nil for Keccak256
+}
+
+// ProveConsistency proves the tree as it was with oldSize leaves is a prefix of the tree as it is now.
+// The accumulator only keeps the partials of its current size, which don't determine those of earlier sizes,
+// so the proof is made from a tree holding the nodes in question, such as one built by appending each send.
+// The proof is verified with the tree's hasher.
+func ProveConsistency(tree MerkleTree, oldSize uint64) (*ConsistencyProof, error) {
+	newSize := tree.Size()
+	if oldSize > newSize {
+		return nil, fmt.Errorf("the old size %v exceeds the tree's size of %v", oldSize, newSize)
+	}
+	proof := &ConsistencyProof{
+		OldSize: oldSize,
+		NewSize: newSize,
+		Nodes:   []common.Hash{},
+		hasher:  proofHasher(hasherOf(tree)),
+	}
+	for _, place := range consistencyPositions(oldSize, newSize) {
+		hash, err := subtreeHash(tree, place)
+		if err != nil {
+			return nil, err
+		}
+		proof.Nodes = append(proof.Nodes, hash)
+	}
+	return proof, nil
+}
+
+// Verify checks the proof shows the old root is that of a prefix of the tree with the new root
+func (proof *ConsistencyProof) Verify(oldRoot, newRoot common.Hash) bool {
+	if proof.OldSize > proof.NewSize {
+		return false
+	}
+	positions := consistencyPositions(proof.OldSize, proof.NewSize)
+	if len(positions) != len(proof.Nodes) {
+		return false
+	}
+	if proof.OldSize == 0 {
+		// every tree extends the empty one
+		return oldRoot == (common.Hash{}) && len(proof.Nodes) == 0
+	}
+	if proof.OldSize == proof.NewSize {
+		return oldRoot == newRoot && len(proof.Nodes) == 0
+	}
+
+	oldNodes := make(map[LevelAndLeaf]common.Hash)
+	newNodes := make(map[LevelAndLeaf]common.Hash)
+	oldBlocks := completeSubtrees(0, proof.OldSize)
+	if len(oldBlocks) == 1 {
+		// a balanced tree is a single subtree
+		oldNodes[oldBlocks[0]] = oldRoot
+		newNodes[oldBlocks[0]] = oldRoot
+	}
+	for i, place := range positions {
+		if place.Leaf < proof.OldSize {
+			oldNodes[place] = proof.Nodes[i]
+		}
+		newNodes[place] = proof.Nodes[i]
+	}
+
+	hasher := orKeccak256(proof.hasher)
+	recoveredOld, err := rootFromSubtrees(oldNodes, proof.OldSize, hasher)
+	if err != nil || recoveredOld != oldRoot {
+		return false
+	}
+	recoveredNew, err := rootFromSubtrees(newNodes, proof.NewSize, hasher)
+	return err == nil && recoveredNew == newRoot
+}
+
+// consistencyPositions finds the nodes a ConsistencyProof holds, from left to right
+func consistencyPositions(oldSize, newSize uint64) []LevelAndLeaf {
+	if oldSize == 0 || oldSize >= newSize {
+		return nil
+	}
+	positions := completeSubtrees(0, oldSize)
+	if len(positions) == 1 {
+		positions = nil // the old root
+	}
+	return append(positions, completeSubtrees(oldSize, newSize)...)
+}
+
+// completeSubtrees covers the leaves from start up to but excluding end with the fewest complete subtrees,
+// from left to right. Starting from zero, the subtrees are the partials of a tree of end leaves.
+func completeSubtrees(start, end uint64) []LevelAndLeaf {
+	positions := []LevelAndLeaf{}
+	for start < end {
+		level := uint64(0)
+		for {
+			width := uint64(2) << level
+			if start%width != 0 || start+width > end {
+				break
+			}
+			level++
+		}
+		width := uint64(1) << level
+		positions = append(positions, NewLevelAndLeaf(level, start+width-1))
+		start += width
+	}
+	return positions
+}
+
+// rootFromSubtrees computes the root of a tree of the given size from the complete subtrees covering its
+// leaves, padding it with empty subtrees up to its capacity
+func rootFromSubtrees(subtrees map[LevelAndLeaf]common.Hash, size uint64, hasher Hasher) (common.Hash, error) {
+	var node func(level, first uint64) (common.Hash, error)
+	node = func(level, first uint64) (common.Hash, error) {
+		if first >= size {
+			return common.Hash{}, nil
+		}
+		width := uint64(1) << level
+		if hash, ok := subtrees[NewLevelAndLeaf(level, first+width-1)]; ok {
+			return hash, nil
+		}
+		if level == 0 {
+			return common.Hash{}, fmt.Errorf("no subtree covers leaf %v", first)
+		}
+		left, err := node(level-1, first)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		right, err := node(level-1, first+width/2)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return hasher(left, right), nil
+	}
+	capacity, err := treeCapacity(size)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return node(arbmath.Log2ceil(capacity)-1, 0)
+}
+
+// subtreeHash finds the hash of the complete subtree at the given position
+func subtreeHash(tree MerkleTree, place LevelAndLeaf) (common.Hash, error) {
+	width := uint64(1) << place.Level
+	first := place.Leaf + 1 - width
+	for {
+		if tree.Capacity() == width {
+			return tree.Hash(), nil
+		}
+		node, ok := internalNode(tree)
+		if !ok {
+			return common.Hash{}, errors.New("the tree is summarized above the subtree")
+		}
+		half := node.left.Capacity()
+		if first < half {
+			tree = node.left
+		} else {
+			tree = node.right
+			first -= half
+		}
+	}
+}
+
+// FirstDivergence finds the first leaf at which two trees differ, comparing only the leaves both have, so found
+// is false when one is a prefix of the other. Subtrees that match are skipped by their hashes, and those that
+// don't are descended into, so the trees must hold their nodes: an accumulator's partials alone can't locate a
+// leaf within the subtrees they summarize.
+func FirstDivergence(a, b MerkleTree) (uint64, bool, error) {
+	shared := arbmath.MinInt(a.Size(), b.Size())
+	if shared == 0 {
+		return 0, false, nil
+	}
+	var search func(level, first uint64) (uint64, bool, error)
+	search = func(level, first uint64) (uint64, bool, error) {
+		width := uint64(1) << level
+		if first >= shared {
+			return 0, false, nil
+		}
+		if first+width <= shared {
+			place := NewLevelAndLeaf(level, first+width-1)
+			hashA, err := subtreeHash(a, place)
+			if err != nil {
+				return 0, false, err
+			}
+			hashB, err := subtreeHash(b, place)
+			if err != nil {
+				return 0, false, err
+			}
+			if hashA == hashB {
+				return 0, false, nil
+			}
+			if level == 0 {
+				return first, true, nil
+			}
+		}
+		if index, found, err := search(level-1, first); found || err != nil {
+			return index, found, err
+		}
+		return search(level-1, first+width/2)
+	}
+	return search(arbmath.Log2ceil(arbmath.NextOrCurrentPowerOf2(shared))-1, 0)
+}
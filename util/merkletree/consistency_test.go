@@ -0,0 +1,113 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestConsistencyProof(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	roots := []common.Hash{root(t, acc)}
+	tree := NewEmptyMerkleTree()
+	for i := uint64(0); i < 21; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+		tree = tree.Append(pseudorandomForTesting(i))
+		roots = append(roots, root(t, acc))
+	}
+
+	for _, newSize := range []uint64{1, 2, 3, 4, 5, 8, 13, 16, 21} {
+		tree := NewMerkleTreeFromLeaves(leavesForTesting(newSize))
+		for oldSize := uint64(0); oldSize <= newSize; oldSize++ {
+			proof, err := ProveConsistency(tree, oldSize)
+			Require(t, err)
+			if !proof.Verify(roots[oldSize], roots[newSize]) {
+				Fail(t, "bad consistency proof from", oldSize, "to", newSize)
+			}
+			if (oldSize == 0 || oldSize == newSize) && len(proof.Nodes) != 0 {
+				Fail(t, "expected an empty proof from", oldSize, "to", newSize)
+			}
+			if oldSize == 0 || oldSize == newSize {
+				continue
+			}
+			if proof.Verify(roots[oldSize-1], roots[newSize]) {
+				Fail(t, "proof from", oldSize, "to", newSize, "accepted the wrong old root")
+			}
+			for i := range proof.Nodes {
+				tampered := *proof
+				tampered.Nodes = append([]common.Hash{}, proof.Nodes...)
+				tampered.Nodes[i][0] ^= 1
+				if tampered.Verify(roots[oldSize], roots[newSize]) {
+					Fail(t, "tampered node", i, "accepted from", oldSize, "to", newSize)
+				}
+			}
+		}
+	}
+
+	// a tree of 3 extends one of 2 with its last leaf, which is the only node needed
+	proof, err := ProveConsistency(NewMerkleTreeFromLeaves(leavesForTesting(3)), 2)
+	Require(t, err)
+	if len(proof.Nodes) != 1 {
+		Fail(t, "expected a single node, got", len(proof.Nodes))
+	}
+	// extending a tree of 5 to one of 8 needs its partials and the 3 leaves after them
+	proof, err = ProveConsistency(NewMerkleTreeFromLeaves(leavesForTesting(8)), 5)
+	Require(t, err)
+	if len(proof.Nodes) != 4 {
+		Fail(t, "expected 4 nodes, got", len(proof.Nodes))
+	}
+
+	if _, err := ProveConsistency(tree, 22); err == nil {
+		Fail(t, "proved consistency with a tree larger than the current one")
+	}
+	if _, err := ProveConsistency(tree.SummarizeUpTo(16), 5); err == nil {
+		Fail(t, "proved consistency from a summarized tree")
+	}
+}
+
+func leavesForTesting(size uint64) []common.Hash {
+	leaves := make([]common.Hash, size)
+	for i := range leaves {
+		leaves[i] = pseudorandomForTesting(uint64(i))
+	}
+	return leaves
+}
+
+func TestFirstDivergence(t *testing.T) {
+	forked := func(prefix, size uint64) MerkleTree {
+		leaves := leavesForTesting(size)
+		for i := prefix; i < size; i++ {
+			leaves[i] = pseudorandomForTesting(1000 + i)
+		}
+		return NewMerkleTreeFromLeaves(leaves)
+	}
+	for _, sizes := range [][2]uint64{{13, 13}, {8, 21}, {21, 5}, {1, 3}, {16, 16}} {
+		for prefix := uint64(0); prefix <= sizes[0] && prefix <= sizes[1]; prefix++ {
+			a := NewMerkleTreeFromLeaves(leavesForTesting(sizes[0]))
+			b := forked(prefix, sizes[1])
+			index, found, err := FirstDivergence(a, b)
+			Require(t, err)
+			shared := min(sizes[0], sizes[1])
+			if found != (prefix < shared) || (found && index != prefix) {
+				Fail(t, "trees of", sizes, "sharing", prefix, "leaves diverged at", index, found)
+			}
+		}
+	}
+
+	// the accumulator's summaries hide where the trees differ
+	acc := initializedMerkleAccumulatorForTesting()
+	for _, leaf := range leavesForTesting(8) {
+		accAppend(t, acc, leaf)
+	}
+	summarized, err := NewMerkleTreeFromAccumulator(acc)
+	Require(t, err)
+	if _, _, err := FirstDivergence(summarized, forked(3, 8)); err == nil {
+		Fail(t, "located a divergence inside a summary")
+	}
+	if _, found, err := FirstDivergence(summarized, NewMerkleTreeFromLeaves(leavesForTesting(8))); err != nil || found {
+		Fail(t, "identical trees diverged", err)
+	}
+}
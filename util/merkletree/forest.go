@@ -0,0 +1,25 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ForestRoot commits to the roots of several trees at once, as the root of a tree whose leaves are those roots.
+// As with any tree, the roots are hashed to form its leaves.
+func ForestRoot(roots []common.Hash) common.Hash {
+	return NewMerkleTreeFromLeaves(roots).Hash()
+}
+
+// ForestProof proves the root at the given index is in the forest committed to by ForestRoot.
+// The proof's LeafHash is the hash of that root.
+func ForestProof(roots []common.Hash, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(roots) {
+		return nil, fmt.Errorf("tree %v isn't in a forest of %v", index, len(roots))
+	}
+	return ProveLeaf(NewMerkleTreeFromLeaves(roots), uint64(index))
+}
@@ -0,0 +1,44 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestForestProof(t *testing.T) {
+	for _, trees := range []int{1, 2, 3, 8, 13} {
+		roots := []common.Hash{}
+		for i := 0; i < trees; i++ {
+			leaves := []common.Hash{}
+			for j := 0; j <= i; j++ {
+				leaves = append(leaves, pseudorandomForTesting(uint64(100*i+j)))
+			}
+			roots = append(roots, NewMerkleTreeFromLeaves(leaves).Hash())
+		}
+		forestRoot := ForestRoot(roots)
+		for i, treeRoot := range roots {
+			proof, err := ForestProof(roots, i)
+			Require(t, err)
+			if proof.RootHash != forestRoot || proof.LeafHash != crypto.Keccak256Hash(treeRoot.Bytes()) || !proof.IsCorrect() {
+				Fail(t, "bad proof of tree", i, "in a forest of", trees)
+			}
+		}
+
+		changed := append([]common.Hash{}, roots...)
+		changed[trees-1] = pseudorandomForTesting(1000)
+		if ForestRoot(changed) == forestRoot {
+			Fail(t, "forest root didn't commit to the last tree of", trees)
+		}
+		if _, err := ForestProof(roots, trees); err == nil {
+			Fail(t, "proved a tree beyond the forest")
+		}
+	}
+	if _, err := ForestProof(nil, -1); err == nil {
+		Fail(t, "proved a negative index")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+)
+
+// StateSource reads the send tree's state as it was when the tree had the given size,
+// as an archive node can from ArbOS storage at the block that produced it
+type StateSource interface {
+	PartialsAt(size uint64) ([]common.Hash, error)
+}
+
+// HybridProver proves leaves using the node events an indexer retained, falling back to historical state for
+// the nodes whose events were pruned. A complete subtree that's a left child was the partial at its level once
+// the tree grew to include it, so it can be read from state. Right children never are partials, so their events
+// must be retained, unless their children can be found instead.
+type HybridProver struct {
+	events map[LevelAndLeaf]common.Hash
+	state  StateSource
+}
+
+// NewHybridProver makes a prover from the retained events, whose hashes are as they appear in the tree,
+// and the source of historical state
+func NewHybridProver(events []merkleAccumulator.MerkleTreeNodeEvent, stateSource StateSource) *HybridProver {
+	known := make(map[LevelAndLeaf]common.Hash, len(events))
+	for _, event := range events {
+		known[EventPosition(event)] = event.Hash
+	}
+	return &HybridProver{known, stateSource}
+}
+
+// Prove proves the leaf is in the tree of the given size, against the root the state had at that size
+func (p *HybridProver) Prove(leaf, treeSize uint64) (*MerkleProof, error) {
+	if leaf >= treeSize {
+		return nil, fmt.Errorf("leaf %v isn't in a tree of size %v", leaf, treeSize)
+	}
+	partials, err := p.state.PartialsAt(treeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state at size %v: %w", treeSize, err)
+	}
+	acc, err := accumulatorFromPartials(partials, treeSize, Keccak256Hasher)
+	if err != nil {
+		return nil, err
+	}
+	root, err := acc.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[LevelAndLeaf]common.Hash)
+	for _, place := range partialPositions(treeSize) {
+		known[place] = partials[place.Level]
+	}
+	for _, query := range proofQueries(leaf, treeSize) {
+		if _, ok := known[query.place]; ok {
+			continue
+		}
+		hash, err := p.node(query.place)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the %v: %w", query.role, err)
+		}
+		known[query.place] = hash
+	}
+	return NewProofBuilder(WithSelfVerify()).BuildForRoot(leaf, treeSize, root, known)
+}
+
+// node finds the hash of the complete subtree at the given position
+func (p *HybridProver) node(place LevelAndLeaf) (common.Hash, error) {
+	if hash, ok := p.events[place]; ok {
+		return hash, nil
+	}
+	if ((place.Leaf+1)>>place.Level)%2 == 1 {
+		// a left child, which was the partial at its level once the tree grew to its last leaf
+		partials, err := p.state.PartialsAt(place.Leaf + 1)
+		if err != nil {
+			return common.Hash{}, fmt.Errorf("failed to read the state at size %v: %w", place.Leaf+1, err)
+		}
+		if place.Level >= uint64(len(partials)) {
+			return common.Hash{}, fmt.Errorf("state at size %v has no partial at level %v", place.Leaf+1, place.Level)
+		}
+		return partials[place.Level], nil
+	}
+	if place.Level == 0 {
+		return common.Hash{}, fmt.Errorf("leaf %v is a right child with no retained event", place.Leaf)
+	}
+	childLevel := place.Level - 1
+	left, err := p.node(NewLevelAndLeaf(childLevel, place.Leaf-(1<<childLevel)))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	right, err := p.node(NewLevelAndLeaf(childLevel, place.Leaf))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(left.Bytes(), right.Bytes()), nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+)
+
+// stateSourceForTesting serves the partials recorded at each size, counting the reads
+type stateSourceForTesting struct {
+	partials map[uint64][]common.Hash
+	reads    int
+}
+
+func (source *stateSourceForTesting) PartialsAt(size uint64) ([]common.Hash, error) {
+	source.reads++
+	partials, ok := source.partials[size]
+	if !ok {
+		return nil, fmt.Errorf("no state for size %v", size)
+	}
+	return partials, nil
+}
+
+func TestHybridProver(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	state := &stateSourceForTesting{partials: make(map[uint64][]common.Hash)}
+	leaves := []common.Hash{}
+	for i := uint64(0); i <= 16; i++ {
+		size, _, partials, err := acc.StateForExport()
+		Require(t, err)
+		state.partials[size] = partials
+		leaves = append(leaves, pseudorandomForTesting(i))
+		accAppend(t, acc, leaves[i])
+	}
+
+	// the indexer pruned the events for levels 1 and 2
+	retained := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for _, event := range eventHistoryForTesting(t, 16) {
+		if event.Level == 0 || event.Level >= 3 {
+			retained = append(retained, event)
+		}
+	}
+	prover := NewHybridProver(retained, state)
+	for _, treeSize := range []uint64{13, 16} {
+		mt := NewMerkleTreeFromLeaves(leaves[:treeSize])
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			state.reads = 0
+			proof, err := prover.Prove(leaf, treeSize)
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			expected, err := ProveLeaf(mt, leaf)
+			Require(t, err)
+			if !reflect.DeepEqual(proof, expected) || !proof.IsCorrect() {
+				Fail(t, "wrong proof for leaf", leaf, "of", treeSize)
+			}
+			if leaf == 7 && treeSize == 16 && state.reads != 3 {
+				// besides the tree's state, its siblings at levels 1 and 2 were pruned
+				Fail(t, "proof of leaf 7 read the state", state.reads, "times rather than 3")
+			}
+		}
+	}
+
+	// leaf 7's sibling at level 3 is a right child, so without its event it has to be hashed from its children
+	withoutTop := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for _, event := range retained {
+		if event.Level < 3 {
+			withoutTop = append(withoutTop, event)
+		}
+	}
+	if _, err := NewHybridProver(withoutTop, state).Prove(7, 16); err != nil {
+		Fail(t, "couldn't recover the right child from its children", err)
+	}
+	leavesOnly := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for _, event := range retained {
+		if event.Level == 0 && event.NumLeaves != 15 {
+			leavesOnly = append(leavesOnly, event)
+		}
+	}
+	if _, err := NewHybridProver(leavesOnly, state).Prove(7, 16); err == nil {
+		Fail(t, "proved leaf 7 without the last leaf, the only source for its sibling at level 3")
+	}
+	if _, err := NewHybridProver(retained, state).Prove(3, 17); err == nil {
+		Fail(t, "proved against a size with no state")
+	}
+}
@@ -5,12 +5,18 @@ package merkletree
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+	"github.com/offchainlabs/nitro/util/arbmath"
 )
 
 func TestEmptyAccumulator(t *testing.T) {
@@ -133,6 +139,1165 @@ func TestAccumulator4(t *testing.T) {
 	testSerDe(mt, t)
 }
 
+func TestProveLeaf(t *testing.T) {
+	for size := uint64(1); size <= 20; size++ {
+		acc := initializedMerkleAccumulatorForTesting()
+		mt := NewEmptyMerkleTree()
+		for i := uint64(0); i < size; i++ {
+			accAppend(t, acc, pseudorandomForTesting(i))
+			mt = mt.Append(pseudorandomForTesting(i))
+		}
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProveLeaf(mt, leaf)
+			Require(t, err)
+			if proof.LeafHash != crypto.Keccak256Hash(pseudorandomForTesting(leaf).Bytes()) {
+				Fail(t, "wrong leaf hash", leaf, size)
+			}
+			if proof.RootHash != root(t, acc) || !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of", size)
+			}
+		}
+		if _, err := ProveLeaf(mt, mt.Capacity()); err == nil {
+			Fail(t, "proved a leaf beyond the tree's capacity")
+		}
+		if size > 1 && size == mt.Capacity() {
+			// a summary hides its leaves
+			if _, err := ProveLeaf(mt.SummarizeUpTo(size), 0); err == nil {
+				Fail(t, "proved a summarized leaf")
+			}
+		}
+	}
+}
+
+func TestIsBalanced(t *testing.T) {
+	balanced := map[uint64]bool{0: true, 1: true, 2: true, 3: false, 4: true, 7: false, 8: true}
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i <= 8; i++ {
+		isBalanced, err := acc.IsBalanced()
+		Require(t, err)
+		if expected, ok := balanced[i]; ok && isBalanced != expected {
+			Fail(t, "size", i, "balanced:", isBalanced)
+		}
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+}
+
+func TestMaterializedDepth(t *testing.T) {
+	eager := NewEmptyMerkleTree()
+	for i := uint64(0); i < 16; i++ {
+		eager = eager.Append(pseudorandomForTesting(i))
+	}
+	if depth := MaterializedDepth(eager); depth != 4 {
+		Fail(t, "eager tree of 16 leaves has materialized depth", depth)
+	}
+	if depth := MaterializedDepth(eager.SummarizeUpTo(8)); depth != 1 {
+		Fail(t, "tree with a summarized left half has materialized depth", depth)
+	}
+	// the new right half is split once before reaching its own empty half
+	if depth := MaterializedDepth(eager.Append(pseudorandomForTesting(16))); depth != 2 {
+		Fail(t, "tree with an empty subtree has materialized depth", depth)
+	}
+
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 16; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	summarized, err := NewMerkleTreeFromAccumulator(acc)
+	Require(t, err)
+	if depth := MaterializedDepth(summarized); depth != 0 {
+		Fail(t, "summary-only tree has materialized depth", depth)
+	}
+	if depth := MaterializedDepth(NewEmptyMerkleTree()); depth != 0 {
+		Fail(t, "empty tree has materialized depth", depth)
+	}
+}
+
+func TestVerifyWithIntermediates(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 11; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	for leaf := uint64(0); leaf < 11; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		intermediates, err := proof.VerifyWithIntermediates()
+		Require(t, err)
+		if len(intermediates) != len(proof.Proof)+1 || intermediates[0] != proof.LeafHash {
+			Fail(t, "intermediates don't start at the leaf", leaf)
+		}
+		if intermediates[len(intermediates)-1] != proof.RootHash {
+			Fail(t, "intermediates don't end at the root", leaf)
+		}
+
+		// the node above the leaf's sibling pair is on the path
+		parent := NewMerkleInternal(
+			NewMerkleLeaf(pseudorandomForTesting(leaf&^1)),
+			NewMerkleLeaf(pseudorandomForTesting(leaf|1)),
+		)
+		if leaf|1 < 11 && intermediates[1] != parent.Hash() {
+			Fail(t, "wrong intermediate at level 1", leaf)
+		}
+
+		proof.Proof[0] = pseudorandomForTesting(1000)
+		if _, err := proof.VerifyWithIntermediates(); !errors.Is(err, ErrRootMismatch) {
+			Fail(t, "wrong error for a bad proof", err)
+		}
+	}
+
+	// it rejects the proofs Verify does, for the same reasons
+	outside := &MerkleProof{LeafIndex: 16, Proof: make([]common.Hash, 4)}
+	if _, err := outside.VerifyWithIntermediates(); !errors.Is(err, ErrLeafIndexOutOfRange) {
+		Fail(t, "wrong error for a leaf beyond the proof's depth", err)
+	}
+	tooDeep := &MerkleProof{Proof: make([]common.Hash, 65)}
+	if _, err := tooDeep.VerifyWithIntermediates(); !errors.Is(err, ErrProofLengthMismatch) {
+		Fail(t, "wrong error for a proof deeper than a tree can be", err)
+	}
+}
+
+func TestVerifyVerbose(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(11))
+	for leaf := uint64(0); leaf < 11; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		steps, ok := proof.VerifyVerbose()
+		if !ok || len(steps) != len(proof.Proof) {
+			Fail(t, "wrong trace of the proof of leaf", leaf, ok, len(steps))
+		}
+		recomputed, err := proof.computeRoot(Keccak256Hasher, nil)
+		Require(t, err)
+		if steps[len(steps)-1].Parent != recomputed || recomputed != proof.RootHash {
+			Fail(t, "trace of leaf", leaf, "doesn't end at the root")
+		}
+		for i, step := range steps {
+			below := proof.LeafHash
+			if i > 0 {
+				below = steps[i-1].Parent
+			}
+			if step.Level != uint64(i) || step.Hash != below || step.Sibling != proof.Proof[i] {
+				Fail(t, "step", i, "of leaf", leaf, "doesn't follow the one below")
+			}
+			if step.SiblingOnLeft != (leaf&(1<<i) != 0) {
+				Fail(t, "step", i, "of leaf", leaf, "has the sibling on the wrong side")
+			}
+		}
+
+		proof.Proof[len(proof.Proof)-1] = pseudorandomForTesting(1000)
+		steps, ok = proof.VerifyVerbose()
+		if ok || len(steps) != len(proof.Proof) || steps[len(steps)-1].Parent == proof.RootHash {
+			Fail(t, "wrong trace of a bad proof of leaf", leaf)
+		}
+	}
+
+	// proofs Verify rejects without hashing aren't traced
+	for _, bad := range []*MerkleProof{
+		{LeafIndex: 16, Proof: make([]common.Hash, 4)},
+		{Proof: make([]common.Hash, 65)},
+	} {
+		if steps, ok := bad.VerifyVerbose(); ok || steps != nil {
+			Fail(t, "traced a proof with", len(bad.Proof), "siblings of leaf", bad.LeafIndex)
+		}
+	}
+}
+
+// treeNodesForTesting maps the position of every node in the tree to its hash, empty subtrees included
+func treeNodesForTesting(tree MerkleTree) map[LevelAndLeaf]common.Hash {
+	nodes := make(map[LevelAndLeaf]common.Hash)
+	var walk func(node MerkleTree, first uint64)
+	walk = func(node MerkleTree, first uint64) {
+		level := arbmath.Log2ceil(node.Capacity()) - 1
+		nodes[NewLevelAndLeaf(level, first+node.Capacity()-1)] = node.Hash()
+		if internal, ok := internalNode(node); ok {
+			walk(internal.left, first)
+			walk(internal.right, first+internal.left.Capacity())
+		}
+	}
+	walk(tree, 0)
+	return nodes
+}
+
+func TestReconstructNodes(t *testing.T) {
+	for _, treeSize := range []uint64{1, 2, 5, 8, 13} {
+		mt := NewEmptyMerkleTree()
+		leaves := []common.Hash{}
+		for i := uint64(0); i < treeSize; i++ {
+			leaves = append(leaves, pseudorandomForTesting(i))
+			mt = mt.Append(leaves[i])
+		}
+		tree := treeNodesForTesting(mt)
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := ProveLeaf(mt, leaf)
+			Require(t, err)
+			nodes := proof.ReconstructNodes(treeSize)
+			if len(nodes) != 2*len(proof.Proof)+1 {
+				Fail(t, "reconstructed", len(nodes), "nodes for leaf", leaf, "of", treeSize)
+			}
+			for place, hash := range nodes {
+				if expected, ok := tree[place]; !ok || hash != expected {
+					Fail(t, "node", place, "differs from the tree for leaf", leaf, "of", treeSize)
+				}
+			}
+			if nodes[NewLevelAndLeaf(uint64(len(proof.Proof)), arbmath.NextOrCurrentPowerOf2(treeSize)-1)] != mt.Hash() {
+				Fail(t, "the path doesn't end at the root for leaf", leaf, "of", treeSize)
+			}
+
+			compact, err := NewProofBuilder(WithExplicitEmptySiblings(false)).Build(leaf, treeSize, completeNodesForTesting(leaves))
+			Require(t, err)
+			if !reflect.DeepEqual(compact.ReconstructNodes(treeSize), nodes) {
+				Fail(t, "compact proof reconstructs different nodes for leaf", leaf, "of", treeSize)
+			}
+		}
+		if nodes := (&MerkleProof{LeafIndex: treeSize}).ReconstructNodes(treeSize); nodes != nil {
+			Fail(t, "reconstructed nodes for a leaf beyond the tree")
+		}
+	}
+}
+
+func TestNewMerkleTreeFromLeaves(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	leaves := []common.Hash{}
+	appended := NewEmptyMerkleTree()
+	for size := uint64(0); size <= 33; size++ {
+		tree := NewMerkleTreeFromLeaves(leaves)
+		if tree.Hash() != root(t, acc) || tree.Size() != size {
+			Fail(t, "standalone tree differs from the accumulator at size", size)
+		}
+		var built, expected bytes.Buffer
+		Require(t, tree.Serialize(&built))
+		Require(t, appended.Serialize(&expected))
+		if !bytes.Equal(built.Bytes(), expected.Bytes()) {
+			Fail(t, "standalone tree isn't shaped like an appended one at size", size)
+		}
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProveLeaf(tree, leaf)
+			Require(t, err)
+			if !proof.IsCorrect() {
+				Fail(t, "bad proof of leaf", leaf, "of standalone tree", size)
+			}
+		}
+
+		leaves = append(leaves, pseudorandomForTesting(size))
+		appended = appended.Append(leaves[size])
+		accAppend(t, acc, leaves[size])
+	}
+}
+
+func sha256HasherForTesting(left, right common.Hash) common.Hash {
+	return sha256.Sum256(append(left.Bytes(), right.Bytes()...))
+}
+
+func TestHasher(t *testing.T) {
+	acc := merkleAccumulator.NewNonpersistentMerkleAccumulatorWithHasher(sha256HasherForTesting)
+	appended := NewEmptyMerkleTreeWithHasher(sha256HasherForTesting)
+	leaves := []common.Hash{}
+	for size := uint64(1); size <= 13; size++ {
+		leaves = append(leaves, pseudorandomForTesting(size))
+		appended = appended.Append(leaves[size-1])
+		accAppend(t, acc, leaves[size-1])
+
+		built := NewMerkleTreeFromLeavesWithHasher(leaves, sha256HasherForTesting)
+		fromAcc, err := NewMerkleTreeFromAccumulator(acc)
+		Require(t, err)
+		if built.Hash() != root(t, acc) || appended.Hash() != root(t, acc) || fromAcc.Hash() != root(t, acc) {
+			Fail(t, "trees built with the same hasher differ at size", size)
+		}
+		if size > 1 && built.Hash() == NewMerkleTreeFromLeaves(leaves).Hash() {
+			Fail(t, "hasher was ignored at size", size)
+		}
+
+		_, _, partials, err := acc.StateForExport()
+		Require(t, err)
+		restored, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartialsWithHasher(partials, sha256HasherForTesting)
+		Require(t, err)
+		if root(t, restored) != root(t, acc) {
+			Fail(t, "accumulator restored from partials has a different root at size", size)
+		}
+
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProveLeaf(appended, leaf)
+			Require(t, err)
+			if !proof.IsCorrectWithHasher(sha256HasherForTesting) {
+				Fail(t, "bad proof of leaf", leaf, "of", size)
+			}
+			if !proof.IsCorrect() {
+				Fail(t, "proof of leaf", leaf, "of", size, "doesn't verify with its own hasher")
+			}
+			if size > 1 && proof.IsCorrectWithHasher(Keccak256Hasher) {
+				Fail(t, "proof of leaf", leaf, "of", size, "is correct with the default hasher")
+			}
+		}
+	}
+
+	// summarizing keeps the hasher for later appends
+	summarized := appended.SummarizeUpTo(8).Append(pseudorandomForTesting(14))
+	accAppend(t, acc, pseudorandomForTesting(14))
+	if summarized.Hash() != root(t, acc) {
+		Fail(t, "summarized tree lost its hasher")
+	}
+}
+
+func TestHasherProofs(t *testing.T) {
+	acc := merkleAccumulator.NewNonpersistentMerkleAccumulatorWithHasher(sha256HasherForTesting)
+	tree := NewEmptyMerkleTreeWithHasher(sha256HasherForTesting)
+	roots := []ProofRoot{}
+	appends := []*MerkleProof{}
+	for i := uint64(0); i < 21; i++ {
+		appendProof, err := AppendProofNoClone(acc, pseudorandomForTesting(i))
+		Require(t, err)
+		appends = append(appends, appendProof)
+		accAppend(t, acc, pseudorandomForTesting(i))
+		tree = tree.Append(pseudorandomForTesting(i))
+		roots = append(roots, ProofRoot{root(t, acc), size(t, acc)})
+		if appendProof.RootHash != root(t, acc) || !appendProof.IsCorrect() {
+			Fail(t, "append proof of leaf", i, "doesn't use the accumulator's hasher")
+		}
+	}
+	Require(t, VerifyAppendChain(appends))
+
+	for _, past := range roots {
+		for leaf := uint64(0); leaf < past.Size; leaf++ {
+			proof, err := ProveLeafAtSize(tree, leaf, past.Size)
+			Require(t, err)
+			if proof.RootHash != past.Root || !proof.IsCorrect() {
+				Fail(t, "bad proof of leaf", leaf, "at size", past.Size)
+			}
+		}
+		consistency, err := ProveConsistency(tree, past.Size)
+		Require(t, err)
+		if !consistency.Verify(past.Root, tree.Hash()) {
+			Fail(t, "consistency proof from size", past.Size, "doesn't verify")
+		}
+	}
+	proofs, err := ProveAcrossRoots(3, roots[3:], tree, 4)
+	Require(t, err)
+	for _, past := range roots[3:] {
+		if proof := proofs[past.Root]; proof == nil || !proof.IsCorrect() {
+			Fail(t, "bad proof against the root of size", past.Size)
+		}
+	}
+
+	leaves := []uint64{2, 3, 9, 20}
+	hashes := make(map[uint64]common.Hash)
+	for _, leaf := range leaves {
+		hash, err := LeafHash(tree, leaf)
+		Require(t, err)
+		hashes[leaf] = hash
+	}
+	batch, err := MultiProof(tree, leaves)
+	Require(t, err)
+	if !batch.Verify(tree.Hash(), hashes) {
+		Fail(t, "multiproof doesn't use the tree's hasher")
+	}
+
+	// the last leaf of an odd-sized tree can be proven from the partials alone
+	proof, err := ProofForLeaf(acc, 20, pseudorandomForTesting(20))
+	Require(t, err)
+	if proof.RootHash != tree.Hash() || !proof.IsCorrect() {
+		Fail(t, "proof built from the partials doesn't use the accumulator's hasher")
+	}
+	partials, err := acc.Partials()
+	Require(t, err)
+	Require(t, VerifyAgainstPartials(partials, size(t, acc), proof))
+}
+
+func TestWalk(t *testing.T) {
+	summary := NewSummaryMerkleTree(pseudorandomForTesting(100), 2)
+	leaf := NewMerkleLeaf(pseudorandomForTesting(2))
+	right := NewMerkleInternal(leaf, NewMerkleEmpty(1))
+	tree := NewMerkleInternal(summary, right)
+
+	type visited struct {
+		place LevelAndLeaf
+		hash  common.Hash
+	}
+	nodes := []visited{}
+	tree.Walk(func(level uint64, leaf uint64, hash common.Hash) {
+		nodes = append(nodes, visited{NewLevelAndLeaf(level, leaf), hash})
+	})
+	expected := []visited{
+		{NewLevelAndLeaf(2, 3), tree.Hash()},
+		{NewLevelAndLeaf(1, 1), summary.Hash()},
+		{NewLevelAndLeaf(1, 3), right.Hash()},
+		{NewLevelAndLeaf(0, 2), crypto.Keccak256Hash(pseudorandomForTesting(2).Bytes())},
+	}
+	if !reflect.DeepEqual(nodes, expected) {
+		Fail(t, "wrong nodes visited", nodes)
+	}
+
+	// the complete subtrees walked match those of the accumulator's history
+	leaves := leavesForTesting(11)
+	complete := completeNodesForTesting(leaves)
+	seen := 0
+	NewMerkleTreeFromLeaves(leaves).Walk(func(level uint64, leaf uint64, hash common.Hash) {
+		if expected, ok := complete[NewLevelAndLeaf(level, leaf)]; ok {
+			seen++
+			if hash != expected {
+				Fail(t, "wrong hash at level", level, "leaf", leaf)
+			}
+		}
+	})
+	if seen != len(complete) {
+		Fail(t, "walked", seen, "of", len(complete), "complete subtrees")
+	}
+	NewEmptyMerkleTree().Walk(func(level uint64, leaf uint64, hash common.Hash) {
+		Fail(t, "visited a node of an empty tree")
+	})
+}
+
+func TestPruneToLeaf(t *testing.T) {
+	for _, treeSize := range []uint64{1, 2, 7, 16, 21} {
+		leaves := []common.Hash{}
+		for i := uint64(0); i < treeSize; i++ {
+			leaves = append(leaves, pseudorandomForTesting(i))
+		}
+		mt := NewMerkleTreeFromLeaves(leaves)
+		var full bytes.Buffer
+		Require(t, mt.Serialize(&full))
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			pruned, err := PruneToLeaf(mt, leaf)
+			Require(t, err)
+			if pruned.Hash() != mt.Hash() || pruned.Size() != mt.Size() || pruned.Capacity() != mt.Capacity() {
+				Fail(t, "pruning to leaf", leaf, "of", treeSize, "changed the tree")
+			}
+			var serialized bytes.Buffer
+			Require(t, pruned.Serialize(&serialized))
+			if treeSize > 2 && serialized.Len() >= full.Len() {
+				Fail(t, "pruning to leaf", leaf, "of", treeSize, "didn't shrink the tree")
+			}
+
+			for other := uint64(0); other < treeSize; other++ {
+				proof, err := ProveLeaf(pruned, other)
+				if other == leaf || other == leaf^1 || treeSize%2 == 1 && other == treeSize-1 {
+					// single leaves can't be summarized beyond their hashes
+					Require(t, err, "leaf", other, "of tree pruned to", leaf)
+					expected, err := ProveLeaf(mt, other)
+					Require(t, err)
+					if !reflect.DeepEqual(proof, expected) {
+						Fail(t, "pruned tree proves leaf", other, "differently")
+					}
+				} else if err == nil {
+					Fail(t, "tree pruned to leaf", leaf, "of", treeSize, "proves leaf", other)
+				}
+			}
+		}
+		if _, err := PruneToLeaf(mt, treeSize); err == nil {
+			Fail(t, "pruned to a leaf beyond the tree")
+		}
+	}
+}
+
+func TestVerifyDeepProofs(t *testing.T) {
+	for _, depth := range []int{63, 64} {
+		for _, leaf := range []uint64{0, 1<<(depth-1) + 12345, 1<<63 - 1} {
+			proof := &MerkleProof{
+				LeafHash:  pseudorandomForTesting(leaf),
+				LeafIndex: leaf,
+				Proof:     make([]common.Hash, depth),
+			}
+			hash := proof.LeafHash
+			for level := range proof.Proof {
+				proof.Proof[level] = pseudorandomForTesting(uint64(1000 + level))
+				if leaf&(1<<level) == 0 {
+					hash = crypto.Keccak256Hash(hash.Bytes(), proof.Proof[level].Bytes())
+				} else {
+					hash = crypto.Keccak256Hash(proof.Proof[level].Bytes(), hash.Bytes())
+				}
+			}
+			proof.RootHash = hash
+			if !proof.IsCorrect() {
+				Fail(t, "proof of leaf", leaf, "with", depth, "siblings didn't verify")
+			}
+			intermediates, err := proof.VerifyWithIntermediates()
+			Require(t, err)
+			if len(intermediates) != depth+1 {
+				Fail(t, "got", len(intermediates), "intermediates for", depth, "siblings")
+			}
+			proof.Proof[depth-1] = common.Hash{}
+			if proof.IsCorrect() {
+				Fail(t, "proof with a wrong top sibling verified")
+			}
+		}
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(13))
+	proof, err := ProveLeaf(mt, 6)
+	Require(t, err)
+	Require(t, proof.Verify())
+
+	wrongRoot := *proof
+	wrongRoot.RootHash = common.Hash{1}
+	err = wrongRoot.Verify()
+	if !errors.Is(err, ErrRootMismatch) || !strings.Contains(err.Error(), proof.RootHash.String()) {
+		Fail(t, "wrong error for the wrong root", err)
+	}
+
+	// leaf 6 of 13 can't be proven without its top sibling, nor by a proof twice as deep as it can be
+	short := *proof
+	short.Proof = proof.Proof[:2]
+	if err := short.Verify(); !errors.Is(err, ErrLeafIndexOutOfRange) {
+		Fail(t, "wrong error for a proof too short for its leaf", err)
+	}
+	outside := *proof
+	outside.LeafIndex = 16
+	if err := outside.Verify(); !errors.Is(err, ErrLeafIndexOutOfRange) {
+		Fail(t, "wrong error for a leaf beyond the tree", err)
+	}
+	long := *proof
+	long.Proof = make([]common.Hash, 65)
+	if err := long.Verify(); !errors.Is(err, ErrProofLengthMismatch) {
+		Fail(t, "wrong error for more siblings than a tree can have", err)
+	}
+
+	for _, bad := range []*MerkleProof{&wrongRoot, &short, &outside, &long} {
+		if bad.IsCorrect() {
+			Fail(t, "IsCorrect accepted a proof Verify rejects")
+		}
+	}
+}
+
+func TestVerifyAny(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	roots := []common.Hash{}
+	for i := uint64(0); i < 20; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+		roots = append(roots, root(t, acc))
+	}
+	for _, treeSize := range []uint64{1, 5, 8, 11, 20} {
+		proof, err := ProveLeaf(NewMerkleTreeFromLeaves(leavesForTesting(treeSize)), treeSize/2)
+		Require(t, err)
+		proof.RootHash = common.Hash{} // the candidates are all that's checked
+		matched, ok := proof.VerifyAny(roots)
+		if !ok || matched != roots[treeSize-1] {
+			Fail(t, "didn't match the root of size", treeSize, matched, ok)
+		}
+		matches := 0
+		for _, candidate := range roots {
+			proof.RootHash = candidate
+			if proof.IsCorrect() {
+				matches++
+			}
+		}
+		if matches != 1 {
+			Fail(t, "the proof for size", treeSize, "verifies against", matches, "roots")
+		}
+
+		others := append(append([]common.Hash{}, roots[:treeSize-1]...), roots[treeSize:]...)
+		if _, ok := proof.VerifyAny(others); ok {
+			Fail(t, "matched a root other than that of size", treeSize)
+		}
+		if len(proof.Proof) > 0 {
+			proof.Proof[0][0] ^= 1
+			if _, ok := proof.VerifyAny(roots); ok {
+				Fail(t, "a tampered proof for size", treeSize, "matched a root")
+			}
+		}
+	}
+	if _, ok := (&MerkleProof{LeafIndex: 1}).VerifyAny([]common.Hash{{}}); ok {
+		Fail(t, "a proof too short for its leaf matched a root")
+	}
+	if _, ok := (&MerkleProof{}).VerifyAny(nil); ok {
+		Fail(t, "matched without any candidates")
+	}
+}
+
+func TestProofLengthAdversarial(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(13))
+	roots := map[uint64]common.Hash{13: mt.Hash()}
+	for _, leaf := range []uint64{0, 6, 12} {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		Require(t, VerifyAgainstRootMap(roots, 13, leaf, proof.LeafHash, proof.Proof))
+
+		extra := *proof
+		extra.Proof = append(append([]common.Hash{}, proof.Proof...), common.Hash{})
+		dropped := *proof
+		dropped.Proof = proof.Proof[:len(proof.Proof)-1]
+		droppedFirst := *proof
+		droppedFirst.Proof = proof.Proof[1:]
+		for _, bad := range []*MerkleProof{&extra, &dropped, &droppedFirst} {
+			if bad.IsCorrect() {
+				Fail(t, "accepted a proof of leaf", leaf, "with", len(bad.Proof), "siblings")
+			}
+			if VerifyAgainstRootMap(roots, 13, leaf, bad.LeafHash, bad.Proof) == nil {
+				Fail(t, "a proof with", len(bad.Proof), "siblings matched the tree's depth")
+			}
+		}
+		// with its top sibling gone, leaf 12 needs more bits than the proof has levels
+		if err := dropped.Verify(); leaf == 12 && !errors.Is(err, ErrLeafIndexOutOfRange) {
+			Fail(t, "wrong error for a proof too short for leaf 12", err)
+		}
+	}
+
+	for _, depth := range []int{0, 1, 4, 63} {
+		proof := &MerkleProof{LeafIndex: 1 << depth, Proof: make([]common.Hash, depth)}
+		if err := proof.Verify(); !errors.Is(err, ErrLeafIndexOutOfRange) {
+			Fail(t, "wrong error for leaf", proof.LeafIndex, "with", depth, "siblings", err)
+		}
+	}
+	// any index fits in the deepest tree, so only the hashes can be wrong
+	deepest := &MerkleProof{LeafIndex: ^uint64(0), Proof: make([]common.Hash, 64)}
+	if err := deepest.Verify(); !errors.Is(err, ErrRootMismatch) {
+		Fail(t, "wrong error for the deepest tree", err)
+	}
+}
+
+func TestPartials(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 21; i++ {
+		_, _, exported, err := acc.StateForExport()
+		Require(t, err)
+		partials := merkleAccumulator.Partials(exported)
+		Require(t, partials.Validate(), "size", i)
+		if partials.Size() != i || partials.Root() != root(t, acc) {
+			Fail(t, "partials disagree with the accumulator at size", i)
+		}
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+
+	// the partials returned are copies, so changing them leaves the accumulator as it was
+	for _, acc := range []*merkleAccumulator.MerkleAccumulator{acc, merkleAccumulator.NewNonpersistentMerkleAccumulator()} {
+		for i := uint64(0); i < 13; i++ {
+			accAppend(t, acc, pseudorandomForTesting(i))
+		}
+		rootBefore := root(t, acc)
+		partials, err := acc.Partials()
+		Require(t, err)
+		before := append(merkleAccumulator.Partials{}, partials...)
+		for level := range partials {
+			partials[level] = pseudorandomForTesting(1000 + uint64(level))
+		}
+		after, err := acc.Partials()
+		Require(t, err)
+		if !reflect.DeepEqual(after, before) || root(t, acc) != rootBefore {
+			Fail(t, "changing the returned partials changed the accumulator")
+		}
+	}
+
+	// no accumulator has levels above its size's highest bit, nor more than a size can need
+	impossible := []merkleAccumulator.Partials{
+		{common.Hash{}},
+		{pseudorandomForTesting(0), common.Hash{}},
+		make(merkleAccumulator.Partials, 65),
+	}
+	impossible[2][64] = pseudorandomForTesting(0)
+	for _, partials := range impossible {
+		if partials.Validate() == nil {
+			Fail(t, "validated impossible partials", partials)
+		}
+		if _, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials); err == nil {
+			Fail(t, "loaded impossible partials", partials)
+		}
+	}
+}
+
+func TestAccumulatorEqual(t *testing.T) {
+	equal := func(a, b *merkleAccumulator.MerkleAccumulator) bool {
+		t.Helper()
+		ab, err := a.Equal(b)
+		Require(t, err)
+		ba, err := b.Equal(a)
+		Require(t, err)
+		if ab != ba {
+			Fail(t, "equality isn't symmetric")
+		}
+		return ab
+	}
+
+	stored := initializedMerkleAccumulatorForTesting()
+	inMemory := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	for i := uint64(0); i < 21; i++ {
+		if !equal(stored, inMemory) {
+			Fail(t, "accumulators of the same leaves differ at size", i)
+		}
+		accAppend(t, stored, pseudorandomForTesting(i))
+		if equal(stored, inMemory) {
+			Fail(t, "accumulators of different sizes are equal at size", i)
+		}
+		accAppend(t, inMemory, pseudorandomForTesting(i))
+	}
+
+	// a lone partial is the root whatever its level, but the sizes tell the accumulators apart
+	leaf := pseudorandomForTesting(0)
+	low, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(merkleAccumulator.Partials{leaf})
+	Require(t, err)
+	high, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(merkleAccumulator.Partials{{}, leaf})
+	Require(t, err)
+	if root(t, low) != root(t, high) || equal(low, high) {
+		Fail(t, "accumulators with the same root but different sizes are equal")
+	}
+
+	_, _, exported, err := stored.StateForExport()
+	Require(t, err)
+	for level := range exported {
+		if exported[level] == (common.Hash{}) {
+			continue
+		}
+		tampered := append(merkleAccumulator.Partials{}, exported...)
+		tampered[level][0] ^= 1
+		other, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(tampered)
+		Require(t, err)
+		if equal(stored, other) {
+			Fail(t, "accumulators differing in the partial at level", level, "are equal")
+		}
+	}
+}
+
+func TestRewind(t *testing.T) {
+	const total = 37
+	fresh := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	roots := []common.Hash{root(t, fresh)}
+	for i := uint64(0); i < total; i++ {
+		accAppend(t, fresh, pseudorandomForTesting(i))
+		roots = append(roots, root(t, fresh))
+	}
+
+	for _, stored := range []bool{false, true} {
+		for _, multi := range []bool{false, true} {
+			for _, toSize := range []uint64{36, 32, 31, 17, 16, 1, 0} {
+				acc := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+				if stored {
+					acc = initializedMerkleAccumulatorForTesting()
+				}
+				acc.RetainRewinds(total)
+				items := leavesForTesting(total)
+				if multi {
+					_, err := acc.AppendMulti(items)
+					Require(t, err)
+				} else {
+					for _, item := range items {
+						accAppend(t, acc, item)
+					}
+				}
+				Require(t, acc.Rewind(toSize))
+				if size(t, acc) != toSize || root(t, acc) != roots[toSize] {
+					Fail(t, "rewinding to", toSize, "didn't restore the root it had then", stored, multi)
+				}
+				for i := toSize; i < total; i++ {
+					accAppend(t, acc, pseudorandomForTesting(i))
+					if root(t, acc) != roots[i+1] {
+						Fail(t, "re-appending after rewinding to", toSize, "diverged at size", i+1, stored, multi)
+					}
+				}
+			}
+		}
+	}
+
+	// without retained appends, only sizes made by clearing the lowest set bits can be reached
+	acc := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	for i := uint64(0); i < total; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	for _, toSize := range []uint64{35, 33, 31, 1} {
+		if err := acc.Rewind(toSize); !errors.Is(err, merkleAccumulator.ErrCannotRewind) {
+			Fail(t, "wrong error rewinding to", toSize, err)
+		}
+		if size(t, acc) != total || root(t, acc) != roots[total] {
+			Fail(t, "a failed rewind to", toSize, "changed the accumulator")
+		}
+	}
+	for _, toSize := range []uint64{36, 32, 0} {
+		Require(t, acc.Rewind(toSize))
+		if size(t, acc) != toSize || root(t, acc) != roots[toSize] {
+			Fail(t, "rewinding to", toSize, "didn't restore the root it had then")
+		}
+	}
+	if err := acc.Rewind(1); err == nil {
+		Fail(t, "rewound forward")
+	}
+
+	// only the last appends up to the limit are retained, beyond which the lowest set bits are cleared
+	acc = merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	acc.RetainRewinds(3)
+	for i := uint64(0); i < 20; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	if err := acc.Rewind(15); !errors.Is(err, merkleAccumulator.ErrCannotRewind) {
+		Fail(t, "rewound past the retained appends", err)
+	}
+	Require(t, acc.Rewind(16))
+	if root(t, acc) != roots[16] {
+		Fail(t, "rewinding past the retained appends restored the wrong root")
+	}
+
+	// the partials a rewind restores aren't shared with each other or the retained appends
+	acc = merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	acc.RetainRewinds(total)
+	for i := uint64(0); i < 24; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	Require(t, acc.Rewind(21))
+	before, err := acc.Partials()
+	Require(t, err)
+	pointers, err := acc.GetPartials()
+	Require(t, err)
+	*pointers[1] = pseudorandomForTesting(1000)
+	after, err := acc.Partials()
+	Require(t, err)
+	for level := range before {
+		if level != 1 && after[level] != before[level] {
+			Fail(t, "writing the partial at level 1 after a rewind changed the one at level", level)
+		}
+	}
+	*pointers[1] = common.Hash{}
+	if root(t, acc) != roots[21] {
+		Fail(t, "rewinding to 21 restored the wrong root")
+	}
+	Require(t, acc.Rewind(16))
+	if root(t, acc) != roots[16] {
+		Fail(t, "writing through the partials after a rewind corrupted the retained appends")
+	}
+}
+
+func TestProofPositionBinding(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(16))
+	for _, leaf := range []uint64{0, 5, 10, 15} {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		Require(t, proof.Verify())
+
+		// moving the leaf anywhere else in the tree, including to its sibling, keeps the siblings but not the root
+		for bit := range proof.Proof {
+			moved := *proof
+			moved.LeafIndex ^= 1 << bit
+			if err := moved.Verify(); !errors.Is(err, ErrRootMismatch) {
+				Fail(t, "leaf", leaf, "verified at", moved.LeafIndex, err)
+			}
+		}
+		for i := 0; i+1 < len(proof.Proof); i++ {
+			swapped := *proof
+			swapped.Proof = append([]common.Hash{}, proof.Proof...)
+			swapped.Proof[i], swapped.Proof[i+1] = swapped.Proof[i+1], swapped.Proof[i]
+			if swapped.IsCorrect() {
+				Fail(t, "leaf", leaf, "verified with siblings", i, "and", i+1, "swapped")
+			}
+		}
+	}
+
+	// a leaf and its sibling can't stand in for each other, even though they share every other sibling
+	left, err := ProveLeaf(mt, 4)
+	Require(t, err)
+	right, err := ProveLeaf(mt, 5)
+	Require(t, err)
+	impostor := *right
+	impostor.LeafHash, impostor.Proof = left.LeafHash, append([]common.Hash{right.LeafHash}, right.Proof[1:]...)
+	if impostor.IsCorrect() {
+		Fail(t, "leaf 4's hash verified at leaf 5's position")
+	}
+}
+
+func TestProofID(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 6; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	proof, err := ProveLeaf(mt, 2)
+	Require(t, err)
+	same, err := ProveLeaf(mt, 2)
+	Require(t, err)
+	if proof.ID() != same.ID() {
+		Fail(t, "identical proofs have different IDs")
+	}
+
+	changes := []func(p *MerkleProof){
+		func(p *MerkleProof) { p.RootHash = pseudorandomForTesting(1000) },
+		func(p *MerkleProof) { p.LeafHash = pseudorandomForTesting(1000) },
+		func(p *MerkleProof) { p.LeafIndex++ },
+		func(p *MerkleProof) { p.Proof[1] = pseudorandomForTesting(1000) },
+		func(p *MerkleProof) { p.Proof = p.Proof[:len(p.Proof)-1] },
+		func(p *MerkleProof) { p.Proof = append(p.Proof, common.Hash{}) },
+	}
+	for i, change := range changes {
+		changed, err := ProveLeaf(mt, 2)
+		Require(t, err)
+		change(changed)
+		if changed.ID() == proof.ID() {
+			Fail(t, "change", i, "didn't change the proof's ID")
+		}
+	}
+}
+
+func TestProofEqualAndClone(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(6))
+	proof, err := ProveLeaf(mt, 2)
+	Require(t, err)
+	same, err := ProveLeaf(mt, 2)
+	Require(t, err)
+	if !proof.Equal(same) || !same.Equal(proof) {
+		Fail(t, "identical proofs aren't equal")
+	}
+	for i := range proof.Proof {
+		changed, err := ProveLeaf(mt, 2)
+		Require(t, err)
+		changed.Proof[i] = pseudorandomForTesting(1000)
+		if proof.Equal(changed) || changed.Equal(proof) {
+			Fail(t, "proofs differing in sibling", i, "are equal")
+		}
+	}
+	shorter := proof.Clone()
+	shorter.Proof = shorter.Proof[:len(shorter.Proof)-1]
+	if proof.Equal(shorter) || proof.Equal(nil) || !(*MerkleProof)(nil).Equal(nil) {
+		Fail(t, "wrong equality for proofs of different lengths or nil ones")
+	}
+
+	clone := proof.Clone()
+	if !clone.Equal(proof) || !reflect.DeepEqual(clone, proof) {
+		Fail(t, "clone differs from the original")
+	}
+	clone.Proof[0] = pseudorandomForTesting(1000)
+	clone.LeafIndex++
+	if !proof.Equal(same) {
+		Fail(t, "changing the clone changed the original")
+	}
+	proof.Proof[1] = pseudorandomForTesting(1001)
+	if clone.Proof[1] == proof.Proof[1] {
+		Fail(t, "changing the original changed the clone")
+	}
+	if (*MerkleProof)(nil).Clone() != nil {
+		Fail(t, "cloned a nil proof into one")
+	}
+}
+
+func TestProofDelta(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 21; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	for leaf := uint64(0); leaf+1 < 21; leaf++ {
+		base, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		target, err := ProveLeaf(mt, leaf+1)
+		Require(t, err)
+		siblings, indices, err := ProofDelta(base, target)
+		Require(t, err)
+		if leaf%2 == 0 && len(siblings) != 1 {
+			Fail(t, "sibling leaves should only differ in their lowest sibling", leaf, indices)
+		}
+		applied, err := ApplyProofDelta(base, target.LeafHash, target.LeafIndex, siblings, indices)
+		Require(t, err)
+		if !reflect.DeepEqual(applied, target) {
+			Fail(t, "applying the delta didn't reconstruct the target", leaf)
+		}
+	}
+
+	other := mt.Append(pseudorandomForTesting(21))
+	base, err := ProveLeaf(mt, 0)
+	Require(t, err)
+	target, err := ProveLeaf(other, 1)
+	Require(t, err)
+	if _, _, err := ProofDelta(base, target); err == nil {
+		Fail(t, "computed a delta between proofs of different roots")
+	}
+}
+
+func TestEmptyLeafPosition(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 13)
+	known := knownFromLogsForTesting(t, logs)
+	builder := NewProofBuilder()
+	mt := NewEmptyMerkleTree()
+	for size := uint64(1); size <= 13; size++ {
+		mt = mt.Append(pseudorandomForTesting(size - 1))
+
+		_, err := ProveLeaf(mt, size-1)
+		Require(t, err)
+		leafHash, err := LeafHash(mt, size-1)
+		Require(t, err)
+		if leafHash != crypto.Keccak256Hash(pseudorandomForTesting(size-1).Bytes()) {
+			Fail(t, "wrong hash for the last leaf of", size)
+		}
+		_, err = builder.Build(size-1, size, known)
+		Require(t, err)
+
+		if size == mt.Capacity() {
+			continue
+		}
+		if _, err := ProveLeaf(mt, size); !errors.Is(err, ErrEmptyLeafPosition) {
+			Fail(t, "wrong error proving an empty leaf of", size, err)
+		}
+		if _, err := LeafHash(mt, size); !errors.Is(err, ErrEmptyLeafPosition) {
+			Fail(t, "wrong error getting the hash of an empty leaf of", size, err)
+		}
+		if _, err := builder.Build(size, size, known); !errors.Is(err, ErrEmptyLeafPosition) {
+			Fail(t, "wrong error building a proof of an empty leaf of", size, err)
+		}
+		if _, err := ProveLeaf(mt, mt.Capacity()); err == nil || errors.Is(err, ErrEmptyLeafPosition) {
+			Fail(t, "wrong error proving a leaf beyond the capacity of", size, err)
+		}
+	}
+}
+
+func TestEmptyTreeRoot(t *testing.T) {
+	for capacity := uint64(1); capacity <= 1<<20; capacity *= 2 {
+		if EmptyTreeRoot(capacity) != NewMerkleEmpty(capacity).Hash() {
+			Fail(t, "wrong empty root for capacity", capacity)
+		}
+	}
+	for _, capacity := range []uint64{0, 3, 1 << 20, 1 << 63} {
+		if EmptyTreeRoot(capacity) != EmptyTreeRoot(1) {
+			Fail(t, "the empty root depends on the capacity", capacity)
+		}
+	}
+	if EmptyTreeRoot(1) != root(t, initializedMerkleAccumulatorForTesting()) {
+		Fail(t, "empty root differs from that of an empty accumulator")
+	}
+
+	// padding a tree with an empty subtree pairs it with the empty root
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 5; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	left := mt.SummarizeUpTo(4).(*merkleInternal).left
+	last := NewEmptyMerkleTree().Append(pseudorandomForTesting(4))
+	padded := crypto.Keccak256Hash(last.Hash().Bytes(), EmptyTreeRoot(1).Bytes())
+	padded = crypto.Keccak256Hash(padded.Bytes(), EmptyTreeRoot(2).Bytes())
+	if mt.Hash() != crypto.Keccak256Hash(left.Hash().Bytes(), padded.Bytes()) {
+		Fail(t, "padded tree doesn't pair its leaves with empty roots")
+	}
+}
+
+func TestApplyLog(t *testing.T) {
+	expected, logs := sendTreeForTesting(t, 12)
+	acc := initializedMerkleAccumulatorForTesting()
+	for _, log := range logs {
+		leaf := PositionTopic(log.Topics[3]).LevelAndLeaf()
+		sizeBefore := size(t, acc)
+		applied, err := acc.ApplyLog(log)
+		Require(t, err)
+		if applied != (leaf.Level == 0) {
+			Fail(t, "log at", leaf, "applied:", applied)
+		}
+		if applied && size(t, acc) != sizeBefore+1 {
+			Fail(t, "applying a leaf didn't append it", leaf)
+		}
+	}
+	if size(t, acc) != size(t, expected) || root(t, acc) != root(t, expected) {
+		Fail(t, "applying logs in order didn't recreate the accumulator")
+	}
+
+	// duplicate and stale logs are skipped
+	rootBefore := root(t, acc)
+	for _, log := range []types.Log{logs[len(logs)-1], logs[0]} {
+		applied, err := acc.ApplyLog(log)
+		Require(t, err)
+		if applied || root(t, acc) != rootBefore {
+			Fail(t, "applied an old log")
+		}
+	}
+
+	// so are leaves that skip ahead
+	_, later := sendTreeForTesting(t, 14)
+	skipped := later[len(later)-1]
+	if PositionTopic(skipped.Topics[3]).Leaf() != 13 {
+		Fail(t, "expected the last log to be that of leaf 13")
+	}
+	applied, err := acc.ApplyLog(skipped)
+	Require(t, err)
+	if applied || root(t, acc) != rootBefore {
+		Fail(t, "applied a leaf out of order")
+	}
+
+	if _, err := acc.ApplyLog(types.Log{Topics: logs[0].Topics}); err == nil {
+		Fail(t, "applied a log from another contract")
+	}
+	other := logs[0]
+	other.Topics = append([]common.Hash{{1}}, logs[0].Topics[1:]...)
+	if _, err := acc.ApplyLog(other); err == nil {
+		Fail(t, "applied a log of another event")
+	}
+
+	// the last leaf's node updates are checked against its partials
+	update := logs[len(logs)-2]
+	if update.Topics[0] != merkleTopicForTesting || PositionTopic(update.Topics[3]).Leaf() != 11 {
+		Fail(t, "expected the second to last log to be a node update for leaf 11")
+	}
+	applied, err = acc.ApplyLog(update)
+	Require(t, err)
+	if applied {
+		Fail(t, "a node update advanced the accumulator")
+	}
+	tampered := update
+	tampered.Topics = append([]common.Hash{}, update.Topics...)
+	tampered.Topics[2] = pseudorandomForTesting(1000)
+	if _, err := acc.ApplyLog(tampered); err == nil {
+		Fail(t, "applied a node update conflicting with the partials")
+	}
+}
+
+func TestAccumulatorCheckpoint(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 11; i++ {
+		checkpoint, err := acc.Checkpoint()
+		Require(t, err)
+		restored, err := merkleAccumulator.RestoreCheckpoint(checkpoint)
+		Require(t, err)
+		if size(t, restored) != size(t, acc) || root(t, restored) != root(t, acc) {
+			Fail(t, "restored accumulator differs at size", i)
+		}
+
+		for j := range checkpoint {
+			corrupt := common.CopyBytes(checkpoint)
+			corrupt[j] ^= 0x01
+			if _, err := merkleAccumulator.RestoreCheckpoint(corrupt); err == nil {
+				Fail(t, "corruption of byte", j, "went undetected at size", i)
+			}
+		}
+		if _, err := merkleAccumulator.RestoreCheckpoint(checkpoint[:len(checkpoint)-1]); err == nil {
+			Fail(t, "truncation went undetected at size", i)
+		}
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+}
+
+// TestNonpersistentMatchesEvents checks an accumulator kept in memory has the roots of one backed by storage,
+// and of the one rebuilt from the latest node events, at every size
+func TestNonpersistentMatchesEvents(t *testing.T) {
+	inMemory := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+	stored := initializedMerkleAccumulatorForTesting()
+	latest := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for i := uint64(0); i < 1<<10+3; i++ {
+		leaf := pseudorandomForTesting(i)
+		accAppend(t, stored, leaf)
+		events, err := inMemory.Append(leaf)
+		Require(t, err)
+		events = append(events, merkleAccumulator.MerkleTreeNodeEvent{
+			Level: 0, NumLeaves: i, Hash: crypto.Keccak256Hash(leaf.Bytes()),
+		})
+		for _, event := range events {
+			for uint64(len(latest)) <= event.Level {
+				latest = append(latest, merkleAccumulator.MerkleTreeNodeEvent{Level: uint64(len(latest))})
+			}
+			latest[event.Level] = event
+		}
+		if root(t, inMemory) != root(t, stored) || size(t, inMemory) != i+1 {
+			Fail(t, "in-memory accumulator differs from the stored one at size", i+1)
+		}
+		rebuilt, err := NewNonPersistentMerkleAccumulatorFromEvents(latest)
+		Require(t, err)
+		if root(t, rebuilt) != root(t, inMemory) || size(t, rebuilt) != i+1 {
+			Fail(t, "accumulator rebuilt from events differs at size", i+1)
+		}
+	}
+}
+
+// BenchmarkNonpersistentAppend appends 1e5 leaves to an accumulator kept in memory, as fuzz tests might.
+// Its appends are bound by hashing rather than by keeping the partials.
+func BenchmarkNonpersistentAppend(b *testing.B) {
+	items := make([]common.Hash, 100_000)
+	for i := range items {
+		items[i] = pseudorandomForTesting(uint64(i))
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		acc := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+		for _, item := range items {
+			if _, err := acc.Append(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func testAllSummarySizes(tree MerkleTree, t *testing.T) {
 	for i := uint64(1); i <= tree.Size(); i++ {
 		sum := tree.SummarizeUpTo(i)
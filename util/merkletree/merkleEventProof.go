@@ -4,35 +4,52 @@
 package merkletree
 
 import (
+	"errors"
+	"fmt"
+	"io"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
 )
 
+// NewMerkleTreeFromAccumulator builds the tree an accumulator describes. Only its partials are known, so the tree
+// is made of summaries and can only prove leaves appended later. NewMerkleTreeFromLeaves needs no accumulator.
+// Accumulators of more than MaxTreeSize leaves have no tree, so ErrTreeTooLarge is returned for them.
 func NewMerkleTreeFromAccumulator(acc *merkleAccumulator.MerkleAccumulator) (MerkleTree, error) {
-	partials, err := acc.GetPartials()
+	size, err := acc.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxTreeSize {
+		return nil, fmt.Errorf("%w: the accumulator has %v leaves", ErrTreeTooLarge, size)
+	}
+	partials, err := acc.Partials()
 	if err != nil {
 		return nil, err
 	}
+	hasher := acc.Hasher()
 	if len(partials) == 0 {
-		return NewEmptyMerkleTree(), nil
+		return NewEmptyMerkleTreeWithHasher(hasher), nil
 	}
 	var tree MerkleTree
 	capacity := uint64(1)
 	for level, partial := range partials {
-		if *partial != (common.Hash{}) {
+		if partial != (common.Hash{}) {
 			var thisLevel MerkleTree
 			if level == 0 {
-				thisLevel = NewMerkleLeaf(*partial)
+				// the accumulator's leaf partial is already hashed, so it can't be a MerkleLeaf
+				thisLevel = NewSummaryMerkleTreeWithHasher(partial, 1, hasher)
 			} else {
-				thisLevel = NewSummaryMerkleTree(*partial, capacity)
+				thisLevel = NewSummaryMerkleTreeWithHasher(partial, capacity, hasher)
 			}
 			if tree == nil {
 				tree = thisLevel
 			} else {
-				for tree.Capacity() < capacity {
-					tree = NewMerkleInternal(tree, NewMerkleEmpty(tree.Capacity()))
-				}
-				tree = NewMerkleInternal(thisLevel, tree)
+				// padding takes a hash per level, as empty subtrees of any capacity hash to zero, but only
+				// the hashes are kept rather than a node for each level
+				tree = newMerklePadded(tree, capacity, hasher)
+				tree = NewMerkleInternalWithHasher(thisLevel, tree, hasher)
 			}
 		}
 		capacity *= 2
@@ -41,9 +58,109 @@ func NewMerkleTreeFromAccumulator(acc *merkleAccumulator.MerkleAccumulator) (Mer
 	return tree, nil
 }
 
+// AppendProofNoClone proves where nextHash would be once appended to the accumulator, without appending it.
+// The accumulator's partials are exactly the next leaf's siblings, so unlike appending to a clone this only
+// reads them. It lives here rather than on the accumulator, which can't depend on MerkleProof.
+// It must not be called concurrently with Append.
+func AppendProofNoClone(acc *merkleAccumulator.MerkleAccumulator, nextHash common.Hash) (*MerkleProof, error) {
+	size, err := acc.Size()
+	if err != nil {
+		return nil, err
+	}
+	partials, err := acc.Partials()
+	if err != nil {
+		return nil, err
+	}
+	hasher := acc.Hasher()
+	proof := &MerkleProof{
+		LeafHash:  crypto.Keccak256Hash(nextHash.Bytes()),
+		LeafIndex: size,
+		Proof:     partials,
+		hasher:    proofHasher(hasher),
+	}
+	hash := proof.LeafHash
+	for level, partial := range partials {
+		if size&(1<<level) == 0 {
+			hash = hasher(hash, partial)
+		} else {
+			hash = hasher(partial, hash)
+		}
+	}
+	proof.RootHash = hash
+	return proof, nil
+}
+
+// PendingProof proves where one of the pending leaves will be once they're all appended to the accumulator in
+// order, against the root it will then have, letting relayers compute the proof of a send before it's included.
+// Like AppendProofNoClone, the accumulator isn't changed: the tree it will have is built from its partials, and
+// the pending leaves appended to that. The target must be one of the pending leaves, as those before are inside
+// partials whose nodes the accumulator no longer has.
+func PendingProof(
+	acc *merkleAccumulator.MerkleAccumulator, pendingLeaves []common.Hash, targetIndex uint64,
+) (*MerkleProof, error) {
+	tree, err := NewMerkleTreeFromAccumulator(acc)
+	if err != nil {
+		return nil, err
+	}
+	size := tree.Size()
+	pending := uint64(len(pendingLeaves))
+	if targetIndex < size || targetIndex-size >= pending {
+		return nil, fmt.Errorf(
+			"leaf %v isn't among the %v pending after the accumulator's %v", targetIndex, pending, size,
+		)
+	}
+	if pending > MaxTreeSize-size {
+		return nil, fmt.Errorf("%w: %v leaves pending after %v", ErrTreeTooLarge, pending, size)
+	}
+	for _, leaf := range pendingLeaves {
+		tree = tree.Append(leaf)
+	}
+	return ProveLeaf(tree, targetIndex)
+}
+
+// ErrHistoricalNodesNeeded is returned by ProofForLeaf when the leaf's siblings aren't among the partials
+var ErrHistoricalNodesNeeded = errors.New("the accumulator's partials don't include the leaf's siblings, " +
+	"so historical node hashes must be supplied, such as with ProveWithKnownNodes")
+
+// ProofForLeaf proves the leaf, appended as leafHash, against the accumulator's current root using only its
+// partials. That's only possible when each sibling is a partial or an empty subtree, which is the case for the
+// last leaf of an odd-sized tree but not for leaves inside a partial, whose siblings are nodes the accumulator
+// no longer has. ErrHistoricalNodesNeeded is returned for those.
+func ProofForLeaf(acc *merkleAccumulator.MerkleAccumulator, leafIndex uint64, leafHash common.Hash) (*MerkleProof, error) {
+	size, err := acc.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLeafInTree(leafIndex, size); err != nil {
+		return nil, err
+	}
+	partials, err := acc.Partials()
+	if err != nil {
+		return nil, err
+	}
+	root, err := acc.Root()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[LevelAndLeaf]common.Hash)
+	for _, place := range partialPositions(size) {
+		known[place] = partials[place.Level]
+	}
+	known[NewLevelAndLeaf(0, leafIndex)] = crypto.Keccak256Hash(leafHash.Bytes())
+	if err := checkQueriesAnswered(proofQueries(leafIndex, size), known); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHistoricalNodesNeeded, err)
+	}
+	return NewProofBuilder(WithSelfVerify(), WithHasher(acc.Hasher())).BuildForRoot(leafIndex, size, root, known)
+}
+
+// NewMerkleTreeFromEvents builds the tree described by the latest event at each level, erroring if the events
+// can't all be from one tree, as checkLatestEvents describes
 func NewMerkleTreeFromEvents(
 	events []merkleAccumulator.MerkleTreeNodeEvent, // latest event at each Level
 ) (MerkleTree, error) {
+	if err := checkLatestEvents(events); err != nil {
+		return nil, err
+	}
 	acc, err := NewNonPersistentMerkleAccumulatorFromEvents(events)
 	if err != nil {
 		return nil, err
@@ -51,23 +168,178 @@ func NewMerkleTreeFromEvents(
 	return NewMerkleTreeFromAccumulator(acc)
 }
 
+// checkLatestEvents checks the latest event at each level, indexed by level, describes a single tree, so that
+// NewNonPersistentMerkleAccumulatorFromEvents doesn't silently build the wrong one. Levels without events have
+// zero ones. Each node needs at least as many leaves as its subtree has, and the events that would be partials,
+// each covering more leaves than those above it, must tile the leaves from the first, so that their levels are
+// the binary digits of a single size. Errors name the level that doesn't fit.
+func checkLatestEvents(events []merkleAccumulator.MerkleTreeNodeEvent) error {
+	covered := uint64(0) // the leaves covered by the partials above
+	latestSeen := uint64(0)
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		level := uint64(i)
+		if event.Level != level {
+			return fmt.Errorf("event for level %v is at level %v", level, event.Level)
+		}
+		if event == (merkleAccumulator.MerkleTreeNodeEvent{Level: level}) {
+			continue
+		}
+		if level <= merkleAccumulator.MaxLevel && event.NumLeaves < 1<<level-1 {
+			return fmt.Errorf(
+				"node at level %v needs at least %v leaves, but its event counts only %v",
+				level, uint64(1)<<level, event.NumLeaves+1,
+			)
+		}
+		if err := event.CheckPosition(); err != nil {
+			return err
+		}
+		if event.NumLeaves <= latestSeen {
+			continue
+		}
+		latestSeen = event.NumLeaves
+		first := event.NumLeaves + 1 - 1<<level
+		if first != covered {
+			return fmt.Errorf(
+				"partial at level %v covers leaves %v to %v, but the partials above cover %v leaves",
+				level, first, event.NumLeaves, covered,
+			)
+		}
+		covered = event.NumLeaves + 1
+	}
+	return nil
+}
+
+// ProveLeafFromEvents builds the tree the events describe and proves one of its leaves
+func ProveLeafFromEvents(events []merkleAccumulator.MerkleTreeNodeEvent, leaf uint64) (*MerkleProof, error) {
+	tree, err := NewMerkleTreeFromEvents(events)
+	if err != nil {
+		return nil, err
+	}
+	return ProveLeaf(tree, leaf)
+}
+
+// EventPosition returns where the event's node is in the tree. Like positions, events are placed at their
+// rightmost leaf, which is NumLeaves, so this is the position ArbSys emits for the event. It lives here rather
+// than on the event, as the accumulator can't depend on LevelAndLeaf.
+func EventPosition(event merkleAccumulator.MerkleTreeNodeEvent) LevelAndLeaf {
+	return NewLevelAndLeaf(event.Level, event.NumLeaves)
+}
+
+// EventReader yields merkle tree node events one at a time, returning io.EOF once there are none left
+type EventReader interface {
+	ReadEvent() (merkleAccumulator.MerkleTreeNodeEvent, error)
+}
+
+// ChannelEventReader reads events from a channel until it's closed
+type ChannelEventReader <-chan merkleAccumulator.MerkleTreeNodeEvent
+
+func (ch ChannelEventReader) ReadEvent() (merkleAccumulator.MerkleTreeNodeEvent, error) {
+	event, ok := <-ch
+	if !ok {
+		return merkleAccumulator.MerkleTreeNodeEvent{}, io.EOF
+	}
+	return event, nil
+}
+
+// BuildTreeFromEventReader builds the same tree as NewMerkleTreeFromEvents, but from a stream of events that
+// may span the tree's whole history. Only the latest event at each level is retained, so memory stays bounded
+// by the height of the tree rather than the number of events.
+func BuildTreeFromEventReader(reader EventReader) (MerkleTree, error) {
+	latest := []merkleAccumulator.MerkleTreeNodeEvent{}
+	seen := []bool{}
+	for {
+		event, err := reader.ReadEvent()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := event.CheckPosition(); err != nil {
+			return nil, err
+		}
+		for uint64(len(latest)) <= event.Level {
+			latest = append(latest, merkleAccumulator.MerkleTreeNodeEvent{Level: uint64(len(latest))})
+			seen = append(seen, false)
+		}
+		if !seen[event.Level] || event.NumLeaves > latest[event.Level].NumLeaves {
+			latest[event.Level] = event
+			seen[event.Level] = true
+		}
+	}
+	return NewMerkleTreeFromEvents(latest)
+}
+
+// NewNonPersistentMerkleAccumulatorFromEvents rebuilds the accumulator from the latest event at each level,
+// indexed by level, with zero events for levels without one. A level's event is a partial unless one above it
+// covers as many leaves. Real nodes never hash to zero, so the first leaf's event is told apart from an empty
+// level by its hash, as its position is the same.
 func NewNonPersistentMerkleAccumulatorFromEvents(
 	events []merkleAccumulator.MerkleTreeNodeEvent,
 ) (*merkleAccumulator.MerkleAccumulator, error) {
 
-	partials := make([]*common.Hash, len(events))
-	zero := common.Hash{}
-	for i := range partials {
-		partials[i] = &zero
-	}
-
+	partials := make(merkleAccumulator.Partials, len(events))
+	seen := false
 	latestSeen := uint64(0)
 	for i := len(events) - 1; i >= 0; i-- {
 		event := events[i]
-		if event.NumLeaves > latestSeen {
+		if event.Hash == (common.Hash{}) {
+			continue
+		}
+		if !seen || event.NumLeaves > latestSeen {
+			seen = true
 			latestSeen = event.NumLeaves
-			partials[i] = &event.Hash
+			partials[i] = event.Hash
+		}
+	}
+	return merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials)
+}
+
+// NewAccumulatorFromNodeEvents rebuilds an accumulator from node events in any order, such as those found in
+// logs, rather than one per level. Each event is placed by its own level, and at each level the one covering the
+// most leaves is kept. A level's event is a partial unless a higher level has a later event, which would have
+// consumed it; levels without one are empty. An error is returned if the partials don't tile the leaves from
+// the first, since the events then describe no single tree. A tree whose latest events are missing can't be
+// told apart from a smaller one, so those are neither detected nor recovered.
+func NewAccumulatorFromNodeEvents(
+	events []merkleAccumulator.MerkleTreeNodeEvent,
+) (*merkleAccumulator.MerkleAccumulator, error) {
+	latest := []*merkleAccumulator.MerkleTreeNodeEvent{}
+	for i := range events {
+		event := &events[i]
+		if err := event.CheckPosition(); err != nil {
+			return nil, err
+		}
+		for uint64(len(latest)) <= event.Level {
+			latest = append(latest, nil)
+		}
+		prior := latest[event.Level]
+		if prior != nil && prior.NumLeaves == event.NumLeaves && prior.Hash != event.Hash {
+			return nil, fmt.Errorf("conflicting events at level %v leaf %v", event.Level, event.NumLeaves)
+		}
+		if prior == nil || event.NumLeaves > prior.NumLeaves {
+			latest[event.Level] = event
+		}
+	}
+
+	partials := make(merkleAccumulator.Partials, len(latest))
+	covered := uint64(0) // the leaves covered by the partials above
+	var consumedBy *uint64
+	for level := len(latest) - 1; level >= 0; level-- {
+		event := latest[level]
+		if event == nil || (consumedBy != nil && event.NumLeaves <= *consumedBy) {
+			continue
+		}
+		first := event.NumLeaves + 1 - 1<<level
+		if first != covered {
+			return nil, fmt.Errorf(
+				"partial at level %v covers leaves from %v, but those above end at %v", level, first, covered,
+			)
 		}
+		partials[level] = event.Hash
+		covered = event.NumLeaves + 1
+		consumedBy = &event.NumLeaves
 	}
 	return merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials)
 }
@@ -4,6 +4,14 @@
 package merkletree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -48,15 +56,381 @@ func TestProofForNext(t *testing.T) {
 	}
 }
 
+func TestAppendProofNoClone(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 33; i++ {
+		next := pseudorandomForTesting(i)
+		sizeBefore, rootBefore := size(t, acc), root(t, acc)
+		proof, err := AppendProofNoClone(acc, next)
+		Require(t, err)
+		if size(t, acc) != sizeBefore || root(t, acc) != rootBefore {
+			Fail(t, "computing the proof changed the accumulator", i)
+		}
+		expected, err := ProofFromAccumulator(acc, next)
+		Require(t, err)
+		if !reflect.DeepEqual(proof, expected) {
+			Fail(t, "proof differs from one built with a clone", i, proof, expected)
+		}
+		accAppend(t, acc, next)
+	}
+}
+
+func TestAppendWithSiblings(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 33; i++ {
+		next := pseudorandomForTesting(i)
+		expected, err := ProofFromAccumulator(acc, next)
+		Require(t, err)
+		index, siblings, newRoot, err := acc.AppendWithSiblings(next)
+		Require(t, err)
+		proof := &MerkleProof{
+			RootHash:  newRoot,
+			LeafHash:  crypto.Keccak256Hash(next.Bytes()),
+			LeafIndex: index,
+			Proof:     siblings,
+		}
+		if !reflect.DeepEqual(proof, expected) {
+			Fail(t, "append proof differs from one built with a clone", i, proof, expected)
+		}
+		if size(t, acc) != i+1 || root(t, acc) != newRoot {
+			Fail(t, "leaf", i, "wasn't appended")
+		}
+	}
+}
+
+func TestAppendMulti(t *testing.T) {
+	items := make([]common.Hash, 70)
+	for i := range items {
+		items[i] = pseudorandomForTesting(uint64(i))
+	}
+	for _, nonpersistent := range []bool{false, true} {
+		for _, batch := range []int{1, 2, 3, 7, 16, 70} {
+			multi, loop := initializedMerkleAccumulatorForTesting(), initializedMerkleAccumulatorForTesting()
+			if nonpersistent {
+				multi, loop = merkleAccumulator.NewNonpersistentMerkleAccumulator(), merkleAccumulator.NewNonpersistentMerkleAccumulator()
+			}
+			for start := 0; start < len(items); start += batch {
+				end := min(start+batch, len(items))
+				events, err := multi.AppendMulti(items[start:end])
+				Require(t, err)
+				expected := []merkleAccumulator.MerkleTreeNodeEvent{}
+				for _, item := range items[start:end] {
+					appended, err := loop.Append(item)
+					Require(t, err)
+					expected = append(expected, appended...)
+				}
+				if !reflect.DeepEqual(events, expected) {
+					Fail(t, "events differ appending", start, "to", end, "in batches of", batch)
+				}
+				if size(t, multi) != size(t, loop) || root(t, multi) != root(t, loop) {
+					Fail(t, "state differs appending", start, "to", end, "in batches of", batch)
+				}
+			}
+		}
+	}
+
+	acc := initializedMerkleAccumulatorForTesting()
+	events, err := acc.AppendMulti(nil)
+	Require(t, err)
+	if len(events) != 0 || size(t, acc) != 0 {
+		Fail(t, "appending nothing changed the accumulator")
+	}
+}
+
+func TestAppendWithRoot(t *testing.T) {
+	for seed := uint64(0); seed < 4; seed++ {
+		withRoot, plain := initializedMerkleAccumulatorForTesting(), initializedMerkleAccumulatorForTesting()
+		if seed%2 == 1 {
+			withRoot, plain = merkleAccumulator.NewNonpersistentMerkleAccumulator(), merkleAccumulator.NewNonpersistentMerkleAccumulator()
+		}
+		for i := uint64(0); i < 70; i++ {
+			item := pseudorandomForTesting(seed<<32 | i)
+			newRoot, events, err := withRoot.AppendWithRoot(item)
+			Require(t, err)
+			expected, err := plain.Append(item)
+			Require(t, err)
+			if !reflect.DeepEqual(events, expected) {
+				Fail(t, "events differ from Append's at size", i+1)
+			}
+			if newRoot != root(t, withRoot) || newRoot != root(t, plain) {
+				Fail(t, "the returned root isn't the accumulator's at size", i+1, "with seed", seed)
+			}
+		}
+	}
+}
+
+func TestNonPersistentCloneConcurrently(t *testing.T) {
+	leaves := leavesForTesting(13)
+	for _, original := range []*merkleAccumulator.MerkleAccumulator{
+		initializedMerkleAccumulatorForTesting(), merkleAccumulator.NewNonpersistentMerkleAccumulator(),
+	} {
+		for _, leaf := range leaves {
+			accAppend(t, original, leaf)
+		}
+		originalRoot := root(t, original)
+
+		var wg sync.WaitGroup
+		roots := make([]common.Hash, 2)
+		errs := make([]error, 2)
+		for i := range roots {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				clone, err := original.NonPersistentClone()
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				for j := uint64(0); j < 5; j++ {
+					if _, err := clone.Append(pseudorandomForTesting(uint64(100*(i+1)) + j)); err != nil {
+						errs[i] = err
+						return
+					}
+				}
+				roots[i], errs[i] = clone.Root()
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range roots {
+			Require(t, errs[i])
+			expected := append([]common.Hash{}, leaves...)
+			for j := uint64(0); j < 5; j++ {
+				expected = append(expected, pseudorandomForTesting(uint64(100*(i+1))+j))
+			}
+			if roots[i] != NewMerkleTreeFromLeaves(expected).Hash() {
+				Fail(t, "clone", i, "has the wrong root")
+			}
+		}
+		if size(t, original) != 13 || root(t, original) != originalRoot {
+			Fail(t, "appending to clones changed the original")
+		}
+	}
+}
+
+// BenchmarkAppendMulti reports the gas charged by storage for appending 1024 leaves
+func BenchmarkAppendMulti(b *testing.B) {
+	items := make([]common.Hash, 1024)
+	for i := range items {
+		items[i] = pseudorandomForTesting(uint64(i))
+	}
+	run := func(b *testing.B, appendAll func(*merkleAccumulator.MerkleAccumulator) error) {
+		burned := uint64(0)
+		for i := 0; i < b.N; i++ {
+			burner := burn.NewSystemBurner(nil, false)
+			sto := storage.NewMemoryBacked(burner)
+			merkleAccumulator.InitializeMerkleAccumulator(sto)
+			if err := appendAll(merkleAccumulator.OpenMerkleAccumulator(sto)); err != nil {
+				b.Fatal(err)
+			}
+			burned += burner.Burned()
+		}
+		b.ReportMetric(float64(burned)/float64(b.N), "gas/op")
+	}
+	b.Run("Append", func(b *testing.B) {
+		run(b, func(acc *merkleAccumulator.MerkleAccumulator) error {
+			for _, item := range items {
+				if _, err := acc.Append(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	b.Run("AppendMulti", func(b *testing.B) {
+		run(b, func(acc *merkleAccumulator.MerkleAccumulator) error {
+			_, err := acc.AppendMulti(items)
+			return err
+		})
+	})
+}
+
+// BenchmarkNewMerkleTreeFromAccumulator pads the single leaf past a full subtree up to the given capacity.
+// Empty subtrees hash to zero without hashing anything, so the cost grows with the levels padded, not the capacity.
+func BenchmarkNewMerkleTreeFromAccumulator(b *testing.B) {
+	for _, levels := range []uint64{4, 20, 40} {
+		partials := make(merkleAccumulator.Partials, levels)
+		partials[0], partials[levels-1] = pseudorandomForTesting(0), pseudorandomForTesting(1)
+		acc, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("capacity=2^%v", levels), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewMerkleTreeFromAccumulator(acc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingProof(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for treeSize := uint64(0); treeSize <= 20; treeSize++ {
+		accRoot := root(t, acc)
+		for count := uint64(1); count <= 12; count++ {
+			pending := make([]common.Hash, count)
+			appended, err := acc.NonPersistentClone()
+			Require(t, err)
+			for i := range pending {
+				pending[i] = pseudorandomForTesting(1000 + uint64(i))
+				accAppend(t, appended, pending[i])
+			}
+			for target := treeSize; target < treeSize+count; target++ {
+				proof, err := PendingProof(acc, pending, target)
+				Require(t, err, "leaf", target, "of", treeSize, "+", count)
+				if !proof.IsCorrect() || proof.RootHash != root(t, appended) || proof.LeafIndex != target {
+					Fail(t, "bad proof of pending leaf", target, "of", treeSize, "+", count)
+				}
+				if proof.LeafHash != crypto.Keccak256Hash(pending[target-treeSize].Bytes()) {
+					Fail(t, "proof of pending leaf", target, "is of the wrong leaf")
+				}
+			}
+			if _, err := PendingProof(acc, pending, treeSize+count); err == nil {
+				Fail(t, "proved leaf", treeSize+count, "past those pending after", treeSize)
+			}
+			if treeSize > 0 {
+				if _, err := PendingProof(acc, pending, treeSize-1); err == nil {
+					Fail(t, "proved leaf", treeSize-1, "already in the accumulator")
+				}
+			}
+		}
+		if _, err := PendingProof(acc, nil, treeSize); err == nil {
+			Fail(t, "proved a leaf with none pending")
+		}
+		if size(t, acc) != treeSize || root(t, acc) != accRoot {
+			Fail(t, "proving pending leaves changed the accumulator")
+		}
+		accAppend(t, acc, pseudorandomForTesting(treeSize))
+	}
+}
+
+func TestProofForLeaf(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for size := uint64(1); size <= 21; size++ {
+		accAppend(t, acc, pseudorandomForTesting(size-1))
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProofForLeaf(acc, leaf, pseudorandomForTesting(leaf))
+			// only the last leaf of an odd-sized tree has no siblings inside a partial
+			if leaf == size-1 && size%2 == 1 {
+				Require(t, err, "leaf", leaf, "of", size)
+				if !proof.IsCorrect() || proof.RootHash != root(t, acc) {
+					Fail(t, "bad proof for leaf", leaf, "of", size)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrHistoricalNodesNeeded) || !strings.Contains(err.Error(), "sibling at level") {
+				Fail(t, "wrong error for leaf", leaf, "of", size, err)
+			}
+		}
+	}
+
+	if _, err := ProofForLeaf(acc, 20, pseudorandomForTesting(1000)); !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "wrong error for a leaf that isn't in the tree", err)
+	}
+	if _, err := ProofForLeaf(acc, 21, pseudorandomForTesting(21)); !errors.Is(err, ErrEmptyLeafPosition) {
+		Fail(t, "wrong error for a leaf beyond the tree", err)
+	}
+}
+
+func TestPaddedTreeMatchesMaterialized(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for treeSize := uint64(1); treeSize <= 40; treeSize++ {
+		accAppend(t, acc, pseudorandomForTesting(treeSize-1))
+		padded, err := NewMerkleTreeFromAccumulator(acc)
+		Require(t, err)
+		// reading the tree back materializes every node of its padding
+		var serialized bytes.Buffer
+		Require(t, padded.Serialize(&serialized))
+		materialized, err := NewMerkleTreeFromReader(bytes.NewReader(serialized.Bytes()))
+		Require(t, err)
+
+		if padded.Hash() != materialized.Hash() || padded.Size() != materialized.Size() ||
+			padded.Capacity() != materialized.Capacity() || padded.String() != materialized.String() {
+			Fail(t, "padded tree differs from the materialized one at size", treeSize)
+		}
+		if !reflect.DeepEqual(treeNodesForTesting(padded), treeNodesForTesting(materialized)) {
+			Fail(t, "padded tree has different nodes at size", treeSize)
+		}
+		last := treeSize - 1
+		paddedProof, paddedErr := ProveLeaf(padded, last)
+		materializedProof, materializedErr := ProveLeaf(materialized, last)
+		if (paddedErr == nil) != (materializedErr == nil) || !reflect.DeepEqual(paddedProof, materializedProof) {
+			Fail(t, "padded tree proves the last leaf differently at size", treeSize, paddedErr, materializedErr)
+		}
+		for i := uint64(0); i < 3; i++ {
+			padded = padded.Append(pseudorandomForTesting(1000 + i))
+			materialized = materialized.Append(pseudorandomForTesting(1000 + i))
+		}
+		if padded.Hash() != materialized.Hash() || padded.SummarizeUpTo(treeSize).Hash() != padded.Hash() {
+			Fail(t, "padded tree grows differently at size", treeSize)
+		}
+	}
+
+	// besides hashing, only the partials and the nodes joining them are allocated, however much padding there is
+	allocs := func(levels int) float64 {
+		partials := make(merkleAccumulator.Partials, levels)
+		partials[0], partials[levels-1] = pseudorandomForTesting(0), pseudorandomForTesting(1)
+		acc, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials)
+		Require(t, err)
+		return testing.AllocsPerRun(10, func() {
+			_, err := NewMerkleTreeFromAccumulator(acc)
+			Require(t, err)
+		})
+	}
+	hashing := testing.AllocsPerRun(10, func() {
+		Keccak256Hasher(pseudorandomForTesting(0), common.Hash{})
+	})
+	if shallow, deep := allocs(4), allocs(21); deep-shallow > 17*hashing {
+		Fail(t, "padding 20 levels took", deep, "allocations, compared to", shallow, "for 3")
+	}
+}
+
+func TestProofForFirstLeaf(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	partials, err := acc.Partials()
+	Require(t, err)
+	if len(partials) != 0 {
+		Fail(t, "an empty accumulator has partials", partials)
+	}
+	if root(t, acc) != (common.Hash{}) {
+		Fail(t, "an empty accumulator has a root")
+	}
+	if ProofHashOps(0, 0) != 0 || len(ProofQueryPositions(0, 0)) != 0 || FrontierPositions(0) != nil {
+		Fail(t, "an empty tree needs nodes to prove its leaves")
+	}
+
+	leaf := pseudorandomForTesting(0)
+	proof, err := ProofFromAccumulator(acc, leaf)
+	Require(t, err)
+	single := NewMerkleTreeFromLeaves([]common.Hash{leaf})
+	if proof.LeafIndex != 0 || len(proof.Proof) != 0 || proof.RootHash != single.Hash() {
+		Fail(t, "wrong proof for the first leaf", proof)
+	}
+	if !proof.IsCorrect() {
+		Fail(t, "the first leaf's proof is incorrect", proof)
+	}
+
+	accAppend(t, acc, leaf)
+	partials, err = acc.Partials()
+	Require(t, err)
+	if len(partials) != 1 || partials[0] != proof.LeafHash || root(t, acc) != proof.RootHash {
+		Fail(t, "a single leaf isn't its own partial and root", partials)
+	}
+	proven, err := ProveLeaf(single, 0)
+	Require(t, err)
+	if !reflect.DeepEqual(proven, proof) {
+		Fail(t, "the tree and accumulator disagree on the first leaf", proven, proof)
+	}
+}
+
 func ProofFromAccumulator(acc *merkleAccumulator.MerkleAccumulator, nextHash common.Hash) (*MerkleProof, error) {
-	origPartials, err := acc.GetPartials()
+	partials, err := acc.Partials()
 	if err != nil {
 		return nil, err
 	}
-	partials := make([]common.Hash, len(origPartials))
-	for i, orig := range origPartials {
-		partials[i] = *orig
-	}
 	clone, err := acc.NonPersistentClone()
 	if err != nil {
 		return nil, err
@@ -78,3 +452,319 @@ func ProofFromAccumulator(acc *merkleAccumulator.MerkleAccumulator, nextHash com
 		Proof:     partials,
 	}, nil
 }
+
+// eventHistoryForTesting returns every node event produced while appending size leaves, including the leaves
+func eventHistoryForTesting(t *testing.T, size uint64) []merkleAccumulator.MerkleTreeNodeEvent {
+	t.Helper()
+	acc := initializedMerkleAccumulatorForTesting()
+	history := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for i := uint64(0); i < size; i++ {
+		leaf := pseudorandomForTesting(i)
+		history = append(history, merkleAccumulator.MerkleTreeNodeEvent{
+			Level: 0, NumLeaves: i, Hash: crypto.Keccak256Hash(leaf.Bytes()),
+		})
+		events, err := acc.Append(leaf)
+		Require(t, err)
+		history = append(history, events...)
+	}
+	return history
+}
+
+// latestEventsForTesting keeps the latest event at each level, indexed by level
+func latestEventsForTesting(history []merkleAccumulator.MerkleTreeNodeEvent) []merkleAccumulator.MerkleTreeNodeEvent {
+	latest := []merkleAccumulator.MerkleTreeNodeEvent{}
+	for _, event := range history {
+		for uint64(len(latest)) <= event.Level {
+			latest = append(latest, merkleAccumulator.MerkleTreeNodeEvent{Level: uint64(len(latest))})
+		}
+		latest[event.Level] = event
+	}
+	return latest
+}
+
+type sliceEventReader []merkleAccumulator.MerkleTreeNodeEvent
+
+func (r *sliceEventReader) ReadEvent() (merkleAccumulator.MerkleTreeNodeEvent, error) {
+	if len(*r) == 0 {
+		return merkleAccumulator.MerkleTreeNodeEvent{}, io.EOF
+	}
+	event := (*r)[0]
+	*r = (*r)[1:]
+	return event, nil
+}
+
+func TestBuildTreeFromEventReader(t *testing.T) {
+	for size := uint64(2); size <= 20; size++ {
+		history := eventHistoryForTesting(t, size)
+
+		expected, err := NewMerkleTreeFromEvents(latestEventsForTesting(history))
+		Require(t, err)
+
+		reader := sliceEventReader(history)
+		streamed, err := BuildTreeFromEventReader(&reader)
+		Require(t, err)
+		if streamed.Hash() != expected.Hash() {
+			Fail(t, "streamed tree differs for size", size)
+		}
+
+		channel := make(chan merkleAccumulator.MerkleTreeNodeEvent)
+		go func() {
+			for _, event := range history {
+				channel <- event
+			}
+			close(channel)
+		}()
+		streamed, err = BuildTreeFromEventReader(ChannelEventReader(channel))
+		Require(t, err)
+		if streamed.Hash() != expected.Hash() {
+			Fail(t, "tree streamed through a channel differs for size", size)
+		}
+	}
+}
+
+func TestNewMerkleTreeFromInconsistentEvents(t *testing.T) {
+	type event = merkleAccumulator.MerkleTreeNodeEvent
+	node := func(level, numLeaves uint64) event {
+		return event{Level: level, NumLeaves: numLeaves, Hash: pseudorandomForTesting(level)}
+	}
+
+	// 13 leaves are partials at levels 3, 2, and 0, with level 1's event consumed by level 2's
+	valid := []event{node(0, 12), node(1, 9), node(2, 11), node(3, 7)}
+	tree, err := NewMerkleTreeFromEvents(valid)
+	Require(t, err)
+	if tree.Size() != 13 {
+		Fail(t, "built a tree of", tree.Size(), "leaves from events of 13")
+	}
+
+	for _, test := range []struct {
+		events   []event
+		mentions []string
+	}{
+		// level 2's partial ends at leaf 15, so it starts at 12, past the 8 leaves level 3's covers
+		{[]event{node(0, 16), {Level: 1}, node(2, 15), node(3, 7)}, []string{"level 2", "12", "8 leaves"}},
+		// a node at level 2 has 4 leaves beneath it, but this one's event ends at the second leaf
+		{[]event{node(0, 2), node(1, 1), node(2, 1)}, []string{"level 2", "at least 4", "only 2"}},
+	} {
+		_, err := NewMerkleTreeFromEvents(test.events)
+		if err == nil {
+			Fail(t, "built a tree from inconsistent events", test.events)
+		}
+		for _, mention := range test.mentions {
+			if !strings.Contains(err.Error(), mention) {
+				Fail(t, "error doesn't mention", mention, err)
+			}
+		}
+	}
+}
+
+func TestApplyEvent(t *testing.T) {
+	history := eventHistoryForTesting(t, 37)
+	batch, err := NewAccumulatorFromNodeEvents(history)
+	Require(t, err)
+	follower := initializedMerkleAccumulatorForTesting()
+	for i, event := range history {
+		Require(t, follower.ApplyEvent(event), "event", i)
+		// delivering the latest event again changes nothing
+		Require(t, follower.ApplyEvent(event), "repeated event", i)
+	}
+	if size(t, follower) != 37 || root(t, follower) != root(t, batch) {
+		Fail(t, "the follower's state differs from the batch reconstruction")
+	}
+	followed, err := follower.Partials()
+	Require(t, err)
+	rebuilt, err := batch.Partials()
+	Require(t, err)
+	if !reflect.DeepEqual(followed, rebuilt) {
+		Fail(t, "the follower's partials differ from the batch reconstruction", followed, rebuilt)
+	}
+
+	// 37 leaves have a partial at level 0, and the next leaf's append makes nodes up to level 1
+	rejected := map[string]merkleAccumulator.MerkleTreeNodeEvent{
+		"a regressive leaf":        {Level: 0, NumLeaves: 35, Hash: history[0].Hash},
+		"a leaf skipping ahead":    {Level: 0, NumLeaves: 38, Hash: history[0].Hash},
+		"a regressive node":        {Level: 2, NumLeaves: 35, Hash: history[0].Hash},
+		"a node before its leaves": {Level: 1, NumLeaves: 37},
+		"a misaligned node":        {Level: 2, NumLeaves: 36},
+		"a conflicting partial":    {Level: 0, NumLeaves: 36, Hash: common.Hash{1}},
+	}
+	for name, event := range rejected {
+		if err := follower.ApplyEvent(event); err == nil {
+			Fail(t, "applied", name)
+		}
+	}
+	if root(t, follower) != root(t, batch) {
+		Fail(t, "a rejected event changed the follower")
+	}
+	leaf := merkleAccumulator.MerkleTreeNodeEvent{Level: 0, NumLeaves: 37, Hash: common.Hash{1}}
+	Require(t, follower.ApplyEvent(leaf))
+	if err := follower.ApplyEvent(merkleAccumulator.MerkleTreeNodeEvent{Level: 1, NumLeaves: 37, Hash: common.Hash{2}}); err == nil {
+		Fail(t, "applied a node conflicting with the follower's partial")
+	}
+}
+
+func TestNewAccumulatorFromNodeEvents(t *testing.T) {
+	for treeSize := uint64(1); treeSize <= 20; treeSize++ {
+		acc, _ := sendTreeForTesting(t, treeSize)
+		history := eventHistoryForTesting(t, treeSize)
+
+		// reversed, and with every event repeated, as overlapping log queries might return them
+		events := []merkleAccumulator.MerkleTreeNodeEvent{}
+		for i := len(history) - 1; i >= 0; i-- {
+			events = append(events, history[i], history[(i*7)%len(history)])
+		}
+		rebuilt, err := NewAccumulatorFromNodeEvents(events)
+		Require(t, err, "size", treeSize)
+		if root(t, rebuilt) != root(t, acc) || size(t, rebuilt) != treeSize {
+			Fail(t, "rebuilt the wrong tree of", treeSize)
+		}
+	}
+
+	leaf := func(i uint64) merkleAccumulator.MerkleTreeNodeEvent {
+		return merkleAccumulator.MerkleTreeNodeEvent{Level: 0, NumLeaves: i, Hash: pseudorandomForTesting(i)}
+	}
+	node := func(level, numLeaves uint64) merkleAccumulator.MerkleTreeNodeEvent {
+		return merkleAccumulator.MerkleTreeNodeEvent{Level: level, NumLeaves: numLeaves, Hash: pseudorandomForTesting(level)}
+	}
+
+	// leaf 5 can only follow a partial at level 1 ending at leaf 3, which is missing
+	if _, err := NewAccumulatorFromNodeEvents([]merkleAccumulator.MerkleTreeNodeEvent{node(2, 3), leaf(5)}); err == nil {
+		Fail(t, "rebuilt a tree with a gap in its leaves")
+	}
+	if _, err := NewAccumulatorFromNodeEvents([]merkleAccumulator.MerkleTreeNodeEvent{node(1, 2)}); err == nil {
+		Fail(t, "rebuilt a tree with a misaligned node")
+	}
+	conflicting := leaf(4)
+	conflicting.Hash = common.Hash{1}
+	if _, err := NewAccumulatorFromNodeEvents([]merkleAccumulator.MerkleTreeNodeEvent{node(2, 3), leaf(4), conflicting}); err == nil {
+		Fail(t, "rebuilt a tree from conflicting events")
+	}
+	if _, err := NewAccumulatorFromNodeEvents([]merkleAccumulator.MerkleTreeNodeEvent{node(64, 1<<64-1)}); err == nil {
+		Fail(t, "rebuilt a tree too deep to exist")
+	}
+}
+
+func TestEventPositionBounds(t *testing.T) {
+	type event = merkleAccumulator.MerkleTreeNodeEvent
+	absurd := []event{
+		{Level: merkleAccumulator.MaxLevel + 1, NumLeaves: 1<<64 - 1},
+		{Level: 1 << 63, NumLeaves: 0},
+		{Level: 1<<64 - 1, NumLeaves: 1<<64 - 1},
+		{Level: 0, NumLeaves: 1<<64 - 1},
+		{Level: merkleAccumulator.MaxLevel, NumLeaves: 1<<64 - 1},
+		{Level: 5, NumLeaves: 1<<64 - 1},
+	}
+	for _, ev := range absurd {
+		ev.Hash = pseudorandomForTesting(ev.Level)
+		if ev.CheckPosition() == nil {
+			Fail(t, "accepted the position of", ev)
+		}
+		if _, err := NewAccumulatorFromNodeEvents([]event{ev}); err == nil {
+			Fail(t, "rebuilt an accumulator from", ev)
+		}
+		events := make(chan event, 1)
+		events <- ev
+		close(events)
+		if _, err := BuildTreeFromEventReader(ChannelEventReader(events)); err == nil {
+			Fail(t, "built a tree from", ev)
+		}
+		// a node ending at the last leaf a size can count would make the size wrap to 0, as an empty one is
+		if err := merkleAccumulator.NewNonpersistentMerkleAccumulator().ApplyEvent(ev); err == nil {
+			Fail(t, "applied", ev)
+		}
+	}
+	highest := event{Level: merkleAccumulator.MaxLevel, NumLeaves: 1<<63 - 1}
+	if err := highest.CheckPosition(); err != nil {
+		Fail(t, "rejected the highest level", err)
+	}
+	if _, err := NewMerkleTreeFromEvents(make([]event, merkleAccumulator.MaxLevel+2)); err == nil {
+		Fail(t, "built a tree from more levels than a size has")
+	}
+
+	// a single partial at the highest level fills a tree's capacity, but anything more overflows it
+	full, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(
+		append(make(merkleAccumulator.Partials, merkleAccumulator.MaxLevel), pseudorandomForTesting(0)),
+	)
+	Require(t, err)
+	tree, err := NewMerkleTreeFromAccumulator(full)
+	Require(t, err)
+	if tree.Size() != MaxTreeSize || tree.Capacity() != MaxTreeSize {
+		Fail(t, "wrong tree for the largest accumulator", tree.Size(), tree.Capacity())
+	}
+	partials := make(merkleAccumulator.Partials, merkleAccumulator.MaxLevel+1)
+	partials[0], partials[merkleAccumulator.MaxLevel] = pseudorandomForTesting(0), pseudorandomForTesting(1)
+	overfull, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartials(partials)
+	Require(t, err)
+	if _, err := NewMerkleTreeFromAccumulator(overfull); !errors.Is(err, ErrTreeTooLarge) {
+		Fail(t, "wrong error for an accumulator too large for a tree", err)
+	}
+	if _, err := ProofFromLogs(nil, 0, common.Hash{}, MaxTreeSize+1); !errors.Is(err, ErrTreeTooLarge) {
+		Fail(t, "wrong error for proving in a tree too large", err)
+	}
+	if _, err := NewProofBuilder().Build(MaxTreeSize, 1<<64-1, nil); !errors.Is(err, ErrTreeTooLarge) {
+		Fail(t, "wrong error for building a proof in a tree too large", err)
+	}
+	if _, err := rootFromSubtrees(nil, MaxTreeSize+1, Keccak256Hasher); !errors.Is(err, ErrTreeTooLarge) {
+		Fail(t, "wrong error for the root of a tree too large", err)
+	}
+	state := SendMerkleTreeStateResult{Size: new(big.Int).SetUint64(MaxTreeSize + 1)}
+	if _, err := TreeFromStateAndLogs(state, nil); !errors.Is(err, ErrTreeTooLarge) {
+		Fail(t, "wrong error for rebuilding a tree too large", err)
+	}
+}
+
+func TestIndexForContract(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 9; i++ {
+		proof, err := ProofFromAccumulator(acc, pseudorandomForTesting(i))
+		Require(t, err)
+		index, err := proof.IndexForContract()
+		Require(t, err)
+		if !index.IsUint64() || index.Uint64() != proof.LeafIndex {
+			Fail(t, "wrong index", index, proof.LeafIndex)
+		}
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+
+	proof := &MerkleProof{LeafIndex: 4, Proof: make([]common.Hash, 2)}
+	if _, err := proof.IndexForContract(); err == nil {
+		Fail(t, "leaf 4 doesn't fit in a tree of height 2")
+	}
+}
+
+func TestProveLeafFromEvents(t *testing.T) {
+	for size := uint64(2); size <= 20; size++ {
+		acc, _ := sendTreeForTesting(t, size)
+		events := latestEventsForTesting(eventHistoryForTesting(t, size))
+		tree, err := NewMerkleTreeFromEvents(events)
+		Require(t, err)
+
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProveLeafFromEvents(events, leaf)
+			stepwise, stepErr := ProveLeaf(tree, leaf)
+			if (err == nil) != (stepErr == nil) {
+				Fail(t, "paths disagree on proving leaf", leaf, "of", size, err, stepErr)
+			}
+			if err != nil {
+				// only leaves outside of summarized subtrees can be proven
+				continue
+			}
+			if !proof.IsCorrect() || proof.RootHash != root(t, acc) {
+				Fail(t, "bad proof for leaf", leaf, "of", size)
+			}
+			if proof.LeafIndex != stepwise.LeafIndex || len(proof.Proof) != len(stepwise.Proof) {
+				Fail(t, "paths produced different proofs for leaf", leaf, "of", size)
+			}
+			for i := range proof.Proof {
+				if proof.Proof[i] != stepwise.Proof[i] {
+					Fail(t, "paths produced different proofs for leaf", leaf, "of", size)
+				}
+			}
+		}
+		if size%2 == 1 {
+			// the latest leaf of an odd-sized tree is its own partial, so it's always provable
+			if _, err := ProveLeafFromEvents(events, size-1); err != nil {
+				Fail(t, "couldn't prove the latest leaf of", size, err)
+			}
+		}
+	}
+}
@@ -4,22 +4,36 @@
 package merkletree
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"math/big"
+	"reflect"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
 	"github.com/offchainlabs/nitro/arbos/util"
+	"github.com/offchainlabs/nitro/util/arbmath"
 )
 
 type MerkleTree interface {
+	// Hash is the root of the tree, or of the subtree the node is. It's what the accumulator's Root returns for
+	// the same leaves, however the tree was made: appended to, built from leaves, or from an accumulator.
 	Hash() common.Hash
 	Size() uint64
 	Capacity() uint64
 	Append(common.Hash) MerkleTree
 	SummarizeUpTo(num uint64) MerkleTree
 	Serialize(wr io.Writer) error
+	// Walk visits each node that isn't empty, parents before their children and left to right.
+	// Nodes are placed at their rightmost leaf, like LevelAndLeaf, and leaves are given by their hash in the tree.
+	// Summaries are visited but not descended into, as their children are unknown.
+	Walk(visit func(level uint64, leaf uint64, hash common.Hash))
+	// String renders the tree for debugging, a node per line with its children indented beneath it
+	String() string
 }
 
 const (
@@ -41,23 +55,101 @@ func NewLevelAndLeaf(level, leaf uint64) LevelAndLeaf {
 	}
 }
 
+// ToBigInt is the position as ArbSys emits it, ToHash as a number
 func (place LevelAndLeaf) ToBigInt() *big.Int {
-	return new(big.Int).Add(
-		new(big.Int).Lsh(big.NewInt(int64(place.Level)), 192),
-		big.NewInt(int64(place.Leaf)),
-	)
+	hash := place.ToHash()
+	return new(big.Int).SetBytes(hash[:])
 }
 
+// ToHash encodes the position as it appears in the position topic of ArbSys logs: the level in the first 8
+// bytes and the leaf in the rest. Both are uint64s, so every position fits, and the leaf only uses the last 8.
+func (place LevelAndLeaf) ToHash() common.Hash {
+	var hash common.Hash
+	binary.BigEndian.PutUint64(hash[:8], place.Level)
+	binary.BigEndian.PutUint64(hash[24:], place.Leaf)
+	return hash
+}
+
+// LevelAndLeafFromHash decodes a position encoded by ToHash, as merkleAccumulator.PositionFromHash does
+func LevelAndLeafFromHash(hash common.Hash) LevelAndLeaf {
+	return NewLevelAndLeaf(merkleAccumulator.PositionFromHash(hash))
+}
+
+// PositionTopic is a LevelAndLeaf as it appears in the position topic of ArbSys logs, as decoded by
+// LevelAndLeafFromHash
+type PositionTopic common.Hash
+
+func (topic PositionTopic) Level() uint64 {
+	return topic.LevelAndLeaf().Level
+}
+
+func (topic PositionTopic) Leaf() uint64 {
+	return topic.LevelAndLeaf().Leaf
+}
+
+func (topic PositionTopic) LevelAndLeaf() LevelAndLeaf {
+	return LevelAndLeafFromHash(common.Hash(topic))
+}
+
+// Hasher combines two child nodes into their parent. Trees, accumulators, and proofs must agree on it.
+// Whatever the hasher, leaves are hashed with Keccak256 before being included in the tree, and empty subtrees
+// hash to zero. Proofs built from a tree or accumulator carry its hasher, and so do consistency proofs and
+// multiproofs. Helpers that work from chain data, such as logs and raw roots, assume Keccak256, as do trees read
+// with NewMerkleTreeFromReader and proofs decoded from their encodings, which IsCorrectWithHasher is for.
+type Hasher = merkleAccumulator.Hasher
+
+// Keccak256Hasher is the Hasher ArbSys and the outbox use, and the default everywhere
+var Keccak256Hasher Hasher = merkleAccumulator.Keccak256Hasher
+
 func NewEmptyMerkleTree() MerkleTree {
 	return NewMerkleEmpty(0)
 }
 
+// NewEmptyMerkleTreeWithHasher makes an empty tree whose nodes, as leaves are appended, combine with the hasher
+func NewEmptyMerkleTreeWithHasher(hasher Hasher) MerkleTree {
+	return &merkleEmpty{0, hasher}
+}
+
+// NewMerkleTreeFromLeaves builds the tree that appending the leaves in order would, without any accumulator.
+// Like Append, it hashes each leaf before putting it in the tree.
+func NewMerkleTreeFromLeaves(leaves []common.Hash) MerkleTree {
+	return NewMerkleTreeFromLeavesWithHasher(leaves, Keccak256Hasher)
+}
+
+// NewMerkleTreeFromLeavesWithHasher is like NewMerkleTreeFromLeaves, combining nodes with the hasher
+func NewMerkleTreeFromLeavesWithHasher(leaves []common.Hash, hasher Hasher) MerkleTree {
+	if len(leaves) == 0 {
+		return NewEmptyMerkleTreeWithHasher(hasher)
+	}
+	capacity, err := treeCapacity(uint64(len(leaves)))
+	if err != nil {
+		panic(err) // unreachable, as a slice can't hold more than MaxTreeSize leaves
+	}
+	return merkleTreeFromLeaves(leaves, capacity, hasher)
+}
+
+func merkleTreeFromLeaves(leaves []common.Hash, capacity uint64, hasher Hasher) MerkleTree {
+	if len(leaves) == 0 {
+		return &merkleEmpty{capacity, hasher}
+	}
+	if capacity == 1 {
+		return &merkleTreeLeaf{leaves[0], hasher}
+	}
+	half := capacity / 2
+	if uint64(len(leaves)) <= half {
+		return NewMerkleInternalWithHasher(merkleTreeFromLeaves(leaves, half, hasher), &merkleEmpty{half, hasher}, hasher)
+	}
+	left := merkleTreeFromLeaves(leaves[:half], half, hasher)
+	return NewMerkleInternalWithHasher(left, merkleTreeFromLeaves(leaves[half:], half, hasher), hasher)
+}
+
 type merkleTreeLeaf struct {
-	hash common.Hash
+	hash   common.Hash
+	hasher Hasher // for the internal node made when appending
 }
 
 func NewMerkleLeaf(hash common.Hash) MerkleTree {
-	return &merkleTreeLeaf{hash}
+	return &merkleTreeLeaf{hash, Keccak256Hasher}
 }
 
 func newMerkleLeafFromReader(rd io.Reader) (MerkleTree, error) {
@@ -78,13 +170,21 @@ func (leaf *merkleTreeLeaf) Capacity() uint64 {
 }
 
 func (leaf *merkleTreeLeaf) Append(newHash common.Hash) MerkleTree {
-	return NewMerkleInternal(leaf, NewMerkleLeaf(newHash))
+	return NewMerkleInternalWithHasher(leaf, &merkleTreeLeaf{newHash, leaf.hasher}, leaf.hasher)
 }
 
 func (leaf *merkleTreeLeaf) SummarizeUpTo(num uint64) MerkleTree {
 	return leaf
 }
 
+func (leaf *merkleTreeLeaf) Walk(visit func(level uint64, leaf uint64, hash common.Hash)) {
+	walk(leaf, 0, visit)
+}
+
+func (leaf *merkleTreeLeaf) String() string {
+	return renderTree(leaf)
+}
+
 func (leaf *merkleTreeLeaf) Serialize(wr io.Writer) error {
 	if _, err := wr.Write([]byte{SerializedLeaf}); err != nil {
 		return err
@@ -95,10 +195,16 @@ func (leaf *merkleTreeLeaf) Serialize(wr io.Writer) error {
 
 type merkleEmpty struct {
 	capacity uint64
+	hasher   Hasher
 }
 
 func NewMerkleEmpty(capacity uint64) MerkleTree {
-	return &merkleEmpty{capacity}
+	return &merkleEmpty{capacity, Keccak256Hasher}
+}
+
+// EmptyTreeRoot is the root of an empty tree, which is zero at every capacity as empty subtrees hash to zero
+func EmptyTreeRoot(_ uint64) common.Hash {
+	return common.Hash{}
 }
 
 func newMerkleEmptyFromReader(rd io.Reader) (MerkleTree, error) {
@@ -120,10 +226,10 @@ func (me *merkleEmpty) Capacity() uint64 {
 
 func (me *merkleEmpty) Append(newHash common.Hash) MerkleTree {
 	if me.capacity <= 1 {
-		return NewMerkleLeaf(newHash)
+		return &merkleTreeLeaf{newHash, me.hasher}
 	} else {
-		halfSizeEmpty := NewMerkleEmpty(me.capacity / 2)
-		return NewMerkleInternal(halfSizeEmpty.Append(newHash), halfSizeEmpty)
+		halfSizeEmpty := &merkleEmpty{me.capacity / 2, me.hasher}
+		return NewMerkleInternalWithHasher(halfSizeEmpty.Append(newHash), halfSizeEmpty, me.hasher)
 	}
 }
 
@@ -131,6 +237,12 @@ func (me *merkleEmpty) SummarizeUpTo(num uint64) MerkleTree {
 	return me
 }
 
+func (me *merkleEmpty) Walk(visit func(level uint64, leaf uint64, hash common.Hash)) {}
+
+func (me *merkleEmpty) String() string {
+	return renderTree(me)
+}
+
 func (me *merkleEmpty) Serialize(wr io.Writer) error {
 	if _, err := wr.Write([]byte{SerializedEmptySubtree}); err != nil {
 		return err
@@ -144,15 +256,23 @@ type merkleInternal struct {
 	capacity uint64
 	left     MerkleTree
 	right    MerkleTree
+	hasher   Hasher
 }
 
 func NewMerkleInternal(left, right MerkleTree) MerkleTree {
+	return NewMerkleInternalWithHasher(left, right, Keccak256Hasher)
+}
+
+// NewMerkleInternalWithHasher joins two subtrees made with the hasher, which also combines any nodes made by
+// appending to the result
+func NewMerkleInternalWithHasher(left, right MerkleTree, hasher Hasher) MerkleTree {
 	return &merkleInternal{
-		crypto.Keccak256Hash(left.Hash().Bytes(), right.Hash().Bytes()),
+		hasher(left.Hash(), right.Hash()),
 		left.Size() + right.Size(),
 		left.Capacity() + right.Capacity(),
 		left,
 		right,
+		hasher,
 	}
 }
 
@@ -182,11 +302,12 @@ func (mi *merkleInternal) Capacity() uint64 {
 
 func (mi *merkleInternal) Append(newHash common.Hash) MerkleTree {
 	if mi.size == mi.capacity {
-		return NewMerkleInternal(mi, NewMerkleEmpty(mi.capacity).Append(newHash))
+		empty := &merkleEmpty{mi.capacity, mi.hasher}
+		return NewMerkleInternalWithHasher(mi, empty.Append(newHash), mi.hasher)
 	} else if 2*mi.size < mi.capacity {
-		return NewMerkleInternal(mi.left.Append(newHash), mi.right)
+		return NewMerkleInternalWithHasher(mi.left.Append(newHash), mi.right, mi.hasher)
 	} else {
-		return NewMerkleInternal(mi.left, mi.right.Append(newHash))
+		return NewMerkleInternalWithHasher(mi.left, mi.right.Append(newHash), mi.hasher)
 	}
 }
 
@@ -196,13 +317,21 @@ func (mi *merkleInternal) SummarizeUpTo(num uint64) MerkleTree {
 	} else {
 		leftSize := mi.left.Size()
 		if num <= leftSize {
-			return NewMerkleInternal(mi.left.SummarizeUpTo(num), mi.right)
+			return NewMerkleInternalWithHasher(mi.left.SummarizeUpTo(num), mi.right, mi.hasher)
 		} else {
-			return NewMerkleInternal(summaryFromMerkleTree(mi.left), mi.right.SummarizeUpTo(num-leftSize))
+			return NewMerkleInternalWithHasher(summaryFromMerkleTree(mi.left), mi.right.SummarizeUpTo(num-leftSize), mi.hasher)
 		}
 	}
 }
 
+func (mi *merkleInternal) Walk(visit func(level uint64, leaf uint64, hash common.Hash)) {
+	walk(mi, 0, visit)
+}
+
+func (mi *merkleInternal) String() string {
+	return renderTree(mi)
+}
+
 func (mi *merkleInternal) Serialize(wr io.Writer) error {
 	if _, err := wr.Write([]byte{SerializedInternalNode}); err != nil {
 		return err
@@ -216,10 +345,16 @@ func (mi *merkleInternal) Serialize(wr io.Writer) error {
 type merkleCompleteSubtreeSummary struct {
 	hash     common.Hash
 	capacity uint64
+	hasher   Hasher
 }
 
 func NewSummaryMerkleTree(hash common.Hash, capacity uint64) MerkleTree {
-	return &merkleCompleteSubtreeSummary{hash, capacity}
+	return NewSummaryMerkleTreeWithHasher(hash, capacity, Keccak256Hasher)
+}
+
+// NewSummaryMerkleTreeWithHasher summarizes a complete subtree made with the hasher
+func NewSummaryMerkleTreeWithHasher(hash common.Hash, capacity uint64, hasher Hasher) MerkleTree {
+	return &merkleCompleteSubtreeSummary{hash, capacity, hasher}
 }
 
 func summaryFromMerkleTree(subtree MerkleTree) MerkleTree {
@@ -229,7 +364,41 @@ func summaryFromMerkleTree(subtree MerkleTree) MerkleTree {
 	if subtree.Size() != subtree.Capacity() {
 		panic("tried to summarize a non-full MerkleTree node")
 	}
-	return &merkleCompleteSubtreeSummary{subtree.Hash(), subtree.Capacity()}
+	return &merkleCompleteSubtreeSummary{subtree.Hash(), subtree.Capacity(), hasherOf(subtree)}
+}
+
+// hasherOf returns the hasher of a tree made by this package
+func hasherOf(tree MerkleTree) Hasher {
+	switch tree := tree.(type) {
+	case *merkleTreeLeaf:
+		return tree.hasher
+	case *merkleEmpty:
+		return tree.hasher
+	case *merkleInternal:
+		return tree.hasher
+	case *merkleCompleteSubtreeSummary:
+		return tree.hasher
+	case *merklePadded:
+		return tree.hasher
+	}
+	return Keccak256Hasher
+}
+
+// proofHasher is the hasher a proof keeps: nil for Keccak256, so that proofs of ordinary trees are the same as
+// those decoded from their encodings
+func proofHasher(hasher Hasher) Hasher {
+	if hasher == nil || reflect.ValueOf(hasher).Pointer() == reflect.ValueOf(Keccak256Hasher).Pointer() {
+		return nil
+	}
+	return hasher
+}
+
+// orKeccak256 undoes proofHasher
+func orKeccak256(hasher Hasher) Hasher {
+	if hasher == nil {
+		return Keccak256Hasher
+	}
+	return hasher
 }
 
 func newMerkleSummaryFromReader(rd io.Reader) (MerkleTree, error) {
@@ -241,7 +410,7 @@ func newMerkleSummaryFromReader(rd io.Reader) (MerkleTree, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &merkleCompleteSubtreeSummary{hash, capacity}, nil
+	return NewSummaryMerkleTree(hash, capacity), nil
 }
 
 func (sum *merkleCompleteSubtreeSummary) Hash() common.Hash {
@@ -257,13 +426,22 @@ func (sum *merkleCompleteSubtreeSummary) Capacity() uint64 {
 }
 
 func (sum *merkleCompleteSubtreeSummary) Append(newHash common.Hash) MerkleTree {
-	return NewMerkleInternal(sum, NewMerkleEmpty(sum.capacity).Append(newHash))
+	empty := &merkleEmpty{sum.capacity, sum.hasher}
+	return NewMerkleInternalWithHasher(sum, empty.Append(newHash), sum.hasher)
 }
 
 func (sum *merkleCompleteSubtreeSummary) SummarizeUpTo(num uint64) MerkleTree {
 	return sum
 }
 
+func (sum *merkleCompleteSubtreeSummary) Walk(visit func(level uint64, leaf uint64, hash common.Hash)) {
+	walk(sum, 0, visit)
+}
+
+func (sum *merkleCompleteSubtreeSummary) String() string {
+	return renderTree(sum)
+}
+
 func (sum *merkleCompleteSubtreeSummary) Serialize(wr io.Writer) error {
 	if _, err := wr.Write([]byte{SerializedSubtreeSummary}); err != nil {
 		return err
@@ -275,6 +453,100 @@ func (sum *merkleCompleteSubtreeSummary) Serialize(wr io.Writer) error {
 	return err
 }
 
+// merklePadded is a subtree padded with empty subtrees to the right up to a larger capacity, as partials are when
+// rebuilding a tree from an accumulator. It stands for the spine of internal nodes pairing the subtree with
+// ever larger empty ones, keeping only their hashes, and behaves as that spine would. Code looking inside
+// internal nodes gets the spine's top node from internalNode, which materializes it a level at a time.
+type merklePadded struct {
+	child  MerkleTree
+	hashes []common.Hash // of the spine's nodes, bottom-up, so the last is the root
+	hasher Hasher
+}
+
+// newMerklePadded pads the subtree with empty subtrees up to the capacity, which must be a larger power of 2
+func newMerklePadded(child MerkleTree, capacity uint64, hasher Hasher) MerkleTree {
+	if padded, ok := child.(*merklePadded); ok {
+		child = padded.child
+	}
+	hashes := make([]common.Hash, 0, arbmath.Log2ceil(capacity/child.Capacity())-1)
+	hash := child.Hash()
+	for width := child.Capacity(); width < capacity; width *= 2 {
+		hash = hasher(hash, EmptyTreeRoot(width))
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return child
+	}
+	return &merklePadded{child, hashes, hasher}
+}
+
+func (mp *merklePadded) Hash() common.Hash {
+	return mp.hashes[len(mp.hashes)-1]
+}
+
+func (mp *merklePadded) Size() uint64 {
+	return mp.child.Size()
+}
+
+func (mp *merklePadded) Capacity() uint64 {
+	return mp.child.Capacity() << len(mp.hashes)
+}
+
+func (mp *merklePadded) Append(newHash common.Hash) MerkleTree {
+	return mp.expand().Append(newHash)
+}
+
+func (mp *merklePadded) SummarizeUpTo(num uint64) MerkleTree {
+	return mp.expand().SummarizeUpTo(num)
+}
+
+func (mp *merklePadded) Walk(visit func(level uint64, leaf uint64, hash common.Hash)) {
+	walk(mp, 0, visit)
+}
+
+func (mp *merklePadded) String() string {
+	return renderTree(mp)
+}
+
+func (mp *merklePadded) Serialize(wr io.Writer) error {
+	return mp.expand().Serialize(wr)
+}
+
+// expand materializes the top of the spine, whose left child is the rest of it
+func (mp *merklePadded) expand() *merkleInternal {
+	half := mp.Capacity() / 2
+	left := mp.child
+	if len(mp.hashes) > 1 {
+		left = &merklePadded{mp.child, mp.hashes[:len(mp.hashes)-1], mp.hasher}
+	}
+	right := &merkleEmpty{half, mp.hasher}
+	return &merkleInternal{mp.Hash(), mp.child.Size(), 2 * half, left, right, mp.hasher}
+}
+
+// internalNode returns the node as an internal node if it is one, including the top of a padded subtree
+func internalNode(tree MerkleTree) (*merkleInternal, bool) {
+	switch node := tree.(type) {
+	case *merkleInternal:
+		return node, true
+	case *merklePadded:
+		return node.expand(), true
+	}
+	return nil, false
+}
+
+// walk does the work of Walk for a subtree whose leftmost leaf is first
+func walk(tree MerkleTree, first uint64, visit func(level uint64, leaf uint64, hash common.Hash)) {
+	if tree.Size() == 0 {
+		return
+	}
+	level := arbmath.Log2ceil(tree.Capacity()) - 1
+	visit(level, first+tree.Capacity()-1, tree.Hash())
+	if node, ok := internalNode(tree); ok {
+		walk(node.left, first, visit)
+		walk(node.right, first+node.left.Capacity(), visit)
+	}
+}
+
 func NewMerkleTreeFromReader(rd io.Reader) (MerkleTree, error) {
 	var typeBuf [1]byte
 	if _, err := rd.Read(typeBuf[:]); err != nil {
@@ -294,27 +566,527 @@ func NewMerkleTreeFromReader(rd io.Reader) (MerkleTree, error) {
 	}
 }
 
+// ErrEmptyLeafPosition is returned when asked about an index past a tree's last leaf but within its capacity
+var ErrEmptyLeafPosition = errors.New("leaf position is empty")
+
+// checkLeafIndex ensures the index is that of one of the size leaves of a tree with the given capacity
+func checkLeafIndex(index, size, capacity uint64) error {
+	if index >= capacity {
+		return fmt.Errorf("leaf %v is beyond the tree's capacity of %v", index, capacity)
+	}
+	if index >= size {
+		return fmt.Errorf("%w: leaf %v of a tree of size %v", ErrEmptyLeafPosition, index, size)
+	}
+	return nil
+}
+
+// MaxTreeSize is the most leaves a tree can have, as its capacity must fit in a uint64. Accumulators can count
+// more, but their trees can't be built or proven in.
+const MaxTreeSize = 1 << merkleAccumulator.MaxLevel
+
+// ErrTreeTooLarge is returned for trees of more than MaxTreeSize leaves
+var ErrTreeTooLarge = errors.New("tree has more leaves than its capacity can count")
+
+// treeCapacity returns the capacity of a tree of the given size, which must not exceed MaxTreeSize. Beyond it,
+// NextOrCurrentPowerOf2 returns its MaxUint64 sentinel, which isn't a capacity.
+func treeCapacity(size uint64) (uint64, error) {
+	capacity := arbmath.NextOrCurrentPowerOf2(size)
+	if capacity == math.MaxUint64 {
+		return 0, fmt.Errorf("%w: %v leaves", ErrTreeTooLarge, size)
+	}
+	return capacity, nil
+}
+
+// checkLeafInTree ensures the index is that of a leaf in a tree of the given size, which must not exceed
+// MaxTreeSize, so that the positions found for it can't overflow
+func checkLeafInTree(index, size uint64) error {
+	capacity, err := treeCapacity(size)
+	if err != nil {
+		return err
+	}
+	return checkLeafIndex(index, size, capacity)
+}
+
+// LeafHash returns the hash of the leaf at the given index, which is already hashed as it would be in a proof
+func LeafHash(tree MerkleTree, index uint64) (common.Hash, error) {
+	if err := checkLeafIndex(index, tree.Size(), tree.Capacity()); err != nil {
+		return common.Hash{}, err
+	}
+	leafHash, _, err := proveLeaf(tree, index)
+	return leafHash, err
+}
+
+// ProveLeaf proves the leaf at the given index is in the tree. Summarized subtrees hide their leaves,
+// so leaves inside them can't be proven.
+func ProveLeaf(tree MerkleTree, index uint64) (*MerkleProof, error) {
+	if err := checkLeafIndex(index, tree.Size(), tree.Capacity()); err != nil {
+		return nil, err
+	}
+	leafHash, proof, err := proveLeaf(tree, index)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{
+		RootHash:  tree.Hash(),
+		LeafHash:  leafHash,
+		LeafIndex: index,
+		Proof:     proof,
+		hasher:    proofHasher(hasherOf(tree)),
+	}, nil
+}
+
+// proveLeaf finds the hash of the leaf and its siblings from the bottom of the tree up
+func proveLeaf(tree MerkleTree, index uint64) (common.Hash, []common.Hash, error) {
+	if node, ok := internalNode(tree); ok {
+		tree = node
+	}
+	switch node := tree.(type) {
+	case *merkleTreeLeaf:
+		return node.Hash(), []common.Hash{}, nil
+	case *merkleInternal:
+		half := node.left.Capacity()
+		if index < half {
+			leafHash, proof, err := proveLeaf(node.left, index)
+			return leafHash, append(proof, node.right.Hash()), err
+		}
+		leafHash, proof, err := proveLeaf(node.right, index-half)
+		return leafHash, append(proof, node.left.Hash()), err
+	case *merkleCompleteSubtreeSummary:
+		if node.capacity == 1 {
+			// a summarized leaf, whose hash is that of the leaf
+			return node.hash, []common.Hash{}, nil
+		}
+		return common.Hash{}, nil, fmt.Errorf("leaf is inside a summarized subtree of capacity %v", node.capacity)
+	case *merkleEmpty:
+		return common.Hash{}, nil, ErrEmptyLeafPosition
+	default:
+		return common.Hash{}, nil, errors.New("unknown merkle tree node")
+	}
+}
+
+// PruneToLeaf returns a tree with the same root and size that keeps only what's needed to prove the leaf:
+// the nodes on its path, with every subtree off the path summarized. Summarizing a single leaf leaves its hash,
+// which is as good as the leaf for proving, so the pruned tree can also prove the leaf's sibling and, in a tree
+// of odd size, the last leaf.
+func PruneToLeaf(tree MerkleTree, index uint64) (MerkleTree, error) {
+	if err := checkLeafIndex(index, tree.Size(), tree.Capacity()); err != nil {
+		return nil, err
+	}
+	return pruneToLeaf(tree, index)
+}
+
+func pruneToLeaf(tree MerkleTree, index uint64) (MerkleTree, error) {
+	if node, ok := internalNode(tree); ok {
+		tree = node
+	}
+	switch node := tree.(type) {
+	case *merkleTreeLeaf:
+		return node, nil
+	case *merkleInternal:
+		half := node.left.Capacity()
+		if index < half {
+			left, err := pruneToLeaf(node.left, index)
+			if err != nil {
+				return nil, err
+			}
+			return NewMerkleInternalWithHasher(left, summarizeOffPath(node.right), node.hasher), nil
+		}
+		right, err := pruneToLeaf(node.right, index-half)
+		if err != nil {
+			return nil, err
+		}
+		return NewMerkleInternalWithHasher(summarizeOffPath(node.left), right, node.hasher), nil
+	case *merkleCompleteSubtreeSummary:
+		if node.capacity == 1 {
+			return node, nil
+		}
+		return nil, fmt.Errorf("leaf is inside a summarized subtree of capacity %v", node.capacity)
+	case *merkleEmpty:
+		return nil, ErrEmptyLeafPosition
+	default:
+		return nil, errors.New("unknown merkle tree node")
+	}
+}
+
+// summarizeOffPath replaces the subtree with the fewest nodes that keep its hash and size.
+// Complete subtrees become summaries, while partly filled ones keep their internal nodes down to complete ones.
+func summarizeOffPath(tree MerkleTree) MerkleTree {
+	if node, ok := internalNode(tree); ok {
+		tree = node
+	}
+	switch node := tree.(type) {
+	case *merkleInternal:
+		if node.size != node.capacity {
+			return NewMerkleInternalWithHasher(summarizeOffPath(node.left), summarizeOffPath(node.right), node.hasher)
+		}
+	case *merkleEmpty:
+		return node
+	}
+	return NewSummaryMerkleTreeWithHasher(tree.Hash(), tree.Capacity(), hasherOf(tree))
+}
+
+// ProveLeafAtSize proves the leaf is in the tree as it was when it only had the given number of leaves.
+// Subtrees made entirely of earlier leaves are shared, so only the nodes along the tree's edge are rehashed.
+func ProveLeafAtSize(tree MerkleTree, index, size uint64) (*MerkleProof, error) {
+	if size > tree.Size() {
+		return nil, fmt.Errorf("tree of size %v has no past version of size %v", tree.Size(), size)
+	}
+	capacity, err := treeCapacity(size)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLeafIndex(index, size, capacity); err != nil {
+		return nil, err
+	}
+	for tree.Capacity() > capacity {
+		node, ok := internalNode(tree)
+		if !ok {
+			return nil, fmt.Errorf("can't find the tree of size %v in a summary", size)
+		}
+		tree = node.left
+	}
+	root, err := hashOfPrefix(tree, size)
+	if err != nil {
+		return nil, err
+	}
+	leafHash, proof, err := proveLeafAtSize(tree, index, size)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{
+		RootHash:  root,
+		LeafHash:  leafHash,
+		LeafIndex: index,
+		Proof:     proof,
+		hasher:    proofHasher(hasherOf(tree)),
+	}, nil
+}
+
+// proveLeafAtSize is proveLeaf for the version of the tree with only its first size leaves
+func proveLeafAtSize(tree MerkleTree, index, size uint64) (common.Hash, []common.Hash, error) {
+	node, ok := internalNode(tree)
+	if !ok || size >= tree.Size() {
+		return proveLeaf(tree, index)
+	}
+	half := node.left.Capacity()
+	if index < half {
+		leafHash, proof, err := proveLeafAtSize(node.left, index, arbmath.MinInt(size, half))
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		sibling, err := hashOfPrefix(node.right, arbmath.SaturatingUSub(size, half))
+		return leafHash, append(proof, sibling), err
+	}
+	leafHash, proof, err := proveLeafAtSize(node.right, index-half, size-half)
+	return leafHash, append(proof, node.left.Hash()), err
+}
+
+// hashOfPrefix finds the hash the tree had when it only had its first size leaves
+func hashOfPrefix(tree MerkleTree, size uint64) (common.Hash, error) {
+	if size >= tree.Size() {
+		return tree.Hash(), nil
+	}
+	if size == 0 {
+		return common.Hash{}, nil
+	}
+	node, ok := internalNode(tree)
+	if !ok {
+		return common.Hash{}, fmt.Errorf("can't find the first %v leaves of a summary of capacity %v", size, tree.Capacity())
+	}
+	half := node.left.Capacity()
+	left, err := hashOfPrefix(node.left, arbmath.MinInt(size, half))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	right, err := hashOfPrefix(node.right, arbmath.SaturatingUSub(size, half))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return hasherOf(tree)(left, right), nil
+}
+
+// MaterializedDepth returns how many levels below the root the tree's nodes are all internal nodes or leaves,
+// rather than summaries or empties. Leaves down to that depth can be proven without fetching more data.
+func MaterializedDepth(tree MerkleTree) uint64 {
+	node, ok := internalNode(tree)
+	if !ok {
+		return 0
+	}
+	return 1 + arbmath.MinInt(MaterializedDepth(node.left), MaterializedDepth(node.right))
+}
+
+// MerkleProof proves LeafHash is at LeafIndex in the tree with RootHash.
+// Proof holds the leaf's siblings in a fixed order, bottom-up from the leaf's level to the one just below the root,
+// so that building a proof from the same inputs always yields the same bytes.
+// A proof built from a tree or accumulator is checked with the same hasher its nodes combine with.
 type MerkleProof struct {
 	RootHash  common.Hash
 	LeafHash  common.Hash
 	LeafIndex uint64
 	Proof     []common.Hash
+	hasher    Hasher // nil for Keccak256
 }
 
+// Hasher returns the hasher the proof's nodes combine with
+func (proof *MerkleProof) Hasher() Hasher {
+	return orKeccak256(proof.hasher)
+}
+
+// Errors returned by Verify
+var (
+	ErrProofLengthMismatch = errors.New("proof has more siblings than a tree can be deep")
+	ErrLeafIndexOutOfRange = errors.New("leaf index is beyond a tree as deep as the proof")
+	ErrRootMismatch        = errors.New("proof doesn't produce its root")
+)
+
+// IsCorrect checks the proof, like Verify but without saying why it's wrong.
+// The proof's depth is its number of siblings, so it's rejected without hashing if the leaf index needs more bits
+// than that. A proof doesn't say how large its tree is; checking the depth matches the tree's is up to callers
+// that know its size, as VerifyAgainstRootMap does.
 func (proof *MerkleProof) IsCorrect() bool {
+	return proof.Verify() == nil
+}
+
+// IsCorrectWithHasher checks the proof like IsCorrect, for a tree whose nodes combine with the hasher, as for a
+// proof decoded from its encoding, which doesn't record the hasher
+func (proof *MerkleProof) IsCorrectWithHasher(hasher Hasher) bool {
+	return proof.VerifyWithHasher(hasher) == nil
+}
+
+// Verify checks the proof by folding its siblings into the leaf one level at a time.
+// The leaf index's bit for each level says whether the node so far is the left or right child, so the proof
+// only verifies for the position it claims, and the siblings can't be reordered to prove a leaf elsewhere.
+// It doesn't recurse, so it needs constant stack space however deep the tree is.
+func (proof *MerkleProof) Verify() error {
+	return proof.VerifyWithHasher(proof.Hasher())
+}
+
+// VerifyWithHasher checks the proof like Verify, for a tree whose nodes combine with the hasher
+func (proof *MerkleProof) VerifyWithHasher(hasher Hasher) error {
+	return proof.verify(hasher, nil)
+}
+
+// verify is VerifyWithHasher, passing each step of the fold to visit as computeRoot does
+func (proof *MerkleProof) verify(hasher Hasher, visit func(VerifyStep)) error {
+	hash, err := proof.computeRoot(hasher, visit)
+	if err != nil {
+		return err
+	}
+	if hash != proof.RootHash {
+		return fmt.Errorf("%w: computed %v, expected %v", ErrRootMismatch, hash, proof.RootHash)
+	}
+	return nil
+}
+
+// VerifyAny checks which of the candidate roots the proof is for, ignoring its RootHash, as when several recent
+// roots are held and it isn't known which the proof targets. The root is computed once, however many there are.
+func (proof *MerkleProof) VerifyAny(roots []common.Hash) (common.Hash, bool) {
+	hash, err := proof.computeRoot(proof.Hasher(), nil)
+	if err != nil {
+		return common.Hash{}, false
+	}
+	for _, root := range roots {
+		if root == hash {
+			return root, true
+		}
+	}
+	return common.Hash{}, false
+}
+
+// computeRoot folds the siblings into the leaf, after checking the leaf index fits the proof's depth.
+// If visit isn't nil, it's called with each step of the fold, bottom-up.
+func (proof *MerkleProof) computeRoot(hasher Hasher, visit func(VerifyStep)) (common.Hash, error) {
+	depth := len(proof.Proof)
+	if depth > 64 {
+		return common.Hash{}, fmt.Errorf("%w: %v siblings", ErrProofLengthMismatch, depth)
+	}
+	if depth < 64 && proof.LeafIndex>>depth != 0 {
+		return common.Hash{}, fmt.Errorf("%w: leaf %v with %v siblings", ErrLeafIndexOutOfRange, proof.LeafIndex, depth)
+	}
 	hash := proof.LeafHash
 	index := proof.LeafIndex
-	for _, hashFromProof := range proof.Proof {
-
+	for level, hashFromProof := range proof.Proof {
+		var parent common.Hash
 		if index&1 == 0 {
-			hash = crypto.Keccak256Hash(hash.Bytes(), hashFromProof.Bytes())
+			parent = hasher(hash, hashFromProof)
 		} else {
-			hash = crypto.Keccak256Hash(hashFromProof.Bytes(), hash.Bytes())
+			parent = hasher(hashFromProof, hash)
 		}
+		if visit != nil {
+			visit(VerifyStep{Level: uint64(level), Hash: hash, Sibling: hashFromProof, SiblingOnLeft: index&1 == 1, Parent: parent})
+		}
+		hash = parent
 		index = index / 2
 	}
-	if index != 0 {
+	return hash, nil
+}
+
+// ID commits to every field of the proof, so that identical proofs share an ID and proofs differing in any way don't
+func (proof *MerkleProof) ID() common.Hash {
+	data := make([]byte, 0, 32+8+32+32*len(proof.Proof))
+	data = append(data, proof.RootHash.Bytes()...)
+	data = binary.BigEndian.AppendUint64(data, proof.LeafIndex)
+	data = append(data, proof.LeafHash.Bytes()...)
+	for _, hash := range proof.Proof {
+		data = append(data, hash.Bytes()...)
+	}
+	return crypto.Keccak256Hash(data)
+}
+
+// Equal returns whether the proofs have the same root, leaf, leaf index, and siblings, as a proof cached for a
+// leaf and one built for it again after a reorg would unless the tree changed. Two nil proofs are equal.
+// Their hashers can't be compared, so they aren't.
+func (proof *MerkleProof) Equal(other *MerkleProof) bool {
+	if proof == nil || other == nil {
+		return proof == other
+	}
+	if proof.RootHash != other.RootHash || proof.LeafHash != other.LeafHash || proof.LeafIndex != other.LeafIndex {
+		return false
+	}
+	if len(proof.Proof) != len(other.Proof) {
 		return false
 	}
-	return hash == proof.RootHash
+	for i := range proof.Proof {
+		if proof.Proof[i] != other.Proof[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone copies the proof along with its siblings, so that the copy can be cached without changes to either
+// proof affecting the other
+func (proof *MerkleProof) Clone() *MerkleProof {
+	if proof == nil {
+		return nil
+	}
+	clone := *proof
+	if proof.Proof != nil {
+		clone.Proof = make([]common.Hash, len(proof.Proof))
+		copy(clone.Proof, proof.Proof)
+	}
+	return &clone
+}
+
+// VerifyWithIntermediates checks the proof like Verify, returning the hash of each node on the path from
+// the leaf to the root, so the last is the root
+func (proof *MerkleProof) VerifyWithIntermediates() ([]common.Hash, error) {
+	intermediates := make([]common.Hash, 0, len(proof.Proof)+1)
+	intermediates = append(intermediates, proof.LeafHash)
+	err := proof.verify(proof.Hasher(), func(step VerifyStep) {
+		intermediates = append(intermediates, step.Parent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return intermediates, nil
+}
+
+// VerifyStep is one level of a proof's verification: the node so far, the sibling it combines with, and their parent
+type VerifyStep struct {
+	Level         uint64
+	Hash          common.Hash
+	Sibling       common.Hash
+	SiblingOnLeft bool // the node so far is the right child, per the leaf index's bit for the level
+	Parent        common.Hash
+}
+
+// VerifyVerbose checks the proof like IsCorrect, also returning a step for each of its siblings, bottom-up, so
+// that a failing proof can be traced level by level. The last step's parent is the root the proof computes,
+// which ok says is RootHash. The steps are returned even if that root is wrong, but proofs rejected without
+// hashing, for being deeper than a tree can be or for a leaf beyond their depth, have none.
+func (proof *MerkleProof) VerifyVerbose() (steps []VerifyStep, ok bool) {
+	steps, hash, err := proof.trace()
+	if err != nil {
+		return nil, false
+	}
+	return steps, hash == proof.RootHash
+}
+
+// trace folds the proof with its hasher like computeRoot, returning each step along with the root computed
+func (proof *MerkleProof) trace() ([]VerifyStep, common.Hash, error) {
+	steps := []VerifyStep{}
+	hash, err := proof.computeRoot(proof.Hasher(), func(step VerifyStep) {
+		steps = append(steps, step)
+	})
+	return steps, hash, err
+}
+
+// ReconstructNodes returns the hash of every node involved in verifying the proof in a tree of the given size,
+// by position: the leaf, its siblings, and the nodes computed on the path up to the root. Proofs built without
+// explicit empty siblings are expanded first. The nodes aren't checked against the root, which IsCorrect is for,
+// and nil is returned if the proof doesn't fit a tree of the given size.
+func (proof *MerkleProof) ReconstructNodes(treeSize uint64) map[LevelAndLeaf]common.Hash {
+	if proof.LeafIndex >= treeSize {
+		return nil
+	}
+	full := proof
+	if len(proof.Proof) != ProofHashOps(treeSize, proof.LeafIndex) {
+		expanded, err := ExpandEmptySiblings(proof, treeSize)
+		if err != nil {
+			return nil
+		}
+		full = expanded
+	}
+	steps, _, err := full.trace()
+	if err != nil {
+		return nil
+	}
+	nodes := map[LevelAndLeaf]common.Hash{NewLevelAndLeaf(0, full.LeafIndex): full.LeafHash}
+	for _, step := range steps {
+		nodes[SiblingPosition(full.LeafIndex, step.Level)] = step.Sibling
+		nodes[NewLevelAndLeaf(step.Level+1, full.LeafIndex|(1<<(step.Level+1)-1))] = step.Parent
+	}
+	return nodes
+}
+
+// IndexForContract returns the leaf index as the uint256 the outbox's executeTransaction expects,
+// erroring if the index wouldn't fit in a tree whose height matches the proof's length
+func (proof *MerkleProof) IndexForContract() (*big.Int, error) {
+	if len(proof.Proof) < 64 && proof.LeafIndex >= 1<<len(proof.Proof) {
+		return nil, fmt.Errorf("leaf %v is beyond the capacity of a tree of height %v", proof.LeafIndex, len(proof.Proof))
+	}
+	return new(big.Int).SetUint64(proof.LeafIndex), nil
+}
+
+// ProofDelta returns the siblings of target that differ from those of base, along with their indices in Proof,
+// so a client that already has base can be sent only what changed. Both proofs must be for the same root.
+func ProofDelta(base, target *MerkleProof) ([]common.Hash, []int, error) {
+	if base.RootHash != target.RootHash {
+		return nil, nil, fmt.Errorf("proofs are for different roots %v and %v", base.RootHash, target.RootHash)
+	}
+	if len(base.Proof) != len(target.Proof) {
+		return nil, nil, fmt.Errorf("proofs have %v and %v siblings", len(base.Proof), len(target.Proof))
+	}
+	siblings := []common.Hash{}
+	indices := []int{}
+	for i := range target.Proof {
+		if base.Proof[i] != target.Proof[i] {
+			siblings = append(siblings, target.Proof[i])
+			indices = append(indices, i)
+		}
+	}
+	return siblings, indices, nil
+}
+
+// ApplyProofDelta rebuilds the proof of the given leaf from base and the delta ProofDelta returned for it
+func ApplyProofDelta(base *MerkleProof, leafHash common.Hash, leafIndex uint64, siblings []common.Hash, indices []int) (*MerkleProof, error) {
+	if len(siblings) != len(indices) {
+		return nil, fmt.Errorf("delta has %v siblings but %v indices", len(siblings), len(indices))
+	}
+	proof := make([]common.Hash, len(base.Proof))
+	copy(proof, base.Proof)
+	for i, index := range indices {
+		if index < 0 || index >= len(proof) {
+			return nil, fmt.Errorf("delta index %v is out of range for a proof of %v siblings", index, len(proof))
+		}
+		proof[index] = siblings[i]
+	}
+	return &MerkleProof{
+		RootHash:  base.RootHash,
+		LeafHash:  leafHash,
+		LeafIndex: leafIndex,
+		Proof:     proof,
+		hasher:    base.hasher,
+	}, nil
 }
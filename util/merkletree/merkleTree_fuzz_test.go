@@ -0,0 +1,45 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+)
+
+// FuzzTreeHashMatchesRoot appends batches of leaves, one batch per byte of counts, checking after each that
+// every way of making the tree agrees with the accumulator's root
+func FuzzTreeHashMatchesRoot(f *testing.F) {
+	f.Add(uint64(0), []byte{1})
+	f.Add(uint64(1), []byte{1, 1, 1, 1, 1})
+	f.Add(uint64(2), []byte{2, 6, 8, 16, 32, 191})
+	f.Add(uint64(3), []byte{255, 0, 3, 129})
+	f.Fuzz(func(t *testing.T, seed uint64, counts []byte) {
+		acc := merkleAccumulator.NewNonpersistentMerkleAccumulator()
+		appended := NewEmptyMerkleTree()
+		leaves := []common.Hash{}
+		for _, count := range counts {
+			if len(leaves) >= 1<<12 {
+				break
+			}
+			for i := 0; i < int(count); i++ {
+				leaf := pseudorandomForTesting(seed<<32 | uint64(len(leaves)))
+				accAppend(t, acc, leaf)
+				appended = appended.Append(leaf)
+				leaves = append(leaves, leaf)
+			}
+			expected := root(t, acc)
+			fromAcc, err := NewMerkleTreeFromAccumulator(acc)
+			Require(t, err)
+			if fromAcc.Hash() != expected || appended.Hash() != expected {
+				Fail(t, "tree hashes differ from the root at size", len(leaves))
+			}
+			if NewMerkleTreeFromLeaves(leaves).Hash() != expected {
+				Fail(t, "the tree built from leaves differs from the root at size", len(leaves))
+			}
+		}
+	})
+}
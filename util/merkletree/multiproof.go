@@ -0,0 +1,119 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// BatchMerkleProof proves several leaves against one root. Nodes shared by the leaves' paths, or computed from
+// other leaves, are left out, so clustered leaves need far fewer hashes than separate proofs would.
+// Proof holds the remaining siblings in the order Verify consumes them: level by level from the leaves up, and
+// left to right within a level.
+type BatchMerkleProof struct {
+	Depth  uint64   // the number of levels below the root
+	Leaves []uint64 // sorted, without duplicates
+	Proof  []common.Hash
+	hasher Hasher // nil for Keccak256
+}
+
+// MultiProof proves the leaves are in the tree. As with ProveLeaf, the tree must hold the nodes needed, which
+// the accumulator alone doesn't. The batch is verified with the tree's hasher.
+func MultiProof(tree MerkleTree, leaves []uint64) (*BatchMerkleProof, error) {
+	if len(leaves) == 0 {
+		return nil, errors.New("no leaves to prove")
+	}
+	sorted := append([]uint64{}, leaves...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	unique := sorted[:1]
+	for _, leaf := range sorted[1:] {
+		if leaf != unique[len(unique)-1] {
+			unique = append(unique, leaf)
+		}
+	}
+	for _, leaf := range unique {
+		if err := checkLeafIndex(leaf, tree.Size(), tree.Capacity()); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := &BatchMerkleProof{
+		Depth:  arbmath.Log2ceil(tree.Capacity()) - 1,
+		Leaves: unique,
+		Proof:  []common.Hash{},
+		hasher: proofHasher(hasherOf(tree)),
+	}
+	indices := unique
+	for level := uint64(0); level < batch.Depth; level++ {
+		parents := []uint64{}
+		for i := 0; i < len(indices); i++ {
+			index := indices[i]
+			if i+1 < len(indices) && indices[i+1] == index^1 {
+				i++ // the sibling is computed from another leaf
+			} else {
+				sibling := index ^ 1
+				hash, err := subtreeHash(tree, NewLevelAndLeaf(level, (sibling+1)<<level-1))
+				if err != nil {
+					return nil, err
+				}
+				batch.Proof = append(batch.Proof, hash)
+			}
+			parents = append(parents, index>>1)
+		}
+		indices = parents
+	}
+	return batch, nil
+}
+
+// Verify checks the batch proves each of its leaves, whose hashes as they appear in the tree are given by index,
+// against the root
+func (batch *BatchMerkleProof) Verify(root common.Hash, leafHashes map[uint64]common.Hash) bool {
+	if len(batch.Leaves) == 0 || len(leafHashes) != len(batch.Leaves) || batch.Depth >= 64 {
+		return false
+	}
+	type node struct {
+		index uint64
+		hash  common.Hash
+	}
+	nodes := make([]node, len(batch.Leaves))
+	for i, leaf := range batch.Leaves {
+		hash, ok := leafHashes[leaf]
+		if !ok || (i > 0 && leaf <= batch.Leaves[i-1]) || leaf>>batch.Depth != 0 {
+			return false
+		}
+		nodes[i] = node{leaf, hash}
+	}
+
+	hasher := orKeccak256(batch.hasher)
+	siblings := batch.Proof
+	for level := uint64(0); level < batch.Depth; level++ {
+		parents := []node{}
+		for i := 0; i < len(nodes); i++ {
+			current := nodes[i]
+			var sibling common.Hash
+			if i+1 < len(nodes) && nodes[i+1].index == current.index^1 {
+				i++
+				sibling = nodes[i].hash
+			} else {
+				if len(siblings) == 0 {
+					return false
+				}
+				sibling, siblings = siblings[0], siblings[1:]
+			}
+			var parent common.Hash
+			if current.index&1 == 0 {
+				parent = hasher(current.hash, sibling)
+			} else {
+				parent = hasher(sibling, current.hash)
+			}
+			parents = append(parents, node{current.index >> 1, parent})
+		}
+		nodes = parents
+	}
+	return len(siblings) == 0 && len(nodes) == 1 && nodes[0].hash == root
+}
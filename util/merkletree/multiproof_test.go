@@ -0,0 +1,77 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMultiProof(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	leaves := leavesForTesting(100)
+	for _, leaf := range leaves {
+		accAppend(t, acc, leaf)
+	}
+	tree := NewMerkleTreeFromLeaves(leaves)
+	leafHashes := func(indices []uint64) map[uint64]common.Hash {
+		hashes := make(map[uint64]common.Hash)
+		for _, index := range indices {
+			hash, err := LeafHash(tree, index)
+			Require(t, err)
+			hashes[index] = hash
+		}
+		return hashes
+	}
+
+	adjacent := []uint64{}
+	for leaf := uint64(40); leaf < 56; leaf++ {
+		adjacent = append(adjacent, leaf)
+	}
+	batch, err := MultiProof(tree, adjacent)
+	Require(t, err)
+	if !batch.Verify(root(t, acc), leafHashes(adjacent)) {
+		Fail(t, "batch of adjacent leaves doesn't verify")
+	}
+	singles := 0
+	for _, leaf := range adjacent {
+		proof, err := ProveLeaf(tree, leaf)
+		Require(t, err)
+		singles += len(proof.Encode())
+	}
+	batched := 8 + 8*len(batch.Leaves) + 32*len(batch.Proof)
+	if batched*4 > singles {
+		Fail(t, "batch takes", batched, "bytes rather than much less than the", singles, "of separate proofs")
+	}
+
+	for _, indices := range [][]uint64{{0}, {99}, {0, 99}, {3, 1, 2, 3}, {7, 8}, {10, 20, 30, 41, 42, 43}} {
+		batch, err := MultiProof(tree, indices)
+		Require(t, err)
+		hashes := leafHashes(indices)
+		if !batch.Verify(root(t, acc), hashes) {
+			Fail(t, "batch of", indices, "doesn't verify")
+		}
+		for index := range hashes {
+			tampered := leafHashes(indices)
+			tampered[index] = common.Hash{1}
+			if batch.Verify(root(t, acc), tampered) {
+				Fail(t, "batch of", indices, "verified with a wrong hash for", index)
+			}
+		}
+		if len(batch.Proof) > 0 {
+			batch.Proof = batch.Proof[1:]
+			if batch.Verify(root(t, acc), hashes) {
+				Fail(t, "batch of", indices, "verified with a sibling missing")
+			}
+		}
+	}
+
+	if _, err := MultiProof(tree, []uint64{100}); err == nil {
+		Fail(t, "proved a leaf beyond the tree")
+	}
+	if _, err := MultiProof(tree, nil); err == nil {
+		Fail(t, "proved no leaves")
+	}
+}
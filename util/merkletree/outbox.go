@@ -0,0 +1,423 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// SendMerkleTreeStateResult is the output of ArbSys's sendMerkleTreeState, as returned by the generated bindings
+type SendMerkleTreeStateResult = struct {
+	Size     *big.Int
+	Root     [32]byte
+	Partials [][32]byte
+}
+
+// TreeFromStateAndLogs rebuilds the send tree described by an ArbSys state from the sends and node hashes in
+// SendMerkleUpdate and L2ToL1Tx logs. The state's size and root are trusted, the logs are not. Each leaf whose
+// L2ToL1Tx log is given is placed in the tree, so it can be proven, as are the nodes above the leaves given.
+// Complete subtrees whose leaves aren't all given are summarized by their logs, which must at least include the
+// partials. An error is returned if the logs are missing a node, disagree with the state's partials, or produce a
+// different root.
+func TreeFromStateAndLogs(state SendMerkleTreeStateResult, logs []types.Log) (MerkleTree, error) {
+	if state.Size == nil || !state.Size.IsUint64() {
+		return nil, errors.New("invalid send tree size")
+	}
+	size := state.Size.Uint64()
+	capacity, err := treeCapacity(size)
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := knownFromLogs(logs)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(state.Partials)) != merkleAccumulator.CalcNumPartials(size) {
+		return nil, fmt.Errorf("state has %v partials but a tree of size %v has %v", len(state.Partials), size, merkleAccumulator.CalcNumPartials(size))
+	}
+	for level, partial := range state.Partials {
+		if size&(1<<level) == 0 && partial != (common.Hash{}) {
+			return nil, fmt.Errorf("state has a partial at level %v, which a tree of size %v lacks", level, size)
+		}
+	}
+	for _, place := range partialPositions(size) {
+		hash, ok := known[place]
+		if !ok {
+			return nil, fmt.Errorf("no log for the partial at level %v leaf %v", place.Level, place.Leaf)
+		}
+		if hash != state.Partials[place.Level] {
+			return nil, fmt.Errorf("log for the partial at level %v leaf %v differs from the state's", place.Level, place.Leaf)
+		}
+	}
+
+	_, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return nil, err
+	}
+	sends := make(map[uint64]common.Hash)
+	for _, log := range logs {
+		if log.Topics[0] == withdrawTopic {
+			sends[PositionTopic(log.Topics[3]).Leaf()] = log.Topics[2]
+		}
+	}
+
+	tree := NewEmptyMerkleTree()
+	if size > 0 {
+		tree, err = treeFromLogNodes(arbmath.Log2ceil(capacity)-1, 0, size, sends, known)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tree.Hash() != state.Root {
+		return nil, fmt.Errorf("logs produce root %v rather than the state's root %v", tree.Hash(), common.Hash(state.Root))
+	}
+	return tree, nil
+}
+
+// treeFromLogNodes builds the subtree at the given level starting at leaf first, in a tree of the given size,
+// from the sends by leaf and the known nodes, preferring leaves to summaries so that as many leaves as possible
+// can be proven
+func treeFromLogNodes(level, first, size uint64, sends map[uint64]common.Hash, known map[LevelAndLeaf]common.Hash) (MerkleTree, error) {
+	width := uint64(1) << level
+	if first >= size {
+		return NewMerkleEmpty(width), nil
+	}
+	place := NewLevelAndLeaf(level, first+width-1)
+	var err error
+	if level == 0 {
+		if send, ok := sends[first]; ok {
+			return NewMerkleLeaf(send), nil
+		}
+		err = fmt.Errorf("no log for leaf %v", first)
+	} else {
+		var left, right MerkleTree
+		left, err = treeFromLogNodes(level-1, first, size, sends, known)
+		if err == nil {
+			right, err = treeFromLogNodes(level-1, first+width/2, size, sends, known)
+		}
+		if err == nil {
+			return NewMerkleInternal(left, right), nil
+		}
+	}
+	// a complete subtree can stand in for the leaves missing below it, but the frontier can't
+	if hash, ok := known[place]; ok && first+width <= size {
+		return NewSummaryMerkleTree(hash, width), nil
+	}
+	return nil, err
+}
+
+// partialPositions finds where the partials of a tree with the given size live, from the highest level down.
+// The partials map to the binary representation of the size, and the leaf for a given partial is the sum of the
+// powers of 2 preceding it. It's 1 less since we count from 0.
+func partialPositions(size uint64) []LevelAndLeaf {
+	positions := []LevelAndLeaf{}
+	total := uint64(0)
+	for level := arbmath.Log2ceil(size); level > 0; level-- {
+		power := uint64(1) << (level - 1)
+		if size&power != 0 {
+			total += power
+			positions = append(positions, NewLevelAndLeaf(level-1, total-1))
+		}
+	}
+	return positions
+}
+
+// FrontierPositions returns, in order, the positions visited when walking the frontier of an unbalanced tree
+// to recover the nodes its partials imply. The walk starts at the zero-hash sibling of the lowest partial, and at
+// each level visits the node it's joined with (a partial on the left or an empty subtree on the right) and then
+// their parent. The last position is the root's. Balanced trees need no walk, so nil is returned for them.
+func FrontierPositions(treeSize uint64) []LevelAndLeaf {
+	if treeSize == 0 || arbmath.IsPowerOf2(treeSize) {
+		return nil
+	}
+	treeLevels := arbmath.Log2ceil(treeSize)
+
+	step := NewLevelAndLeaf(uint64(bits.TrailingZeros64(treeSize)), treeSize-1) // the lowest partial
+	step.Leaf += 1 << step.Level                                                // its zero-hash sibling
+	positions := []LevelAndLeaf{step}
+
+	for step.Level < treeLevels {
+		if treeSize&(1<<step.Level) != 0 {
+			// a partial on the frontier can only appear on the left
+			step.Leaf -= 1 << step.Level
+		} else {
+			// getting to the next partial means covering its mirror subtree, so go right
+			step.Leaf += 1 << step.Level
+		}
+		positions = append(positions, step)
+
+		// move to the parent
+		step.Level += 1
+		step.Leaf |= 1 << (step.Level - 1)
+		positions = append(positions, step)
+	}
+	return positions
+}
+
+// ToTopicHashes encodes positions as they appear in the position topic of ArbSys logs, for filtering by them
+func ToTopicHashes(positions []LevelAndLeaf) []common.Hash {
+	hashes := make([]common.Hash, len(positions))
+	for i, place := range positions {
+		hashes[i] = place.ToHash()
+	}
+	return hashes
+}
+
+// LogFilterer is the part of a client needed to fetch ArbSys's logs
+type LogFilterer interface {
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// FetchProofLogs fetches, in one query, the SendMerkleUpdate and L2ToL1Tx logs ArbSys emitted at the positions,
+// such as those from ProofQueryPositions. Logs the client returns that don't match the query are dropped, so
+// only logs at the positions are returned. The query is cancelled with the context.
+func FetchProofLogs(
+	ctx context.Context, client LogFilterer, positions []LevelAndLeaf,
+) ([]types.Log, error) {
+	query, err := proofLogsQuery(positions)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	logs, err := client.FilterLogs(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get logs: %w", err)
+	}
+	wanted := make(map[common.Hash]bool)
+	for _, topic := range query.Topics[3] {
+		wanted[topic] = true
+	}
+	merkleTopic, withdrawTopic := query.Topics[0][0], query.Topics[0][1]
+	matching := []types.Log{}
+	for _, log := range logs {
+		if log.Address != types.ArbSysAddress || len(log.Topics) < 4 {
+			continue
+		}
+		if (log.Topics[0] == merkleTopic || log.Topics[0] == withdrawTopic) && wanted[log.Topics[3]] {
+			matching = append(matching, log)
+		}
+	}
+	return matching, nil
+}
+
+// proofLogsQuery filters for ArbSys's SendMerkleUpdate and L2ToL1Tx logs at the positions
+func proofLogsQuery(positions []LevelAndLeaf) (ethereum.FilterQuery, error) {
+	merkleTopic, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return ethereum.FilterQuery{}, err
+	}
+	return ethereum.FilterQuery{
+		Addresses: []common.Address{types.ArbSysAddress},
+		Topics:    [][]common.Hash{{merkleTopic, withdrawTopic}, nil, nil, ToTopicHashes(positions)},
+	}, nil
+}
+
+// BuildFromLogFilterer fetches the SendMerkleUpdate and L2ToL1Tx logs needed to prove the leaf against the root
+// of the tree of the given size, then builds the proof. The logs are only returned if the builder was made
+// WithReturnLogs.
+func (b *ProofBuilder) BuildFromLogFilterer(
+	ctx context.Context, client LogFilterer, leaf, treeSize uint64, root common.Hash,
+) (*MerkleProof, []types.Log, error) {
+	if err := checkLeafInTree(leaf, treeSize); err != nil {
+		return nil, nil, err
+	}
+	queries := proofQueries(leaf, treeSize)
+	positions := make([]LevelAndLeaf, len(queries))
+	for i, q := range queries {
+		positions[i] = q.place
+	}
+	query, err := proofLogsQuery(positions)
+	if err != nil {
+		return nil, nil, err
+	}
+	logs, err := b.filterLogs(ctx, client, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get logs: %w", err)
+	}
+	known, err := knownFromLogs(logs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkQueriesAnswered(queries, known); err != nil {
+		return nil, nil, err
+	}
+	proof, err := b.BuildForRoot(leaf, treeSize, root, known)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !b.returnLogs {
+		logs = nil
+	}
+	return proof, logs, nil
+}
+
+// filterLogs runs the query, retrying transient failures as configured by WithRetry
+func (b *ProofBuilder) filterLogs(ctx context.Context, client LogFilterer, query ethereum.FilterQuery) ([]types.Log, error) {
+	backoff := b.retryBackoff
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logs, err := client.FilterLogs(ctx, query)
+		if err == nil {
+			return logs, nil
+		}
+		if attempt >= b.retryAttempts || !isTransient(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Codes of RPC errors that retrying may resolve: geth's for a request that timed out, and the one providers
+// reply with when rate limiting
+const (
+	rpcErrorCodeTimeout       = -32002
+	rpcErrorCodeLimitExceeded = -32005
+)
+
+// isTransient returns whether fetching logs may succeed if retried after failing with the error. Errors the RPC
+// server replied with are only transient if it was rate limiting or timing out, whether it said so with an RPC
+// error code or an HTTP status. Others, such as -32600 and -32602 for malformed requests, would be replied with
+// again. Errors without a reply, as when the connection drops, are taken to be transient.
+func isTransient(err error) bool {
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		code := rpcErr.ErrorCode()
+		return code == rpcErrorCodeTimeout || code == rpcErrorCodeLimitExceeded
+	}
+	return true
+}
+
+// BuildProofFromLogsJSON proves the leaf against the root of the tree of the given size from a JSON array of
+// logs, such as those a builder made WithReturnLogs returned, checking the proof is correct
+func BuildProofFromLogsJSON(data []byte, leaf, treeSize uint64, root common.Hash) (*MerkleProof, error) {
+	var logs []types.Log
+	if err := json.Unmarshal(data, &logs); err != nil {
+		return nil, err
+	}
+	return ProofFromLogs(logs, leaf, root, treeSize)
+}
+
+// ProofFromLogs proves the leaf against the root of the tree of the given size from SendMerkleUpdate and
+// L2ToL1Tx logs already fetched from geth, walking the frontier when the tree isn't balanced. The logs must
+// include the leaf, its siblings that are complete subtrees, and the tree's partials; an error names the first
+// node missing. The proof is checked before being returned.
+func ProofFromLogs(logs []types.Log, leaf uint64, rootHash common.Hash, treeSize uint64) (*MerkleProof, error) {
+	if err := checkLeafInTree(leaf, treeSize); err != nil {
+		return nil, err
+	}
+	known, err := knownFromLogs(logs)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQueriesAnswered(proofQueries(leaf, treeSize), known); err != nil {
+		return nil, err
+	}
+	return NewProofBuilder(WithSelfVerify()).BuildForRoot(leaf, treeSize, rootHash, known)
+}
+
+// arbSysLogTopics returns the IDs of the SendMerkleUpdate and L2ToL1Tx events
+func arbSysLogTopics() (common.Hash, common.Hash, error) {
+	return merkleAccumulator.ArbSysEventIDs()
+}
+
+// ErrUnexpectedLog is returned when decoding a log that isn't one of ArbSys's SendMerkleUpdate or L2ToL1Tx logs
+var ErrUnexpectedLog = errors.New("log isn't an ArbSys SendMerkleUpdate or L2ToL1Tx log")
+
+// knownFromLogs maps the positions of the nodes in the logs to their hashes, erroring with ErrUnexpectedLog if
+// any of the logs isn't one of ArbSys's node logs
+func knownFromLogs(logs []types.Log) (map[LevelAndLeaf]common.Hash, error) {
+	merkleTopic, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[LevelAndLeaf]common.Hash)
+	for i := range logs {
+		place, hash, err := decodeNodeLog(&logs[i], merkleTopic, withdrawTopic)
+		if err != nil {
+			return nil, err
+		}
+		known[place] = hash
+	}
+	return known, nil
+}
+
+// NodeEventFromLog decodes an ArbSys SendMerkleUpdate or L2ToL1Tx log into the event of the node it emits,
+// with the hash the node has in the tree, so an L2ToL1Tx log's send hash is hashed into its leaf. The events
+// can be applied with ApplyEvent, and placed in a map of known nodes by EventPosition. Other logs are rejected
+// with ErrUnexpectedLog.
+func NodeEventFromLog(log *types.Log) (merkleAccumulator.MerkleTreeNodeEvent, error) {
+	place, hash, err := nodeFromLog(log)
+	if err != nil {
+		return merkleAccumulator.MerkleTreeNodeEvent{}, err
+	}
+	return merkleAccumulator.MerkleTreeNodeEvent{Level: place.Level, NumLeaves: place.Leaf, Hash: hash}, nil
+}
+
+// nodeFromLog decodes the position and node hash of an ArbSys SendMerkleUpdate or L2ToL1Tx log.
+// Leaves are hashed before being included in the tree, so level 0 hashes are hashed here too.
+func nodeFromLog(log *types.Log) (LevelAndLeaf, common.Hash, error) {
+	merkleTopic, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return LevelAndLeaf{}, common.Hash{}, err
+	}
+	return decodeNodeLog(log, merkleTopic, withdrawTopic)
+}
+
+// decodeNodeLog is nodeFromLog given the IDs of the SendMerkleUpdate and L2ToL1Tx events. Only L2ToL1Tx logs
+// are of leaves.
+func decodeNodeLog(log *types.Log, merkleTopic, withdrawTopic common.Hash) (LevelAndLeaf, common.Hash, error) {
+	if log.Address != types.ArbSysAddress {
+		return LevelAndLeaf{}, common.Hash{}, fmt.Errorf("%w: emitted by %v", ErrUnexpectedLog, log.Address)
+	}
+	if len(log.Topics) < 4 {
+		return LevelAndLeaf{}, common.Hash{}, errors.New("log is missing the hash and position topics")
+	}
+	if log.Topics[0] != merkleTopic && log.Topics[0] != withdrawTopic {
+		return LevelAndLeaf{}, common.Hash{}, fmt.Errorf("%w: event %v", ErrUnexpectedLog, log.Topics[0])
+	}
+	hash := log.Topics[2]
+	place := PositionTopic(log.Topics[3]).LevelAndLeaf()
+	if (log.Topics[0] == withdrawTopic) != (place.Level == 0) {
+		return LevelAndLeaf{}, common.Hash{}, fmt.Errorf("%w: event %v at level %v", ErrUnexpectedLog, log.Topics[0], place.Level)
+	}
+
+	if place.Level == 0 {
+		hash = crypto.Keccak256Hash(hash.Bytes())
+	}
+	return place, hash, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/offchainlabs/nitro/arbos/util"
+)
+
+// OutboxExecuteArgs holds the parameters of the outbox's executeTransaction, in the order the generated
+// binding takes them
+type OutboxExecuteArgs struct {
+	Proof       [][32]byte
+	Index       *big.Int
+	L2Sender    common.Address
+	To          common.Address
+	L2Block     *big.Int
+	L1Block     *big.Int
+	L2Timestamp *big.Int
+	Value       *big.Int
+	Data        []byte
+}
+
+// Withdrawal returns the withdrawal the args execute
+func (args *OutboxExecuteArgs) Withdrawal() Withdrawal {
+	return Withdrawal{
+		Caller:      args.L2Sender,
+		Destination: args.To,
+		ArbBlockNum: args.L2Block,
+		EthBlockNum: args.L1Block,
+		Timestamp:   args.L2Timestamp,
+		CallValue:   args.Value,
+		Data:        args.Data,
+	}
+}
+
+// OutboxArgsClient is the part of an L2 client needed to read ArbSys's state and logs
+type OutboxArgsClient interface {
+	bind.ContractCaller
+	LogFilterer
+}
+
+// BuildOutboxExecuteArgs gathers everything needed to execute the withdrawal at the leaf on L1: its L2ToL1Tx
+// log, and a proof against the latest send root. The outbox only accepts proofs against roots confirmed on L1,
+// so the args can only be used once an assertion including that root is.
+func BuildOutboxExecuteArgs(ctx context.Context, client OutboxArgsClient, leaf uint64) (OutboxExecuteArgs, error) {
+	root, size, err := SendRoot(ctx, client, types.ArbSysAddress, nil)
+	if err != nil {
+		return OutboxExecuteArgs{}, err
+	}
+	if leaf >= size {
+		return OutboxExecuteArgs{}, fmt.Errorf("leaf %v isn't in the send tree of size %v", leaf, size)
+	}
+
+	_, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return OutboxExecuteArgs{}, err
+	}
+	logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+		Addresses: []common.Address{types.ArbSysAddress},
+		Topics:    [][]common.Hash{{withdrawTopic}, nil, nil, {common.BigToHash(new(big.Int).SetUint64(leaf))}},
+	})
+	if err != nil {
+		return OutboxExecuteArgs{}, fmt.Errorf("failed to get the L2ToL1Tx log: %w", err)
+	}
+	if len(logs) != 1 {
+		return OutboxExecuteArgs{}, fmt.Errorf("found %v L2ToL1Tx logs for leaf %v", len(logs), leaf)
+	}
+	event, err := util.ParseL2ToL1TxLog(&logs[0])
+	if err != nil {
+		return OutboxExecuteArgs{}, err
+	}
+
+	proof, _, err := NewProofBuilder(WithSelfVerify()).BuildFromLogFilterer(ctx, client, leaf, size, root)
+	if err != nil {
+		return OutboxExecuteArgs{}, err
+	}
+	index, err := proof.IndexForContract()
+	if err != nil {
+		return OutboxExecuteArgs{}, err
+	}
+	args := OutboxExecuteArgs{
+		Proof:       make([][32]byte, len(proof.Proof)),
+		Index:       index,
+		L2Sender:    event.Caller,
+		To:          event.Destination,
+		L2Block:     event.ArbBlockNum,
+		L1Block:     event.EthBlockNum,
+		L2Timestamp: event.Timestamp,
+		Value:       event.Callvalue,
+		Data:        event.Data,
+	}
+	for i, sibling := range proof.Proof {
+		args.Proof[i] = sibling
+	}
+	if sendHash := ComputeSendHash(args.Withdrawal()); sendHash != common.BigToHash(event.Hash) {
+		return OutboxExecuteArgs{}, fmt.Errorf("log's send hash %v doesn't match its withdrawal's %v", common.BigToHash(event.Hash), sendHash)
+	}
+	return args, nil
+}
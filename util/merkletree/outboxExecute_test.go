@@ -0,0 +1,119 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+// withdrawalLogsForTesting sends the withdrawals, producing the logs ArbSys would emit along the way
+func withdrawalLogsForTesting(t *testing.T, withdrawals []Withdrawal) []types.Log {
+	t.Helper()
+	arbSys, err := precompilesgen.ArbSysMetaData.GetAbi()
+	Require(t, err)
+	acc := initializedMerkleAccumulatorForTesting()
+	logs := []types.Log{}
+	for i, w := range withdrawals {
+		sendHash := ComputeSendHash(w)
+		events, err := acc.Append(sendHash)
+		Require(t, err)
+		for _, event := range events {
+			position := NewLevelAndLeaf(event.Level, event.NumLeaves)
+			logs = append(logs, types.Log{
+				Address: types.ArbSysAddress,
+				Topics:  []common.Hash{merkleTopicForTesting, {}, event.Hash, position.ToHash()},
+			})
+		}
+		data, err := arbSys.Events["L2ToL1Tx"].Inputs.NonIndexed().Pack(
+			w.Caller, w.ArbBlockNum, w.EthBlockNum, w.Timestamp, w.CallValue, w.Data,
+		)
+		Require(t, err)
+		logs = append(logs, types.Log{
+			Address: types.ArbSysAddress,
+			Topics: []common.Hash{
+				withdrawTopicForTesting,
+				common.BytesToHash(w.Destination.Bytes()),
+				sendHash,
+				common.BigToHash(big.NewInt(int64(i))),
+			},
+			Data: data,
+		})
+	}
+	return logs
+}
+
+// l2ClientForTesting serves ArbSys's state and logs
+type l2ClientForTesting struct {
+	*arbSysSimulator
+	*logFiltererForTesting
+}
+
+// executeTransactionForTesting checks its arguments the way the outbox's executeTransaction does
+func executeTransactionForTesting(
+	root common.Hash, proof [][32]byte, index *big.Int, l2Sender, to common.Address,
+	l2Block, l1Block, l2Timestamp, value *big.Int, data []byte,
+) error {
+	sendHash := ComputeSendHash(Withdrawal{l2Sender, to, l2Block, l1Block, l2Timestamp, value, data})
+	merkleProof := &MerkleProof{
+		RootHash:  root,
+		LeafHash:  crypto.Keccak256Hash(sendHash.Bytes()),
+		LeafIndex: index.Uint64(),
+		Proof:     make([]common.Hash, len(proof)),
+	}
+	for i, sibling := range proof {
+		merkleProof.Proof[i] = sibling
+	}
+	if !index.IsUint64() || !merkleProof.IsCorrect() {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+func TestBuildOutboxExecuteArgs(t *testing.T) {
+	ctx := context.Background()
+	const sends = 11
+	withdrawals := make([]Withdrawal, sends)
+	for i := range withdrawals {
+		withdrawals[i] = withdrawalForTesting(uint64(i))
+	}
+	acc := initializedMerkleAccumulatorForTesting()
+	for _, w := range withdrawals {
+		accAppend(t, acc, ComputeSendHash(w))
+	}
+	simulator := &arbSysSimulator{t: t}
+	simulator.setState(0, sendTreeStateForTesting(t, acc))
+	client := l2ClientForTesting{simulator, &logFiltererForTesting{logs: withdrawalLogsForTesting(t, withdrawals)}}
+
+	for leaf := uint64(0); leaf < sends; leaf++ {
+		args, err := BuildOutboxExecuteArgs(ctx, client, leaf)
+		Require(t, err, "leaf", leaf)
+		Require(t, executeTransactionForTesting(
+			root(t, acc), args.Proof, args.Index, args.L2Sender, args.To,
+			args.L2Block, args.L1Block, args.L2Timestamp, args.Value, args.Data,
+		), "leaf", leaf)
+		if ComputeSendHash(args.Withdrawal()) != ComputeSendHash(withdrawals[leaf]) {
+			Fail(t, "args are for a different withdrawal than leaf", leaf)
+		}
+
+		args.Value = new(big.Int).Add(args.Value, big.NewInt(1))
+		err = executeTransactionForTesting(
+			root(t, acc), args.Proof, args.Index, args.L2Sender, args.To,
+			args.L2Block, args.L1Block, args.L2Timestamp, args.Value, args.Data,
+		)
+		if !errors.Is(err, ErrInvalidProof) {
+			Fail(t, "outbox accepted a changed value for leaf", leaf)
+		}
+	}
+	if _, err := BuildOutboxExecuteArgs(ctx, client, sends); err == nil {
+		Fail(t, "built args for a leaf beyond the send tree")
+	}
+}
@@ -0,0 +1,637 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+var merkleTopicForTesting, withdrawTopicForTesting = func() (common.Hash, common.Hash) {
+	merkleTopic, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		panic(err)
+	}
+	return merkleTopic, withdrawTopic
+}()
+
+// sendTreeForTesting appends size leaves to an accumulator, producing the logs ArbSys would emit along the way
+func sendTreeForTesting(t *testing.T, size uint64) (*merkleAccumulator.MerkleAccumulator, []types.Log) {
+	t.Helper()
+	acc := initializedMerkleAccumulatorForTesting()
+	logs := []types.Log{}
+	for i := uint64(0); i < size; i++ {
+		sendHash := pseudorandomForTesting(i)
+		events, err := acc.Append(sendHash)
+		Require(t, err)
+		for _, event := range events {
+			logs = append(logs, types.Log{
+				Address: types.ArbSysAddress,
+				Topics:  []common.Hash{merkleTopicForTesting, {}, event.Hash, EventPosition(event).ToHash()},
+			})
+		}
+		logs = append(logs, types.Log{
+			Address: types.ArbSysAddress,
+			Topics:  []common.Hash{withdrawTopicForTesting, {}, sendHash, common.BigToHash(new(big.Int).SetUint64(i))},
+		})
+	}
+	return acc, logs
+}
+
+func sendTreeStateForTesting(t *testing.T, acc *merkleAccumulator.MerkleAccumulator) SendMerkleTreeStateResult {
+	t.Helper()
+	size, root, partials, err := acc.StateForExport()
+	Require(t, err)
+	state := SendMerkleTreeStateResult{
+		Size:     new(big.Int).SetUint64(size),
+		Root:     root,
+		Partials: make([][32]byte, len(partials)),
+	}
+	for i, partial := range partials {
+		state.Partials[i] = partial
+	}
+	return state
+}
+
+func TestTreeFromStateAndLogs(t *testing.T) {
+	for size := uint64(0); size <= 17; size++ {
+		acc, logs := sendTreeForTesting(t, size)
+		state := sendTreeStateForTesting(t, acc)
+
+		tree, err := TreeFromStateAndLogs(state, logs)
+		Require(t, err, size)
+		if tree.Hash() != root(t, acc) {
+			Fail(t, "wrong root for size", size)
+		}
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := ProveLeaf(tree, leaf)
+			Require(t, err, size, leaf)
+			if proof.RootHash != root(t, acc) || !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of size", size)
+			}
+		}
+
+		// disagree with the logs about a partial
+		if size > 0 {
+			wrong := sendTreeStateForTesting(t, acc)
+			wrong.Partials[partialPositions(size)[0].Level] = pseudorandomForTesting(1001)
+			if _, err := TreeFromStateAndLogs(wrong, logs); err == nil {
+				Fail(t, "accepted a partial the logs disagree with for size", size)
+			}
+		}
+
+		// drop the logs for the partials
+		partials := make(map[common.Hash]bool)
+		for _, place := range partialPositions(size) {
+			partials[place.ToHash()] = true
+		}
+		insufficient := []types.Log{}
+		for _, log := range logs {
+			if !partials[log.Topics[3]] {
+				insufficient = append(insufficient, log)
+			}
+		}
+		if len(partials) > 0 {
+			if _, err := TreeFromStateAndLogs(state, insufficient); err == nil {
+				Fail(t, "built a tree without the partials for size", size)
+			}
+		}
+
+		// claim a different root
+		if size > 0 {
+			state.Root = pseudorandomForTesting(1000)
+			if _, err := TreeFromStateAndLogs(state, logs); err == nil {
+				Fail(t, "accepted the wrong root for size", size)
+			}
+		}
+	}
+}
+
+func TestTreeFromAccumulatorMatchesRoot(t *testing.T) {
+	for size := uint64(0); size <= 17; size++ {
+		acc, _ := sendTreeForTesting(t, size)
+		tree, err := NewMerkleTreeFromAccumulator(acc)
+		Require(t, err)
+		if tree.Hash() != root(t, acc) {
+			Fail(t, "tree and accumulator disagree for size", size)
+		}
+	}
+}
+
+func TestFrontierPositions(t *testing.T) {
+	for _, treeSize := range []uint64{3, 5, 7, 11} {
+		acc, logs := sendTreeForTesting(t, treeSize)
+		known := make(map[LevelAndLeaf]common.Hash)
+		for i := range logs {
+			place, hash, err := nodeFromLog(&logs[i])
+			Require(t, err)
+			known[place] = hash
+		}
+		partialsByLevel := make(map[uint64]bool)
+		for _, place := range partialPositions(treeSize) {
+			partialsByLevel[place.Level] = true
+		}
+		minPartial := partialPositions(treeSize)[len(partialsByLevel)-1]
+		treeLevels := arbmath.Log2ceil(treeSize)
+
+		// walk the frontier the way the outbox proof construction does, recording each position visited
+		visited := []LevelAndLeaf{}
+		step := minPartial
+		step.Leaf += 1 << step.Level
+		known[step] = common.Hash{}
+		visited = append(visited, step)
+		for step.Level < treeLevels {
+			left := known[step]
+			right := known[step]
+			if partialsByLevel[step.Level] {
+				step.Leaf -= 1 << step.Level
+				left = known[step]
+			} else {
+				step.Leaf += 1 << step.Level
+				known[step] = common.Hash{}
+				right = common.Hash{}
+			}
+			visited = append(visited, step)
+			step.Level += 1
+			step.Leaf |= 1 << (step.Level - 1)
+			known[step] = crypto.Keccak256Hash(left.Bytes(), right.Bytes())
+			visited = append(visited, step)
+		}
+		if known[step] != root(t, acc) {
+			Fail(t, "reference walk didn't recreate the root for size", treeSize)
+		}
+
+		positions := FrontierPositions(treeSize)
+		if len(positions) != len(visited) {
+			Fail(t, "wrong number of positions for size", treeSize, positions, visited)
+		}
+		for i := range positions {
+			if positions[i] != visited[i] {
+				Fail(t, "position", i, "differs for size", treeSize, positions[i], visited[i])
+			}
+		}
+	}
+
+	for _, balanced := range []uint64{0, 1, 2, 4, 8} {
+		if FrontierPositions(balanced) != nil {
+			Fail(t, "balanced trees need no frontier walk", balanced)
+		}
+	}
+}
+
+func TestNodeEventFromLog(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 13; i++ {
+		events, err := acc.Append(pseudorandomForTesting(i))
+		Require(t, err)
+		// the leaf's event isn't made by Append, but its log is decoded to the leaf as it is in the tree
+		leaf := merkleAccumulator.MerkleTreeNodeEvent{Level: 0, NumLeaves: i, Hash: crypto.Keccak256Hash(pseudorandomForTesting(i).Bytes())}
+		for _, event := range append([]merkleAccumulator.MerkleTreeNodeEvent{leaf}, events...) {
+			topic := merkleTopicForTesting
+			hash := event.Hash
+			if event.Level == 0 {
+				topic, hash = withdrawTopicForTesting, pseudorandomForTesting(i)
+			}
+			log := types.Log{
+				Address: types.ArbSysAddress,
+				Topics:  []common.Hash{topic, {}, hash, EventPosition(event).ToHash()},
+			}
+			decoded, err := NodeEventFromLog(&log)
+			Require(t, err)
+			if decoded != event {
+				Fail(t, "decoded", decoded, "rather than", event)
+			}
+			if EventPosition(decoded) != PositionTopic(log.Topics[3]).LevelAndLeaf() {
+				Fail(t, "the event's position differs from its topic's", decoded)
+			}
+		}
+	}
+
+	_, logs := sendTreeForTesting(t, 13)
+	for i := range logs {
+		event, err := NodeEventFromLog(&logs[i])
+		Require(t, err)
+		place, hash, err := nodeFromLog(&logs[i])
+		Require(t, err)
+		if EventPosition(event) != place || event.Hash != hash {
+			Fail(t, "event", event, "differs from the node", place, hash)
+		}
+	}
+	if _, err := NodeEventFromLog(&types.Log{Topics: logs[0].Topics[:3]}); err == nil {
+		Fail(t, "decoded a log without a position")
+	}
+}
+
+func TestPositionTopic(t *testing.T) {
+	places := []LevelAndLeaf{
+		NewLevelAndLeaf(0, 0),
+		NewLevelAndLeaf(0, 1),
+		NewLevelAndLeaf(3, 7),
+		NewLevelAndLeaf(5, 1<<40+31),
+		NewLevelAndLeaf(63, 1<<63-1),
+		NewLevelAndLeaf(1<<63, 1<<63),
+		NewLevelAndLeaf(^uint64(0), ^uint64(0)),
+	}
+	for _, place := range places {
+		hash := place.ToHash()
+		if LevelAndLeafFromHash(hash) != place || common.BigToHash(place.ToBigInt()) != hash {
+			Fail(t, "position", place, "doesn't round trip through", hash)
+		}
+		topic := PositionTopic(hash)
+		if topic.Level() != place.Level || topic.Leaf() != place.Leaf || topic.LevelAndLeaf() != place {
+			Fail(t, "decoded", topic.Level(), topic.Leaf(), "rather than", place)
+		}
+	}
+
+	// matches the encoding ArbSys has always used for positions that fit in an int64
+	place := NewLevelAndLeaf(3, 7)
+	legacy := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(3), 192), big.NewInt(7))
+	if place.ToBigInt().Cmp(legacy) != 0 {
+		Fail(t, "encoded", place, "as", place.ToBigInt(), "rather than", legacy)
+	}
+}
+
+// logFiltererForTesting answers queries for logs the way geth would, remembering the last query
+type logFiltererForTesting struct {
+	logs      []types.Log
+	lastQuery ethereum.FilterQuery
+}
+
+func (f *logFiltererForTesting) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	f.lastQuery = query
+	matches := func(options []common.Hash, topic common.Hash) bool {
+		if len(options) == 0 {
+			return true
+		}
+		for _, option := range options {
+			if option == topic {
+				return true
+			}
+		}
+		return false
+	}
+	found := []types.Log{}
+	for _, log := range f.logs {
+		ok := len(query.Addresses) == 0
+		for _, address := range query.Addresses {
+			ok = ok || address == log.Address
+		}
+		ok = ok && len(log.Topics) >= len(query.Topics)
+		for i := 0; ok && i < len(query.Topics); i++ {
+			ok = matches(query.Topics[i], log.Topics[i])
+		}
+		if ok {
+			found = append(found, log)
+		}
+	}
+	return found, nil
+}
+
+func TestBuildFromLogFilterer(t *testing.T) {
+	ctx := context.Background()
+	_, logs := sendTreeForTesting(t, 21)
+	client := &logFiltererForTesting{logs: logs}
+	builder := NewProofBuilder(WithReturnLogs())
+	for _, treeSize := range []uint64{1, 4, 7, 21} {
+		acc, _ := sendTreeForTesting(t, treeSize)
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, fetched, err := builder.BuildFromLogFilterer(ctx, client, leaf, treeSize, root(t, acc))
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			if !proof.IsCorrect() || proof.RootHash != root(t, acc) {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+			if len(fetched) == 0 || len(fetched) >= len(logs) {
+				Fail(t, "expected only some of the logs to be fetched, got", len(fetched))
+			}
+
+			// the returned logs suffice to rebuild the proof offline
+			data, err := json.Marshal(fetched)
+			Require(t, err)
+			rebuilt, err := BuildProofFromLogsJSON(data, leaf, treeSize, root(t, acc))
+			Require(t, err)
+			if !reflect.DeepEqual(rebuilt, proof) {
+				Fail(t, "rebuilt proof differs for leaf", leaf, "of", treeSize)
+			}
+		}
+	}
+
+	acc, _ := sendTreeForTesting(t, 21)
+	_, fetched, err := NewProofBuilder().BuildFromLogFilterer(ctx, client, 3, 21, root(t, acc))
+	Require(t, err)
+	if fetched != nil {
+		Fail(t, "returned logs without being asked to")
+	}
+}
+
+func TestProofFromLogs(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 13)
+	for _, treeSize := range []uint64{1, 8, 3, 5, 7, 11, 13} {
+		acc, _ := sendTreeForTesting(t, treeSize)
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := ProofFromLogs(logs, leaf, root(t, acc), treeSize)
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			if !proof.IsCorrect() || proof.RootHash != root(t, acc) {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+			if proof.LeafHash != crypto.Keccak256Hash(pseudorandomForTesting(leaf).Bytes()) {
+				Fail(t, "wrong leaf hash for leaf", leaf, "of", treeSize)
+			}
+		}
+	}
+
+	// without the partial at level 2, the frontier of a tree of 5 can't be walked
+	acc, _ := sendTreeForTesting(t, 5)
+	partial := NewLevelAndLeaf(2, 3).ToHash()
+	missing := []types.Log{}
+	for _, log := range logs {
+		if log.Topics[3] != partial {
+			missing = append(missing, log)
+		}
+	}
+	_, err := ProofFromLogs(missing, 4, root(t, acc), 5)
+	if err == nil || !strings.Contains(err.Error(), "at level 2 leaf 3") {
+		Fail(t, "wrong error for a missing partial", err)
+	}
+
+	if _, err := ProofFromLogs(logs, 5, root(t, acc), 5); !errors.Is(err, ErrEmptyLeafPosition) {
+		Fail(t, "wrong error for a leaf beyond the tree", err)
+	}
+	if _, err := ProofFromLogs(logs, 0, common.Hash{}, 0); !errors.Is(err, ErrEmptyLeafPosition) {
+		Fail(t, "wrong error for an empty tree", err)
+	}
+	if _, err := ProofFromLogs(logs, 4, common.Hash{}, 5); !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "wrong error for the wrong root", err)
+	}
+
+	// logs that aren't ArbSys's node logs are rejected rather than taken as nodes
+	foreign := logs[0]
+	foreign.Address = common.Address{1}
+	other := logs[0]
+	other.Topics = append([]common.Hash{{1}}, logs[0].Topics[1:]...)
+	misplaced := logs[0]
+	misplaced.Topics = append([]common.Hash{merkleTopicForTesting}, logs[0].Topics[1:]...)
+	for _, bad := range []types.Log{foreign, other, misplaced} {
+		if _, err := ProofFromLogs(append([]types.Log{bad}, logs...), 4, root(t, acc), 5); !errors.Is(err, ErrUnexpectedLog) {
+			Fail(t, "wrong error for an unexpected log", bad.Address, bad.Topics[0], err)
+		}
+		if _, err := NodeEventFromLog(&bad); !errors.Is(err, ErrUnexpectedLog) {
+			Fail(t, "decoded an unexpected log", bad.Address, bad.Topics[0], err)
+		}
+	}
+}
+
+// cannedFiltererForTesting returns the same logs whatever the query, or blocks until the context is done
+type cannedFiltererForTesting struct {
+	logs  []types.Log
+	block bool
+}
+
+func (f *cannedFiltererForTesting) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	if f.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return f.logs, nil
+}
+
+func TestProofFromLogsCorruptPartial(t *testing.T) {
+	acc, logs := sendTreeForTesting(t, 13)
+	expected := root(t, acc)
+
+	// corrupt the partial covering leaves 8 to 11, which the frontier walk to the root starts from
+	partial := NewLevelAndLeaf(2, 11).ToHash()
+	corrupted := make([]types.Log, len(logs))
+	for i, log := range logs {
+		if log.Topics[3] == partial {
+			log.Topics = append([]common.Hash{}, log.Topics...)
+			log.Topics[2] = pseudorandomForTesting(1000)
+		}
+		corrupted[i] = log
+	}
+
+	// the last leaf's siblings are partials, so its path agrees with the corrupted frontier on the wrong root
+	_, err := ProofFromLogs(corrupted, 12, expected, 13)
+	var mismatch *FrontierRootMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrFrontierRootMismatch) || !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "wrong error for a corrupted partial", err)
+	}
+	frontier := FrontierPositions(13)
+	if mismatch.Position != frontier[len(frontier)-1] || mismatch.Expected != expected || mismatch.Computed == expected {
+		Fail(t, "wrong details of the mismatch", mismatch)
+	}
+	// the walk is checked even without self-verifying, as it costs no more hashing
+	_, err = NewProofBuilder().BuildForRoot(12, 13, expected, knownFromLogsForTesting(t, corrupted))
+	if !errors.As(err, &mismatch) {
+		Fail(t, "built a proof from a corrupted partial without self-verifying", err)
+	}
+}
+
+func TestFetchProofLogs(t *testing.T) {
+	acc, logs := sendTreeForTesting(t, 13)
+	foreign := logs[0]
+	foreign.Address = common.Address{1}
+	client := &cannedFiltererForTesting{logs: append([]types.Log{foreign}, logs...)}
+
+	for _, leaf := range []uint64{0, 6, 12} {
+		positions := ProofQueryPositions(leaf, 13)
+		fetched, err := FetchProofLogs(context.Background(), client, positions)
+		Require(t, err)
+		found := make(map[LevelAndLeaf]bool)
+		for _, log := range fetched {
+			found[PositionTopic(log.Topics[3]).LevelAndLeaf()] = true
+		}
+		expected := make(map[LevelAndLeaf]bool)
+		for _, place := range positions {
+			expected[place] = true
+		}
+		if !reflect.DeepEqual(found, expected) {
+			Fail(t, "fetched logs at", found, "rather than", expected)
+		}
+		proof, err := ProofFromLogs(fetched, leaf, root(t, acc), 13)
+		Require(t, err)
+		if !proof.IsCorrect() {
+			Fail(t, "bad proof from the fetched logs for leaf", leaf)
+		}
+	}
+
+	query := &logFiltererForTesting{}
+	_, err := FetchProofLogs(context.Background(), query, ProofQueryPositions(4, 5))
+	Require(t, err)
+	if len(query.lastQuery.Topics) != 4 || len(query.lastQuery.Topics[0]) != 2 || len(query.lastQuery.Topics[3]) != 2 {
+		Fail(t, "wrong topics", query.lastQuery.Topics)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	blocked := &cannedFiltererForTesting{block: true}
+	if _, err := FetchProofLogs(ctx, blocked, ProofQueryPositions(0, 13)); !errors.Is(err, context.DeadlineExceeded) {
+		Fail(t, "wrong error once the context timed out", err)
+	}
+}
+
+// flakyFiltererForTesting fails with each of its errors in turn before answering queries
+type flakyFiltererForTesting struct {
+	logFiltererForTesting
+	failures []error
+	queries  int
+}
+
+func (f *flakyFiltererForTesting) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	f.queries++
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return nil, err
+	}
+	return f.logFiltererForTesting.FilterLogs(ctx, query)
+}
+
+// rpcErrorForTesting is an error the RPC server replied with
+type rpcErrorForTesting struct {
+	code int
+}
+
+func (err rpcErrorForTesting) Error() string  { return fmt.Sprintf("rpc error %v", err.code) }
+func (err rpcErrorForTesting) ErrorCode() int { return err.code }
+
+func TestBuildFromLogFiltererRetry(t *testing.T) {
+	ctx := context.Background()
+	acc, logs := sendTreeForTesting(t, 7)
+	transient := errors.New("connection reset by peer")
+	builder := NewProofBuilder(WithRetry(3, time.Millisecond))
+
+	client := &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{transient, transient}, 0}
+	proof, _, err := builder.BuildFromLogFilterer(ctx, client, 2, 7, root(t, acc))
+	Require(t, err)
+	if !proof.IsCorrect() || client.queries != 3 {
+		Fail(t, "expected a correct proof after 3 queries, got", client.queries)
+	}
+
+	client = &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{transient, transient, transient}, 0}
+	if _, _, err := builder.BuildFromLogFilterer(ctx, client, 2, 7, root(t, acc)); !errors.Is(err, transient) || client.queries != 3 {
+		Fail(t, "expected to give up after 3 queries, got", client.queries, err)
+	}
+
+	// the server rate limiting or timing out is retried, but its other replies aren't
+	for _, limited := range []error{
+		rpcErrorForTesting{-32005},
+		rpcErrorForTesting{-32002},
+		rpc.HTTPError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"},
+		rpc.HTTPError{StatusCode: http.StatusGatewayTimeout, Status: "504 Gateway Timeout"},
+	} {
+		client = &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{limited, limited}, 0}
+		proof, _, err := builder.BuildFromLogFilterer(ctx, client, 2, 7, root(t, acc))
+		Require(t, err, limited)
+		if !proof.IsCorrect() || client.queries != 3 {
+			Fail(t, "didn't retry", limited, "got", client.queries, "queries")
+		}
+	}
+	for _, malformed := range []error{
+		rpcErrorForTesting{-32600},
+		rpcErrorForTesting{-32602},
+		rpc.HTTPError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"},
+	} {
+		client = &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{malformed}, 0}
+		if _, _, err := builder.BuildFromLogFilterer(ctx, client, 2, 7, root(t, acc)); err == nil || client.queries != 1 {
+			Fail(t, "retried", malformed, "got", client.queries, "queries", err)
+		}
+	}
+
+	client = &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{transient}, 0}
+	if _, _, err := NewProofBuilder().BuildFromLogFilterer(ctx, client, 2, 7, root(t, acc)); err == nil || client.queries != 1 {
+		Fail(t, "retried without being asked to", client.queries, err)
+	}
+
+	// cancelling the context stops the backoff
+	cancelled, cancel := context.WithCancel(ctx)
+	client = &flakyFiltererForTesting{logFiltererForTesting{logs: logs}, []error{transient}, 0}
+	patient := NewProofBuilder(WithRetry(3, time.Hour))
+	done := make(chan error)
+	go func() {
+		_, _, err := patient.BuildFromLogFilterer(cancelled, client, 2, 7, root(t, acc))
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			Fail(t, "wrong error after cancelling", err)
+		}
+	case <-time.After(10 * time.Second):
+		Fail(t, "backoff ignored the context")
+	}
+}
+
+func TestProofQueriesDeduplicated(t *testing.T) {
+	// in a tree of 3, leaf 2 is itself a partial, and its sibling at level 1 is the other partial
+	queries := proofQueries(2, 3)
+	expected := []proofQuery{
+		{NewLevelAndLeaf(0, 2), roleLeaf | rolePartial},
+		{NewLevelAndLeaf(1, 1), roleSibling | rolePartial},
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		Fail(t, "wrong queries", queries)
+	}
+
+	for treeSize := uint64(1); treeSize <= 21; treeSize++ {
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			seen := make(map[LevelAndLeaf]bool)
+			for _, place := range ProofQueryPositions(leaf, treeSize) {
+				if seen[place] {
+					Fail(t, "queried", place, "twice for leaf", leaf, "of", treeSize)
+				}
+				seen[place] = true
+			}
+			if arbmath.IsPowerOf2(treeSize) {
+				continue // balanced trees need no partials
+			}
+			for _, place := range partialPositions(treeSize) {
+				if !seen[place] {
+					Fail(t, "didn't query partial", place, "for leaf", leaf, "of", treeSize)
+				}
+			}
+		}
+	}
+
+	// the shared position is queried once, and its log serves both roles
+	acc, logs := sendTreeForTesting(t, 3)
+	client := &logFiltererForTesting{logs: logs}
+	proof, _, err := NewProofBuilder().BuildFromLogFilterer(context.Background(), client, 2, 3, root(t, acc))
+	Require(t, err)
+	if !proof.IsCorrect() {
+		Fail(t, "bad proof for leaf 2 of 3")
+	}
+	if positions := client.lastQuery.Topics[3]; len(positions) != 2 {
+		Fail(t, "queried", len(positions), "positions rather than 2")
+	}
+
+	shared := NewLevelAndLeaf(1, 1).ToHash()
+	missing := []types.Log{}
+	for _, log := range logs {
+		if log.Topics[3] != shared {
+			missing = append(missing, log)
+		}
+	}
+	client = &logFiltererForTesting{logs: missing}
+	_, _, err = NewProofBuilder().BuildFromLogFilterer(context.Background(), client, 2, 3, root(t, acc))
+	if err == nil || !strings.Contains(err.Error(), "sibling and partial") {
+		Fail(t, "wrong error for a missing shared node", err)
+	}
+}
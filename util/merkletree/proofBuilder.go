@@ -0,0 +1,537 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// ProofBuilder builds proofs of leaves in a tree of a given size from the nodes known to be in it,
+// such as those recovered from ArbSys logs
+type ProofBuilder struct {
+	explicitEmptySiblings bool
+	selfVerify            bool
+	returnLogs            bool
+	transforms            []func(*MerkleProof) (*MerkleProof, error)
+	retryAttempts         int
+	retryBackoff          time.Duration
+	hasher                Hasher
+}
+
+type ProofBuilderOption func(*ProofBuilder)
+
+// ErrSelfVerifyFailed is returned by a builder made WithSelfVerify when a proof it built doesn't verify, and by any
+// builder within a *FrontierRootMismatchError
+var ErrSelfVerifyFailed = errors.New("built proof doesn't verify against the target root")
+
+// ErrFrontierRootMismatch is returned, within a *FrontierRootMismatchError, when walking the frontier of an
+// unbalanced tree from its partials doesn't reproduce the target root
+var ErrFrontierRootMismatch = errors.New("walking the frontier didn't reproduce the root")
+
+// FrontierRootMismatchError reports the root the frontier walk computed, the root expected, and the position
+// the walk ended at. The proof couldn't verify against the expected root, so it's also an ErrSelfVerifyFailed.
+type FrontierRootMismatchError struct {
+	Position LevelAndLeaf
+	Computed common.Hash
+	Expected common.Hash
+}
+
+func (e *FrontierRootMismatchError) Error() string {
+	return fmt.Sprintf(
+		"%v: walk ended at level %v leaf %v with %v rather than %v",
+		ErrFrontierRootMismatch, e.Position.Level, e.Position.Leaf, e.Computed, e.Expected,
+	)
+}
+
+func (e *FrontierRootMismatchError) Unwrap() []error {
+	return []error{ErrFrontierRootMismatch, ErrSelfVerifyFailed}
+}
+
+// ErrPartialUnknown is returned when a partial needed to walk the frontier of an unbalanced tree isn't known
+var ErrPartialUnknown = errors.New("the tree's partial is unknown")
+
+// WithExplicitEmptySiblings sets whether siblings that are empty subtrees appear in proofs as zero hashes.
+// The outbox requires them, so they're included by default.
+// Proofs built without them can be expanded back with ExpandEmptySiblings.
+func WithExplicitEmptySiblings(explicit bool) ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.explicitEmptySiblings = explicit
+	}
+}
+
+// WithSelfVerify makes BuildForRoot check the proofs it builds against the target root before returning them.
+// It's off by default, as it costs another pass over the proof.
+func WithSelfVerify() ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.selfVerify = true
+	}
+}
+
+// WithReturnLogs makes BuildFromLogFilterer return the logs it fetched alongside the proof,
+// so callers can cache them and build other proofs without fetching them again
+func WithReturnLogs() ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.returnLogs = true
+	}
+}
+
+// WithProofTransform adds a step that post-processes each proof the builder makes, for instance to reorder,
+// pad, or encode it for a particular contract. Transforms run in the order given, after the proof is assembled
+// and before it's self-verified.
+func WithProofTransform(transform func(*MerkleProof) (*MerkleProof, error)) ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.transforms = append(builder.transforms, transform)
+	}
+}
+
+// WithRetry makes BuildFromLogFilterer try fetching logs up to the given number of attempts in all, waiting the
+// backoff before the first retry and twice as long before each one after. Errors the RPC server replied with,
+// such as for a malformed query, aren't retried, as retrying the same query would get the same reply, unless
+// the server was rate limiting or timing out.
+func WithRetry(attempts int, backoff time.Duration) ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.retryAttempts = attempts
+		builder.retryBackoff = backoff
+	}
+}
+
+// WithHasher sets the hasher the tree's nodes combine with, which the builder's proofs then carry.
+// Keccak256Hasher, which ArbSys uses, is the default.
+func WithHasher(hasher Hasher) ProofBuilderOption {
+	return func(builder *ProofBuilder) {
+		builder.hasher = hasher
+	}
+}
+
+func NewProofBuilder(opts ...ProofBuilderOption) *ProofBuilder {
+	builder := &ProofBuilder{
+		explicitEmptySiblings: true,
+		hasher:                Keccak256Hasher,
+	}
+	for _, opt := range opts {
+		opt(builder)
+	}
+	return builder
+}
+
+// Build proves the leaf is in the tree of the given size. Known maps positions to node hashes, with leaves
+// already hashed, and must include the leaf, its siblings that are complete subtrees, and the tree's partials.
+// Any other nodes are ignored, so known may describe a later version of the tree.
+func (b *ProofBuilder) Build(leaf, treeSize uint64, known map[LevelAndLeaf]common.Hash) (*MerkleProof, error) {
+	proof, err := b.assemble(leaf, treeSize, known)
+	if err != nil {
+		return nil, err
+	}
+	return b.transform(proof)
+}
+
+// assemble does the work of Build, short of applying the transforms
+func (b *ProofBuilder) assemble(leaf, treeSize uint64, known map[LevelAndLeaf]common.Hash) (*MerkleProof, error) {
+	if err := checkLeafInTree(leaf, treeSize); err != nil {
+		return nil, err
+	}
+	leafHash, ok := known[NewLevelAndLeaf(0, leaf)]
+	if !ok {
+		return nil, fmt.Errorf("leaf %v is unknown", leaf)
+	}
+
+	// the frontier nodes take precedence, as known may have later versions of them
+	recovered, err := FillFrontierWithHasher(treeSize, known, b.hasher)
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(place LevelAndLeaf) (common.Hash, bool) {
+		if hash, ok := recovered[place]; ok {
+			return hash, true
+		}
+		hash, ok := known[place]
+		return hash, ok
+	}
+	var frontierRoot *common.Hash
+	if frontier := FrontierPositions(treeSize); len(frontier) > 0 {
+		root := recovered[frontier[len(frontier)-1]]
+		frontierRoot = &root
+	}
+
+	proof := &MerkleProof{
+		LeafHash:  leafHash,
+		LeafIndex: leaf,
+		Proof:     []common.Hash{},
+		hasher:    proofHasher(b.hasher),
+	}
+	hash := leafHash
+	for level, place := range proofPositions(leaf, treeSize) {
+		sibling, ok := lookup(place)
+		if !ok {
+			return nil, fmt.Errorf("the sibling at level %v leaf %v is unknown", place.Level, place.Leaf)
+		}
+		if leaf&(1<<level) == 0 {
+			hash = b.hasher(hash, sibling)
+		} else {
+			hash = b.hasher(sibling, hash)
+		}
+		if b.explicitEmptySiblings || !isEmptySubtree(place, treeSize) {
+			proof.Proof = append(proof.Proof, sibling)
+		}
+	}
+	if frontierRoot != nil && *frontierRoot != hash {
+		return nil, errors.New("the known nodes are inconsistent with the tree's partials")
+	}
+	proof.RootHash = hash
+	return proof, nil
+}
+
+// FillFrontier computes every node on the frontier of a tree of the given size, as FrontierPositions walks it,
+// from the tree's partials in known. These are the nodes that aren't complete subtrees, so their hashes in a
+// later version of the tree differ, and known may hold such versions: only the partials are read from it.
+// Balanced trees have no frontier, so the result is empty for them. The caller's map isn't modified, and the
+// only error is ErrPartialUnknown, naming the first partial missing from known.
+func FillFrontier(treeSize uint64, known map[LevelAndLeaf]common.Hash) (map[LevelAndLeaf]common.Hash, error) {
+	return FillFrontierWithHasher(treeSize, known, Keccak256Hasher)
+}
+
+// FillFrontierWithHasher is FillFrontier for a tree whose nodes combine with the hasher
+func FillFrontierWithHasher(treeSize uint64, known map[LevelAndLeaf]common.Hash, hasher Hasher) (map[LevelAndLeaf]common.Hash, error) {
+	recovered := make(map[LevelAndLeaf]common.Hash)
+	frontier := FrontierPositions(treeSize)
+	if len(frontier) == 0 {
+		return recovered, nil
+	}
+	recovered[frontier[0]] = common.Hash{}
+	for i := 1; i+1 < len(frontier); i += 2 {
+		curr := recovered[frontier[i-1]]
+		step, parent := frontier[i], frontier[i+1]
+		left, right := curr, curr
+		if treeSize&(1<<step.Level) != 0 {
+			partial, ok := known[step]
+			if !ok {
+				return nil, fmt.Errorf("%w: level %v leaf %v", ErrPartialUnknown, step.Level, step.Leaf)
+			}
+			recovered[step] = partial
+			left = partial
+		} else {
+			recovered[step] = common.Hash{}
+			right = common.Hash{}
+		}
+		recovered[parent] = hasher(left, right)
+	}
+	return recovered, nil
+}
+
+// BuildForRoot builds a proof like Build, but for the target root rather than the one the known nodes produce.
+// When the tree is unbalanced, walking its frontier computes the root without more hashing, so a
+// *FrontierRootMismatchError is returned if that isn't the target. Otherwise, unless the builder was made
+// WithSelfVerify, it's up to the caller to check the proof.
+func (b *ProofBuilder) BuildForRoot(leaf, treeSize uint64, root common.Hash, known map[LevelAndLeaf]common.Hash) (*MerkleProof, error) {
+	proof, err := b.assemble(leaf, treeSize, known)
+	if err != nil {
+		return nil, err
+	}
+	if frontier := FrontierPositions(treeSize); len(frontier) > 0 && proof.RootHash != root {
+		// assemble checked the walk's root is the one the leaf's path makes, which it returned
+		return nil, &FrontierRootMismatchError{frontier[len(frontier)-1], proof.RootHash, root}
+	}
+	proof.RootHash = root
+	proof, err = b.transform(proof)
+	if err != nil {
+		return nil, err
+	}
+	if b.selfVerify {
+		check := proof
+		if !b.explicitEmptySiblings {
+			check, err = ExpandEmptySiblings(proof, treeSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !check.IsCorrectWithHasher(b.hasher) {
+			return nil, fmt.Errorf("%w: proof of leaf %v of %v for root %v", ErrSelfVerifyFailed, leaf, treeSize, root)
+		}
+	}
+	return proof, nil
+}
+
+func (b *ProofBuilder) transform(proof *MerkleProof) (*MerkleProof, error) {
+	for _, transform := range b.transforms {
+		transformed, err := transform(proof)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform proof of leaf %v: %w", proof.LeafIndex, err)
+		}
+		proof = transformed
+	}
+	return proof, nil
+}
+
+// ProveWithKnownNodes builds a proof purely from the caller's nodes, with leaves already hashed,
+// checking it proves the leaf against the given root
+func ProveWithKnownNodes(leaf, treeSize uint64, root common.Hash, nodes map[LevelAndLeaf]common.Hash) (*MerkleProof, error) {
+	return NewProofBuilder(WithSelfVerify()).BuildForRoot(leaf, treeSize, root, nodes)
+}
+
+// ExpandEmptySiblings returns the proof with the empty siblings a ProofBuilder may have omitted put back,
+// in the form the outbox and IsCorrect expect
+func ExpandEmptySiblings(proof *MerkleProof, treeSize uint64) (*MerkleProof, error) {
+	if proof.LeafIndex >= treeSize {
+		return nil, fmt.Errorf("leaf %v isn't in a tree of size %v", proof.LeafIndex, treeSize)
+	}
+	expanded := []common.Hash{}
+	remaining := proof.Proof
+	for _, place := range proofPositions(proof.LeafIndex, treeSize) {
+		if isEmptySubtree(place, treeSize) {
+			expanded = append(expanded, common.Hash{})
+			continue
+		}
+		if len(remaining) == 0 {
+			return nil, errors.New("proof has too few siblings for the tree")
+		}
+		expanded = append(expanded, remaining[0])
+		remaining = remaining[1:]
+	}
+	if len(remaining) != 0 {
+		return nil, errors.New("proof has too many siblings for the tree")
+	}
+	return &MerkleProof{
+		RootHash:  proof.RootHash,
+		LeafHash:  proof.LeafHash,
+		LeafIndex: proof.LeafIndex,
+		Proof:     expanded,
+		hasher:    proof.hasher,
+	}, nil
+}
+
+// NeedsPartials returns whether proving the leaf needs the tree's partials, which is when one of its siblings
+// is only partly filled, so its hash has to be recovered by walking the frontier. Siblings that are complete
+// subtrees are known outright and empty ones hash to zero, so leaves in balanced trees never need partials.
+func NeedsPartials(treeSize, leafIndex uint64) bool {
+	if leafIndex >= treeSize {
+		return false
+	}
+	for _, place := range proofPositions(leafIndex, treeSize) {
+		if place.Leaf >= treeSize && !isEmptySubtree(place, treeSize) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProofHashOps returns how many pairs of hashes verifying a proof of the leaf will keccak.
+// Verification hashes once per sibling, empty or not, so this is the height of the smallest balanced tree
+// that holds treeSize leaves. Leaves not in the tree need none.
+func ProofHashOps(treeSize, leafIndex uint64) int {
+	if leafIndex >= treeSize {
+		return 0
+	}
+	return len(proofPositions(leafIndex, treeSize))
+}
+
+// Rough costs for EstimateBuildCost's latency model
+const (
+	estimatedRoundTrip   = 100 * time.Millisecond // to fetch the logs in one query
+	estimatedPerPosition = 2 * time.Millisecond   // for the node to find each position's log
+	estimatedPerKeccak   = time.Microsecond
+)
+
+// BuildCostEstimate is the approximate cost of building and checking a proof from ArbSys logs
+type BuildCostEstimate struct {
+	Positions int           // positions queried, for the leaf that needs the most
+	KeccakOps int           // hashes to verify the proof
+	Latency   time.Duration // a rough model, assuming all the logs are fetched in one query
+}
+
+// EstimateBuildCost estimates the cost of proving a leaf in a tree of the given size, to help size infrastructure.
+// With balanced, the estimate is instead for the smallest balanced tree that holds treeSize leaves.
+// Leaf 0 queries the most positions: all its siblings up to the largest partial are complete, and none is a partial.
+func EstimateBuildCost(treeSize uint64, balanced bool) BuildCostEstimate {
+	if balanced {
+		treeSize = arbmath.NextOrCurrentPowerOf2(treeSize)
+	}
+	if treeSize == 0 {
+		return BuildCostEstimate{}
+	}
+	// the leaf, a complete sibling at each level below the largest partial, and the partials if unbalanced
+	positions := int(arbmath.Log2ceil(treeSize))
+	if !arbmath.IsPowerOf2(treeSize) {
+		positions += bits.OnesCount64(treeSize)
+	}
+	keccakOps := ProofHashOps(treeSize, 0)
+	latency := estimatedRoundTrip +
+		time.Duration(positions)*estimatedPerPosition +
+		time.Duration(keccakOps)*estimatedPerKeccak
+	return BuildCostEstimate{positions, keccakOps, latency}
+}
+
+// queryRole records what a queried node is needed for, as a set
+type queryRole uint8
+
+const (
+	roleLeaf queryRole = 1 << iota
+	roleSibling
+	rolePartial
+)
+
+func (role queryRole) String() string {
+	names := []string{}
+	for _, option := range []struct {
+		role queryRole
+		name string
+	}{{roleLeaf, "leaf"}, {roleSibling, "sibling"}, {rolePartial, "partial"}} {
+		if role&option.role != 0 {
+			names = append(names, option.name)
+		}
+	}
+	return strings.Join(names, " and ")
+}
+
+type proofQuery struct {
+	place LevelAndLeaf
+	role  queryRole
+}
+
+// proofQueries finds the nodes a proof needs that can only be known from the tree's history:
+// the leaf, its siblings that are complete subtrees, and the partials of an unbalanced tree. A sibling or the leaf
+// itself may also be a partial, in which case it's queried once with both roles.
+func proofQueries(leaf, treeSize uint64) []proofQuery {
+	queries := []proofQuery{}
+	if treeSize == 0 {
+		return queries // an empty tree has no leaf to prove
+	}
+	indices := make(map[LevelAndLeaf]int)
+	add := func(place LevelAndLeaf, role queryRole) {
+		if i, ok := indices[place]; ok {
+			queries[i].role |= role
+			return
+		}
+		indices[place] = len(queries)
+		queries = append(queries, proofQuery{place, role})
+	}
+	add(NewLevelAndLeaf(0, leaf), roleLeaf)
+	for _, place := range proofPositions(leaf, treeSize) {
+		if place.Leaf < treeSize {
+			// the sibling must not be newer than the root
+			add(place, roleSibling)
+		}
+	}
+	if !arbmath.IsPowerOf2(treeSize) {
+		// only the frontier of an unbalanced tree needs its partials
+		for _, place := range partialPositions(treeSize) {
+			add(place, rolePartial)
+		}
+	}
+	return queries
+}
+
+// ProofQueryPositions returns, each once, the positions of the logs needed to prove the leaf in a tree of the
+// given size: the leaf, its siblings that are complete subtrees, and the partials if the tree isn't balanced.
+// Siblings newer than the root are left out, as the proof uses zero hashes for them. An empty tree needs none.
+func ProofQueryPositions(leaf, treeSize uint64) []LevelAndLeaf {
+	queries := proofQueries(leaf, treeSize)
+	positions := make([]LevelAndLeaf, len(queries))
+	for i, query := range queries {
+		positions[i] = query.place
+	}
+	return positions
+}
+
+// checkQueriesAnswered makes sure each queried node is known, naming the roles of the first that isn't
+func checkQueriesAnswered(queries []proofQuery, known map[LevelAndLeaf]common.Hash) error {
+	for _, query := range queries {
+		if _, ok := known[query.place]; !ok {
+			return fmt.Errorf("no node for the %v at level %v leaf %v", query.role, query.place.Level, query.place.Leaf)
+		}
+	}
+	return nil
+}
+
+// proofPositions finds the positions of the leaf's siblings, bottom-up, in a tree of the given size
+func proofPositions(leaf, treeSize uint64) []LevelAndLeaf {
+	if treeSize == 0 {
+		return nil // there's no tree, not even a root, so there are no levels to count down from
+	}
+	treeLevels := arbmath.Log2ceil(treeSize) // the # of levels in the tree
+	if arbmath.IsPowerOf2(treeSize) {
+		treeLevels -= 1 // a balanced tree's top level is its root
+	}
+	positions := []LevelAndLeaf{}
+	for level := uint64(0); level < treeLevels; level++ {
+		positions = append(positions, SiblingPosition(leaf, level))
+	}
+	return positions
+}
+
+// SiblingPosition returns the position of the sibling needed at the given level when proving the leaf.
+// Nodes are placed at their rightmost leaf, so the path is approached from the right with the lower bits set,
+// and the sibling is found by flipping the bit for the level.
+func SiblingPosition(leafIndex uint64, level uint64) LevelAndLeaf {
+	which := uint64(1) << level      // which bit to flip
+	place := leafIndex | (which - 1) // where the path is at this level
+	return NewLevelAndLeaf(level, place^which)
+}
+
+// isEmptySubtree checks whether the subtree at the given position is entirely beyond the tree's leaves
+func isEmptySubtree(place LevelAndLeaf, treeSize uint64) bool {
+	first := place.Leaf &^ (1<<place.Level - 1)
+	return first >= treeSize
+}
+
+// WithdrawalSource provides the hashes of sends, as found in L2ToL1Tx logs, by their leaf index
+type WithdrawalSource interface {
+	SendHash(leaf uint64) (common.Hash, error)
+}
+
+// NodeSource provides the hashes of internal nodes, as found in SendMerkleUpdate logs.
+// Positions it doesn't know may be left out of the result.
+type NodeSource interface {
+	Nodes(positions []LevelAndLeaf) (map[LevelAndLeaf]common.Hash, error)
+}
+
+// BuildProofFromSources proves the leaf is in the tree with the given root and size, getting leaves from one
+// source and internal nodes from another, so the two needn't come from the same client
+func BuildProofFromSources(
+	leaf uint64, root common.Hash, size uint64, withdrawalSource WithdrawalSource, nodeSource NodeSource,
+) (*MerkleProof, error) {
+	if leaf >= size {
+		return nil, fmt.Errorf("leaf %v isn't in a tree of size %v", leaf, size)
+	}
+	queries := proofQueries(leaf, size)
+
+	known := make(map[LevelAndLeaf]common.Hash)
+	internal := []LevelAndLeaf{}
+	for _, query := range queries {
+		place := query.place
+		if place.Level > 0 {
+			internal = append(internal, place)
+			continue
+		}
+		sendHash, err := withdrawalSource.SendHash(place.Leaf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get send %v: %w", place.Leaf, err)
+		}
+		known[place] = crypto.Keccak256Hash(sendHash.Bytes())
+	}
+	if len(internal) > 0 {
+		nodes, err := nodeSource.Nodes(internal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get merkle nodes: %w", err)
+		}
+		for place, hash := range nodes {
+			if place.Level == 0 {
+				return nil, errors.New("node source returned a leaf")
+			}
+			known[place] = hash
+		}
+	}
+	if err := checkQueriesAnswered(queries, known); err != nil {
+		return nil, err
+	}
+
+	return NewProofBuilder(WithSelfVerify()).BuildForRoot(leaf, size, root, known)
+}
@@ -0,0 +1,555 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+func knownFromLogsForTesting(t *testing.T, logs []types.Log) map[LevelAndLeaf]common.Hash {
+	t.Helper()
+	known, err := knownFromLogs(logs)
+	Require(t, err)
+	return known
+}
+
+func TestProofBuilder(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 20)
+	known := knownFromLogsForTesting(t, logs)
+	explicit := NewProofBuilder()
+	compact := NewProofBuilder(WithExplicitEmptySiblings(false))
+
+	for treeSize := uint64(1); treeSize <= 20; treeSize++ {
+		acc, _ := sendTreeForTesting(t, treeSize)
+		tree, err := NewMerkleTreeFromAccumulator(acc)
+		Require(t, err)
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := explicit.Build(leaf, treeSize, known)
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			if proof.RootHash != root(t, acc) || !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+			if len(proof.Proof) != int(arbmath.Log2ceil(tree.Capacity())-1) {
+				Fail(t, "explicit proof has", len(proof.Proof), "siblings for a tree of capacity", tree.Capacity())
+			}
+
+			compactProof, err := compact.Build(leaf, treeSize, known)
+			Require(t, err)
+			empties := 0
+			for _, sibling := range proof.Proof {
+				if sibling == (common.Hash{}) {
+					empties++
+				}
+			}
+			if len(compactProof.Proof) != len(proof.Proof)-empties {
+				Fail(t, "compact proof kept empty siblings", leaf, "of", treeSize)
+			}
+			if empties > 0 && compactProof.IsCorrect() {
+				Fail(t, "the outbox's verifier accepted a compact proof", leaf, "of", treeSize)
+			}
+			expanded, err := ExpandEmptySiblings(compactProof, treeSize)
+			Require(t, err)
+			if !reflect.DeepEqual(expanded, proof) || !expanded.IsCorrect() {
+				Fail(t, "expanding the compact proof didn't produce the explicit one", leaf, "of", treeSize)
+			}
+		}
+		if _, err := explicit.Build(treeSize, treeSize, known); err == nil {
+			Fail(t, "proved a leaf beyond the tree", treeSize)
+		}
+	}
+
+	if _, err := explicit.Build(3, 20, map[LevelAndLeaf]common.Hash{}); err == nil {
+		Fail(t, "built a proof without knowing any nodes")
+	}
+}
+
+func TestProofBuilderDeterministic(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 20)
+	known := knownFromLogsForTesting(t, logs)
+
+	// the same nodes, found from the logs in the reverse order and inserted into a fresh map
+	reversed := make([]types.Log, len(logs))
+	for i := range logs {
+		reversed[len(logs)-1-i] = logs[i]
+	}
+	rebuilt := knownFromLogsForTesting(t, reversed)
+	if !reflect.DeepEqual(rebuilt, known) {
+		Fail(t, "reordering the logs changed the known nodes")
+	}
+
+	for _, explicit := range []bool{true, false} {
+		builder := NewProofBuilder(WithExplicitEmptySiblings(explicit))
+		for _, treeSize := range []uint64{1, 5, 8, 13, 20} {
+			for leaf := uint64(0); leaf < treeSize; leaf++ {
+				first, err := builder.Build(leaf, treeSize, known)
+				Require(t, err)
+				second, err := builder.Build(leaf, treeSize, known)
+				Require(t, err)
+				fromRebuilt, err := NewProofBuilder(WithExplicitEmptySiblings(explicit)).Build(leaf, treeSize, rebuilt)
+				Require(t, err)
+
+				encoded := first.Encode()
+				data, err := json.Marshal(first)
+				Require(t, err)
+				for _, other := range []*MerkleProof{second, fromRebuilt} {
+					otherData, err := json.Marshal(other)
+					Require(t, err)
+					if !bytes.Equal(other.Encode(), encoded) || !bytes.Equal(otherData, data) {
+						Fail(t, "building the proof of leaf", leaf, "of", treeSize, "again gave different bytes", explicit)
+					}
+				}
+			}
+		}
+	}
+}
+
+type withdrawalSourceForTesting map[uint64]common.Hash
+
+func (source withdrawalSourceForTesting) SendHash(leaf uint64) (common.Hash, error) {
+	sendHash, ok := source[leaf]
+	if !ok {
+		return common.Hash{}, fmt.Errorf("no send %v", leaf)
+	}
+	return sendHash, nil
+}
+
+type nodeSourceForTesting map[LevelAndLeaf]common.Hash
+
+func (source nodeSourceForTesting) Nodes(positions []LevelAndLeaf) (map[LevelAndLeaf]common.Hash, error) {
+	nodes := make(map[LevelAndLeaf]common.Hash)
+	for _, place := range positions {
+		if hash, ok := source[place]; ok {
+			nodes[place] = hash
+		}
+	}
+	return nodes, nil
+}
+
+func TestBuildProofFromSources(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 19)
+	withdrawals := withdrawalSourceForTesting{}
+	nodes := nodeSourceForTesting{}
+	for _, log := range logs {
+		position := PositionTopic(log.Topics[3])
+		if log.Topics[0] == withdrawTopicForTesting {
+			withdrawals[position.Leaf()] = log.Topics[2]
+		} else {
+			nodes[position.LevelAndLeaf()] = log.Topics[2]
+		}
+	}
+
+	for size := uint64(1); size <= 19; size++ {
+		acc, _ := sendTreeForTesting(t, size)
+		for leaf := uint64(0); leaf < size; leaf++ {
+			proof, err := BuildProofFromSources(leaf, root(t, acc), size, withdrawals, nodes)
+			Require(t, err, "leaf", leaf, "of", size)
+			if !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of", size)
+			}
+		}
+		if _, err := BuildProofFromSources(0, pseudorandomForTesting(1000), size, withdrawals, nodes); err == nil {
+			Fail(t, "built a proof for the wrong root", size)
+		}
+	}
+
+	// without the internal nodes, only the smallest trees can be proven
+	for size := uint64(3); size <= 19; size++ {
+		acc, _ := sendTreeForTesting(t, size)
+		if _, err := BuildProofFromSources(0, root(t, acc), size, withdrawals, nodeSourceForTesting{}); err == nil {
+			Fail(t, "built a proof without internal nodes", size)
+		}
+	}
+}
+
+func TestProofGoldens(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 13)
+	known := knownFromLogsForTesting(t, logs)
+	builder := NewProofBuilder()
+	for _, treeSize := range []uint64{1, 3, 5, 8, 13} {
+		for _, leaf := range []uint64{0, treeSize / 2, treeSize - 1} {
+			proof, err := builder.Build(leaf, treeSize, known)
+			Require(t, err)
+			golden := filepath.Join("testdata", fmt.Sprintf("proof_size%v_leaf%v.json", treeSize, leaf))
+			CompareToGolden(t, proof, golden)
+		}
+	}
+}
+
+// completeNodesForTesting hashes every complete subtree of a tree with the given leaves, by position
+func completeNodesForTesting(leaves []common.Hash) map[LevelAndLeaf]common.Hash {
+	nodes := make(map[LevelAndLeaf]common.Hash)
+	level := make([]common.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = crypto.Keccak256Hash(leaf.Bytes())
+	}
+	for height := uint64(0); len(level) > 0; height++ {
+		for i, hash := range level {
+			nodes[NewLevelAndLeaf(height, uint64(i+1)<<height-1)] = hash
+		}
+		next := []common.Hash{}
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, crypto.Keccak256Hash(level[i].Bytes(), level[i+1].Bytes()))
+		}
+		level = next
+	}
+	return nodes
+}
+
+func TestProveWithKnownNodes(t *testing.T) {
+	for _, treeSize := range []uint64{3, 5, 6, 7, 9, 11, 13} {
+		leaves := make([]common.Hash, treeSize)
+		for i := range leaves {
+			leaves[i] = pseudorandomForTesting(uint64(i))
+		}
+		nodes := completeNodesForTesting(leaves)
+		acc, _ := sendTreeForTesting(t, treeSize)
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := ProveWithKnownNodes(leaf, treeSize, root(t, acc), nodes)
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			if !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+		}
+		if _, err := ProveWithKnownNodes(0, treeSize, pseudorandomForTesting(1000), nodes); err == nil {
+			Fail(t, "proved a leaf against the wrong root", treeSize)
+		}
+	}
+}
+
+func TestFillFrontier(t *testing.T) {
+	later := leavesForTesting(1 << 11)
+	laterNodes := completeNodesForTesting(later)
+	for _, treeSize := range []uint64{3, 5, 1<<10 - 1, 1<<10 + 1, 1<<9 + 1<<3 + 1} {
+		older := NewMerkleTreeFromLeaves(later[:treeSize])
+		highest := arbmath.NextPowerOf2(treeSize) / 2
+
+		// the nodes left of the frontier are the same in the later tree, but those on it aren't
+		recovered, err := FillFrontier(treeSize, laterNodes)
+		Require(t, err)
+		frontier := FrontierPositions(treeSize)
+		if len(recovered) != len(frontier) {
+			Fail(t, "recovered", len(recovered), "nodes for a frontier of", len(frontier), "in size", treeSize)
+		}
+		for _, place := range frontier {
+			hash, err := subtreeHash(older, place)
+			Require(t, err)
+			if recovered[place] != hash {
+				Fail(t, "wrong frontier node at", place, "for size", treeSize)
+			}
+		}
+
+		// the leaves next to the frontier, and either side of the largest partial's edge, prove with only the
+		// nodes queried for them, even when known has the later versions of the frontier
+		for _, leaf := range []uint64{treeSize - 1, treeSize - 2, highest - 1, highest} {
+			if leaf >= treeSize {
+				continue
+			}
+			known := make(map[LevelAndLeaf]common.Hash)
+			for _, place := range append(ProofQueryPositions(leaf, treeSize), frontier...) {
+				if hash, ok := laterNodes[place]; ok {
+					known[place] = hash
+				}
+			}
+			proof, err := NewProofBuilder().Build(leaf, treeSize, known)
+			Require(t, err, "leaf", leaf, "of", treeSize)
+			if proof.RootHash != older.Hash() || !proof.IsCorrect() {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+		}
+
+		for _, place := range partialPositions(treeSize) {
+			missing := make(map[LevelAndLeaf]common.Hash)
+			for position, hash := range laterNodes {
+				if position != place {
+					missing[position] = hash
+				}
+			}
+			if _, err := FillFrontier(treeSize, missing); !errors.Is(err, ErrPartialUnknown) {
+				Fail(t, "wrong error without the partial at", place, "for size", treeSize, err)
+			}
+			if _, err := NewProofBuilder().Build(0, treeSize, missing); !errors.Is(err, ErrPartialUnknown) {
+				Fail(t, "built a proof without the partial at", place, "for size", treeSize, err)
+			}
+		}
+	}
+
+	recovered, err := FillFrontier(8, map[LevelAndLeaf]common.Hash{})
+	if err != nil || len(recovered) != 0 {
+		Fail(t, "balanced trees have no frontier", recovered, err)
+	}
+}
+
+// countingVerifyForTesting verifies the proof like IsCorrect, counting the pairs of hashes it keccaks
+func countingVerifyForTesting(proof *MerkleProof) (bool, int) {
+	hashes := 0
+	hash := proof.LeafHash
+	index := proof.LeafIndex
+	for _, sibling := range proof.Proof {
+		if index&1 == 0 {
+			hash = crypto.Keccak256Hash(hash.Bytes(), sibling.Bytes())
+		} else {
+			hash = crypto.Keccak256Hash(sibling.Bytes(), hash.Bytes())
+		}
+		hashes++
+		index /= 2
+	}
+	return index == 0 && hash == proof.RootHash, hashes
+}
+
+func TestProofHashOps(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 33)
+	known := knownFromLogsForTesting(t, logs)
+	builder := NewProofBuilder()
+	for treeSize := uint64(1); treeSize <= 33; treeSize++ {
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := builder.Build(leaf, treeSize, known)
+			Require(t, err)
+			correct, hashes := countingVerifyForTesting(proof)
+			if !correct {
+				Fail(t, "bad proof for leaf", leaf, "of", treeSize)
+			}
+			if ops := ProofHashOps(treeSize, leaf); ops != hashes {
+				Fail(t, "estimated", ops, "hashes but verifying leaf", leaf, "of", treeSize, "took", hashes)
+			}
+		}
+		if ProofHashOps(treeSize, treeSize) != 0 {
+			Fail(t, "counted hashes for a leaf not in the tree", treeSize)
+		}
+	}
+}
+
+func TestProofBuilderSelfVerify(t *testing.T) {
+	acc, logs := sendTreeForTesting(t, 16)
+	known := knownFromLogsForTesting(t, logs)
+	for _, opts := range [][]ProofBuilderOption{{}, {WithExplicitEmptySiblings(false)}} {
+		verifying := NewProofBuilder(append(opts, WithSelfVerify())...)
+		for _, treeSize := range []uint64{5, 16} {
+			sizedAcc, _ := sendTreeForTesting(t, treeSize)
+			_, err := verifying.BuildForRoot(0, treeSize, root(t, sizedAcc), known)
+			Require(t, err, treeSize)
+		}
+	}
+
+	// break an internal node that isn't a partial, so nothing but the root can catch it
+	broken := make(map[LevelAndLeaf]common.Hash)
+	for place, hash := range known {
+		broken[place] = hash
+	}
+	broken[NewLevelAndLeaf(1, 3)] = pseudorandomForTesting(1000)
+
+	proof, err := NewProofBuilder().BuildForRoot(0, 16, root(t, acc), broken)
+	Require(t, err)
+	if proof.IsCorrect() {
+		Fail(t, "proof from a broken node verified")
+	}
+	_, err = NewProofBuilder(WithSelfVerify()).BuildForRoot(0, 16, root(t, acc), broken)
+	if !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "wrong error for a proof from a broken node", err)
+	}
+	if _, err := ProveWithKnownNodes(0, 16, root(t, acc), broken); !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "wrong error proving with a broken node", err)
+	}
+}
+
+func TestNeedsPartials(t *testing.T) {
+	// the leaves whose siblings include a partly filled subtree, by tree size
+	needing := map[uint64][]uint64{
+		1: {},
+		2: {},
+		3: {0, 1},
+		5: {0, 1, 2, 3},
+		6: {0, 1, 2, 3},
+		7: {0, 1, 2, 3, 4, 5},
+		8: {},
+	}
+	for treeSize, leaves := range needing {
+		needs := make(map[uint64]bool)
+		for _, leaf := range leaves {
+			needs[leaf] = true
+		}
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			if NeedsPartials(treeSize, leaf) != needs[leaf] {
+				Fail(t, "leaf", leaf, "of", treeSize, "needs partials:", !needs[leaf])
+			}
+		}
+	}
+	for treeSize := uint64(1); treeSize <= 1<<10; treeSize *= 2 {
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			if NeedsPartials(treeSize, leaf) {
+				Fail(t, "leaf", leaf, "of balanced tree", treeSize, "needs partials")
+			}
+		}
+	}
+}
+
+func TestSiblingPosition(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 32)
+	known := knownFromLogsForTesting(t, logs)
+	builder := NewProofBuilder()
+	for _, treeSize := range []uint64{2, 5, 13, 32} {
+		for _, leaf := range []uint64{0, 1, treeSize / 2, treeSize - 1} {
+			proof, err := builder.Build(leaf, treeSize, known)
+			Require(t, err)
+			for level, sibling := range proof.Proof {
+				place := SiblingPosition(leaf, uint64(level))
+				if place.Level != uint64(level) {
+					Fail(t, "sibling at level", level, "of leaf", leaf, "placed at level", place.Level)
+				}
+				if isEmptySubtree(place, treeSize) {
+					if sibling != (common.Hash{}) {
+						Fail(t, "empty sibling", place, "of leaf", leaf, "of", treeSize, "isn't zero")
+					}
+					continue
+				}
+				if place.Leaf < treeSize && known[place] != sibling {
+					Fail(t, "walk used a different sibling than", place, "for leaf", leaf, "of", treeSize)
+				}
+			}
+		}
+	}
+
+	// the rightmost-leaf convention, spelled out
+	expected := map[[2]uint64]LevelAndLeaf{
+		{0, 0}:  NewLevelAndLeaf(0, 1),
+		{5, 0}:  NewLevelAndLeaf(0, 4),
+		{5, 1}:  NewLevelAndLeaf(1, 7),
+		{5, 2}:  NewLevelAndLeaf(2, 3),
+		{12, 3}: NewLevelAndLeaf(3, 7),
+	}
+	for args, place := range expected {
+		if got := SiblingPosition(args[0], args[1]); got != place {
+			Fail(t, "sibling of leaf", args[0], "at level", args[1], "is", got, "not", place)
+		}
+	}
+}
+
+func TestWithProofTransform(t *testing.T) {
+	acc, logs := sendTreeForTesting(t, 13)
+	known := knownFromLogsForTesting(t, logs)
+	const padded = 8
+	pad := func(proof *MerkleProof) (*MerkleProof, error) {
+		if len(proof.Proof) > padded {
+			return nil, errors.New("proof too long to pad")
+		}
+		siblings := make([]common.Hash, padded)
+		copy(siblings, proof.Proof)
+		return &MerkleProof{
+			RootHash:  proof.RootHash,
+			LeafHash:  proof.LeafHash,
+			LeafIndex: proof.LeafIndex,
+			Proof:     siblings,
+		}, nil
+	}
+
+	plain, err := NewProofBuilder().BuildForRoot(6, 13, root(t, acc), known)
+	Require(t, err)
+	proof, err := NewProofBuilder(WithProofTransform(pad)).BuildForRoot(6, 13, root(t, acc), known)
+	Require(t, err)
+	if len(proof.Proof) != padded {
+		Fail(t, "transform wasn't applied, got", len(proof.Proof), "siblings")
+	}
+	for i := range proof.Proof {
+		if i < len(plain.Proof) && proof.Proof[i] != plain.Proof[i] || i >= len(plain.Proof) && proof.Proof[i] != (common.Hash{}) {
+			Fail(t, "padded sibling", i, "differs")
+		}
+	}
+	if proof.RootHash != root(t, acc) || proof.LeafHash != plain.LeafHash {
+		Fail(t, "transform didn't see the target root")
+	}
+	built, err := NewProofBuilder(WithProofTransform(pad)).Build(6, 13, known)
+	Require(t, err)
+	if len(built.Proof) != padded {
+		Fail(t, "Build didn't apply the transform")
+	}
+
+	// the transform runs before self-verifying, so a transform that breaks the proof is caught
+	_, err = NewProofBuilder(WithProofTransform(pad), WithSelfVerify()).BuildForRoot(6, 13, root(t, acc), known)
+	if !errors.Is(err, ErrSelfVerifyFailed) {
+		Fail(t, "self-verify didn't check the transformed proof", err)
+	}
+
+	// transforms compose in order, and their errors are returned
+	strip := func(proof *MerkleProof) (*MerkleProof, error) {
+		stripped := *proof
+		stripped.Proof = proof.Proof[:len(plain.Proof)]
+		return &stripped, nil
+	}
+	proof, err = NewProofBuilder(WithProofTransform(pad), WithProofTransform(strip), WithSelfVerify()).BuildForRoot(6, 13, root(t, acc), known)
+	Require(t, err)
+	if !proof.IsCorrect() {
+		Fail(t, "composed transforms broke the proof")
+	}
+	failing := func(proof *MerkleProof) (*MerkleProof, error) {
+		return pad(&MerkleProof{Proof: make([]common.Hash, padded+1)})
+	}
+	if _, err := NewProofBuilder(WithProofTransform(failing)).Build(6, 13, known); err == nil {
+		Fail(t, "transform error wasn't returned")
+	}
+}
+
+func TestEstimateBuildCost(t *testing.T) {
+	for treeSize := uint64(1); treeSize <= 70; treeSize++ {
+		most := 0
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			if positions := len(ProofQueryPositions(leaf, treeSize)); positions > most {
+				most = positions
+			}
+		}
+		estimate := EstimateBuildCost(treeSize, false)
+		if estimate.Positions != most {
+			Fail(t, "estimated", estimate.Positions, "positions for size", treeSize, "but at most", most, "are queried")
+		}
+		if estimate.KeccakOps != ProofHashOps(treeSize, treeSize-1) || estimate.Latency <= 0 {
+			Fail(t, "bad estimate for size", treeSize, estimate)
+		}
+		balanced := EstimateBuildCost(arbmath.NextOrCurrentPowerOf2(treeSize), false)
+		if EstimateBuildCost(treeSize, true) != balanced {
+			Fail(t, "balanced estimate for size", treeSize, "isn't that of the next balanced tree")
+		}
+	}
+	if EstimateBuildCost(0, false) != (BuildCostEstimate{}) {
+		Fail(t, "estimated a cost for an empty tree")
+	}
+}
+
+func TestProofQueryPositions(t *testing.T) {
+	cases := []struct {
+		leaf, treeSize uint64
+		expected       []LevelAndLeaf
+	}{
+		// an empty tree has nothing to prove, and a single leaf is its own root
+		{0, 0, []LevelAndLeaf{}},
+		{0, 1, []LevelAndLeaf{{0, 0}}},
+		// balanced trees have no partials
+		{0, 8, []LevelAndLeaf{{0, 0}, {0, 1}, {1, 3}, {2, 7}}},
+		{7, 8, []LevelAndLeaf{{0, 7}, {0, 6}, {1, 5}, {2, 3}}},
+		// the sibling at level 2 is newer than the root, but the partials are needed
+		{0, 5, []LevelAndLeaf{{0, 0}, {0, 1}, {1, 3}, {2, 3}, {0, 4}}},
+		// the last leaf is itself a partial, and its siblings below level 2 are empty
+		{4, 5, []LevelAndLeaf{{0, 4}, {2, 3}}},
+	}
+	for _, c := range cases {
+		positions := ProofQueryPositions(c.leaf, c.treeSize)
+		if !reflect.DeepEqual(positions, c.expected) {
+			Fail(t, "wrong positions for leaf", c.leaf, "of", c.treeSize, positions)
+		}
+		topics := ToTopicHashes(positions)
+		for i, topic := range topics {
+			if PositionTopic(topic).LevelAndLeaf() != positions[i] {
+				Fail(t, "topic", topic, "doesn't encode", positions[i])
+			}
+		}
+	}
+}
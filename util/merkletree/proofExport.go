@@ -0,0 +1,184 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/util"
+)
+
+// an encoded proof is its root, leaf, index, and up to 64 siblings
+const (
+	encodedProofHeaderBytes = 32 + 32 + 8
+	maxExportedProofBytes   = encodedProofHeaderBytes + 64*32
+)
+
+// Encode packs the proof as its root, leaf hash, big-endian leaf index, and siblings, back to back
+func (proof *MerkleProof) Encode() []byte {
+	data := make([]byte, 0, encodedProofHeaderBytes+32*len(proof.Proof))
+	data = append(data, proof.RootHash.Bytes()...)
+	data = append(data, proof.LeafHash.Bytes()...)
+	data = binary.BigEndian.AppendUint64(data, proof.LeafIndex)
+	for _, sibling := range proof.Proof {
+		data = append(data, sibling.Bytes()...)
+	}
+	return data
+}
+
+// DecodeMerkleProof unpacks a proof packed by Encode
+func DecodeMerkleProof(data []byte) (*MerkleProof, error) {
+	if len(data) < encodedProofHeaderBytes || (len(data)-encodedProofHeaderBytes)%32 != 0 {
+		return nil, fmt.Errorf("malformed proof of %v bytes", len(data))
+	}
+	if len(data) > maxExportedProofBytes {
+		return nil, fmt.Errorf("proof has %v siblings, more than a tree can be deep", (len(data)-encodedProofHeaderBytes)/32)
+	}
+	proof := &MerkleProof{
+		RootHash:  common.BytesToHash(data[:32]),
+		LeafHash:  common.BytesToHash(data[32:64]),
+		LeafIndex: binary.BigEndian.Uint64(data[64:encodedProofHeaderBytes]),
+		Proof:     make([]common.Hash, (len(data)-encodedProofHeaderBytes)/32),
+	}
+	for i := range proof.Proof {
+		start := encodedProofHeaderBytes + 32*i
+		proof.Proof[i] = common.BytesToHash(data[start : start+32])
+	}
+	return proof, nil
+}
+
+// a compressed proof is its root, leaf, index, number of siblings, and a bitmap of which siblings are zero,
+// followed by only the siblings that aren't
+const compressedProofHeaderBytes = encodedProofHeaderBytes + 1 + 8
+
+// EncodeCompressed packs the proof like Encode, but leaves out its zero siblings, the empty subtrees near the
+// right frontier of a tree, marking them instead with a bit each in a bitmap ahead of the remaining siblings.
+// Bit i of the big-endian bitmap is set when Proof[i] is zero. Proofs with more siblings than a tree can be deep
+// are packed so that they don't decode.
+func (proof *MerkleProof) EncodeCompressed() []byte {
+	var zeros uint64
+	for i, sibling := range proof.Proof {
+		if sibling == (common.Hash{}) {
+			zeros |= 1 << i
+		}
+	}
+	nonzero := len(proof.Proof) - bits.OnesCount64(zeros)
+	data := make([]byte, 0, compressedProofHeaderBytes+32*nonzero)
+	data = append(data, proof.RootHash.Bytes()...)
+	data = append(data, proof.LeafHash.Bytes()...)
+	data = binary.BigEndian.AppendUint64(data, proof.LeafIndex)
+	data = append(data, byte(min(len(proof.Proof), 255)))
+	data = binary.BigEndian.AppendUint64(data, zeros)
+	for _, sibling := range proof.Proof {
+		if sibling != (common.Hash{}) {
+			data = append(data, sibling.Bytes()...)
+		}
+	}
+	return data
+}
+
+// DecodeCompressedMerkleProof unpacks a proof packed by EncodeCompressed, restoring its zero siblings.
+// Each proof has only one compressed encoding, so bitmaps marking missing siblings and zero siblings that
+// weren't left out are rejected.
+func DecodeCompressedMerkleProof(data []byte) (*MerkleProof, error) {
+	if len(data) < compressedProofHeaderBytes {
+		return nil, fmt.Errorf("malformed compressed proof of %v bytes", len(data))
+	}
+	depth := int(data[encodedProofHeaderBytes])
+	if depth > 64 {
+		return nil, fmt.Errorf("proof has %v siblings, more than a tree can be deep", depth)
+	}
+	zeros := binary.BigEndian.Uint64(data[encodedProofHeaderBytes+1 : compressedProofHeaderBytes])
+	if depth < 64 && zeros>>depth != 0 {
+		return nil, fmt.Errorf("compressed proof of %v siblings marks zero siblings beyond them", depth)
+	}
+	nonzero := depth - bits.OnesCount64(zeros)
+	if len(data) != compressedProofHeaderBytes+32*nonzero {
+		return nil, fmt.Errorf("compressed proof of %v bytes should have %v nonzero siblings", len(data), nonzero)
+	}
+	proof := &MerkleProof{
+		RootHash:  common.BytesToHash(data[:32]),
+		LeafHash:  common.BytesToHash(data[32:64]),
+		LeafIndex: binary.BigEndian.Uint64(data[64:encodedProofHeaderBytes]),
+		Proof:     make([]common.Hash, depth),
+	}
+	rest := data[compressedProofHeaderBytes:]
+	for i := range proof.Proof {
+		if zeros&(1<<i) != 0 {
+			continue
+		}
+		proof.Proof[i] = common.BytesToHash(rest[:32])
+		if proof.Proof[i] == (common.Hash{}) {
+			return nil, fmt.Errorf("compressed proof includes zero sibling %v rather than marking it", i)
+		}
+		rest = rest[32:]
+	}
+	return proof, nil
+}
+
+// merkleProofJSON is how a MerkleProof appears in JSON, with its fields optional so missing ones can be caught
+type merkleProofJSON struct {
+	RootHash  *common.Hash
+	LeafHash  *common.Hash
+	LeafIndex *uint64
+	Proof     []common.Hash
+}
+
+func (proof *MerkleProof) MarshalJSON() ([]byte, error) {
+	siblings := proof.Proof
+	if siblings == nil {
+		siblings = []common.Hash{}
+	}
+	return json.Marshal(merkleProofJSON{&proof.RootHash, &proof.LeafHash, &proof.LeafIndex, siblings})
+}
+
+func (proof *MerkleProof) UnmarshalJSON(data []byte) error {
+	var decoded merkleProofJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.RootHash == nil || decoded.LeafHash == nil || decoded.LeafIndex == nil {
+		return errors.New("proof is missing its root, leaf hash, or leaf index")
+	}
+	if decoded.Proof == nil {
+		decoded.Proof = []common.Hash{}
+	}
+	*proof = MerkleProof{
+		RootHash:  *decoded.RootHash,
+		LeafHash:  *decoded.LeafHash,
+		LeafIndex: *decoded.LeafIndex,
+		Proof:     decoded.Proof,
+	}
+	return nil
+}
+
+// ExportAllProofs writes a proof of every leaf in the tree, in order, each prefixed by its length.
+// Every leaf must be provable, so the tree can't have summaries.
+func ExportAllProofs(tree MerkleTree, w io.Writer) error {
+	for leaf := uint64(0); leaf < tree.Size(); leaf++ {
+		proof, err := ProveLeaf(tree, leaf)
+		if err != nil {
+			return err
+		}
+		if err := util.BytestringToWriter(proof.Encode(), w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadExportedProof reads the next proof written by ExportAllProofs, returning io.EOF once there are none left
+func ReadExportedProof(rd io.Reader) (*MerkleProof, error) {
+	data, err := util.BytestringFromReader(rd, maxExportedProofBytes)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMerkleProof(data)
+}
@@ -0,0 +1,193 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestExportAllProofs(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 11; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	var buf bytes.Buffer
+	Require(t, ExportAllProofs(mt, &buf))
+
+	for leaf := uint64(0); leaf < 11; leaf++ {
+		proof, err := ReadExportedProof(&buf)
+		Require(t, err, "leaf", leaf)
+		if proof.LeafIndex != leaf || proof.RootHash != mt.Hash() || !proof.IsCorrect() {
+			Fail(t, "bad exported proof for leaf", leaf)
+		}
+	}
+	if _, err := ReadExportedProof(&buf); !errors.Is(err, io.EOF) {
+		Fail(t, "expected the export to end after the last leaf", err)
+	}
+
+	if err := ExportAllProofs(mt.SummarizeUpTo(8), &buf); err == nil {
+		Fail(t, "exported proofs of summarized leaves")
+	}
+}
+
+func TestEncodeMerkleProof(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(13))
+	for leaf := uint64(0); leaf < 13; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		data := proof.Encode()
+		if len(data) != 32+32+8+32*len(proof.Proof) {
+			Fail(t, "encoded proof of leaf", leaf, "has the wrong length", len(data))
+		}
+		decoded, err := DecodeMerkleProof(data)
+		Require(t, err)
+		if !reflect.DeepEqual(decoded, proof) || !decoded.IsCorrect() {
+			Fail(t, "decoded proof of leaf", leaf, "differs")
+		}
+
+		// truncating the proof either fails to decode or leaves it missing siblings
+		for cut := range data {
+			truncated, err := DecodeMerkleProof(data[:cut])
+			if err == nil && truncated.IsCorrect() {
+				Fail(t, "proof of leaf", leaf, "truncated to", cut, "bytes still verifies")
+			}
+			if err == nil && (cut < 72 || (cut-72)%32 != 0) {
+				Fail(t, "decoded a proof truncated to", cut, "bytes")
+			}
+		}
+	}
+	if _, err := DecodeMerkleProof(make([]byte, 32+32+8+65*32)); err == nil {
+		Fail(t, "decoded a proof deeper than any tree")
+	}
+}
+
+func TestMerkleProofJSON(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(5))
+	for leaf := uint64(0); leaf < 5; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		data, err := json.Marshal(proof)
+		Require(t, err)
+		var decoded MerkleProof
+		Require(t, json.Unmarshal(data, &decoded))
+		if !reflect.DeepEqual(&decoded, proof) || !decoded.IsCorrect() {
+			Fail(t, "proof of leaf", leaf, "didn't survive JSON")
+		}
+	}
+
+	data, err := json.Marshal(&MerkleProof{})
+	Require(t, err)
+	if !strings.Contains(string(data), `"Proof":[]`) {
+		Fail(t, "a proof without siblings should have an empty list of them", string(data))
+	}
+	var decoded MerkleProof
+	if err := json.Unmarshal([]byte(`{"RootHash":"0x0000000000000000000000000000000000000000000000000000000000000000","Proof":[]}`), &decoded); err == nil {
+		Fail(t, "decoded a proof missing its leaf")
+	}
+}
+
+func TestEncodeCompressedMerkleProof(t *testing.T) {
+	mt := NewMerkleTreeFromLeaves(leavesForTesting(13))
+	for leaf := uint64(0); leaf < 13; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		data := proof.EncodeCompressed()
+		decoded, err := DecodeCompressedMerkleProof(data)
+		Require(t, err, "leaf", leaf)
+		if !reflect.DeepEqual(decoded, proof) || !decoded.IsCorrect() {
+			Fail(t, "decoded compressed proof of leaf", leaf, "differs")
+		}
+		for cut := range data {
+			if _, err := DecodeCompressedMerkleProof(data[:cut]); err == nil {
+				Fail(t, "decoded a compressed proof of leaf", leaf, "truncated to", cut, "bytes")
+			}
+		}
+	}
+
+	// leaf 12 is alone past the full subtrees of 8 and 4 leaves, so its bottom two siblings are empty
+	proof, err := ProveLeaf(mt, 12)
+	Require(t, err)
+	data := proof.EncodeCompressed()
+	if len(data) >= len(proof.Encode()) {
+		Fail(t, "compressing a proof with zero siblings didn't shrink it")
+	}
+	if data[72+8] != 0b11 {
+		Fail(t, "proof of leaf 12 should mark its bottom two siblings as zero", proof.Proof)
+	}
+
+	marksMissing := bytes.Clone(data)
+	marksMissing[72+1] |= 0x80
+	if _, err := DecodeCompressedMerkleProof(marksMissing); err == nil {
+		Fail(t, "decoded a compressed proof marking a sibling beyond its depth as zero")
+	}
+	unmarked := append(bytes.Clone(data), make([]byte, 32)...)
+	unmarked[72+8] &^= 1
+	if _, err := DecodeCompressedMerkleProof(unmarked); err == nil {
+		Fail(t, "decoded a compressed proof including a zero sibling")
+	}
+	tooDeep := &MerkleProof{Proof: make([]common.Hash, 65)}
+	if _, err := DecodeCompressedMerkleProof(tooDeep.EncodeCompressed()); err == nil {
+		Fail(t, "decoded a compressed proof deeper than any tree")
+	}
+}
+
+// rightEdgeProofForTesting proves the only leaf past the full left half of a tree of capacity 1<<levels
+func rightEdgeProofForTesting(t testing.TB, levels uint64) *MerkleProof {
+	t.Helper()
+	leaves := leavesForTesting(1<<(levels-1) + 1)
+	tree := NewMerkleTreeFromLeaves(leaves).SummarizeUpTo(1 << (levels - 1))
+	if tree.Capacity() != 1<<levels {
+		t.Fatal("tree has capacity", tree.Capacity())
+	}
+	proof, err := ProveLeaf(tree, 1<<(levels-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestEncodeCompressedRightEdge(t *testing.T) {
+	proof := rightEdgeProofForTesting(t, 16)
+	data := proof.EncodeCompressed()
+	// of its 16 siblings, all but the full left half are empty
+	if len(data) != 72+1+8+32 {
+		Fail(t, "compressed proof of the right-edge leaf has", len(data), "bytes")
+	}
+	if uncompressed := len(proof.Encode()); len(data)*4 > uncompressed {
+		Fail(t, "compressed proof takes", len(data), "bytes rather than much less than", uncompressed)
+	}
+	decoded, err := DecodeCompressedMerkleProof(data)
+	Require(t, err)
+	if !reflect.DeepEqual(decoded, proof) || !decoded.IsCorrect() {
+		Fail(t, "decoded compressed proof of the right-edge leaf differs")
+	}
+}
+
+// BenchmarkEncodeCompressed reports the encoded size of a right-edge proof in a tree of capacity 2^16
+func BenchmarkEncodeCompressed(b *testing.B) {
+	proof := rightEdgeProofForTesting(b, 16)
+	for _, encoding := range []struct {
+		name   string
+		encode func() []byte
+	}{
+		{"Encode", proof.Encode},
+		{"EncodeCompressed", proof.EncodeCompressed},
+	} {
+		b.Run(encoding.name, func(b *testing.B) {
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data = encoding.encode()
+			}
+			b.ReportMetric(float64(len(data)), "bytes/proof")
+		})
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+)
+
+// WithdrawalIndex finds the leaf index of a send by its hash, as emitted in L2ToL1Tx logs
+type WithdrawalIndex interface {
+	IndexOf(sendHash common.Hash) (uint64, bool, error)
+}
+
+// MapWithdrawalIndex is an in-memory WithdrawalIndex
+type MapWithdrawalIndex map[common.Hash]uint64
+
+func (index MapWithdrawalIndex) IndexOf(sendHash common.Hash) (uint64, bool, error) {
+	leaf, ok := index[sendHash]
+	return leaf, ok, nil
+}
+
+// ProofService answers questions about sends using an index of withdrawals and the send tree's accumulator
+type ProofService struct {
+	acc   *merkleAccumulator.MerkleAccumulator
+	index WithdrawalIndex
+}
+
+func NewProofService(acc *merkleAccumulator.MerkleAccumulator, index WithdrawalIndex) *ProofService {
+	return &ProofService{
+		acc:   acc,
+		index: index,
+	}
+}
+
+// Locate finds the leaf index of the send, and whether the accumulator has caught up enough to prove it.
+// Sends the index doesn't know are reported as not provable.
+func (s *ProofService) Locate(sendHash common.Hash) (index uint64, provable bool, err error) {
+	leaf, ok, err := s.index.IndexOf(sendHash)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	size, err := s.acc.Size()
+	if err != nil {
+		return 0, false, err
+	}
+	return leaf, leaf < size, nil
+}
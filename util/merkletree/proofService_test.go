@@ -0,0 +1,34 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"testing"
+)
+
+func TestProofServiceLocate(t *testing.T) {
+	_, logs := sendTreeForTesting(t, 12)
+	index := MapWithdrawalIndex{}
+	for _, log := range logs {
+		if log.Topics[0] == withdrawTopicForTesting {
+			index[log.Topics[2]] = PositionTopic(log.Topics[3]).Leaf()
+		}
+	}
+
+	// the accumulator lags the index
+	acc, _ := sendTreeForTesting(t, 8)
+	service := NewProofService(acc, index)
+	for i := uint64(0); i < 12; i++ {
+		leaf, provable, err := service.Locate(pseudorandomForTesting(i))
+		Require(t, err)
+		if leaf != i || provable != (i < 8) {
+			Fail(t, "send", i, "located at", leaf, "provable", provable)
+		}
+	}
+	_, provable, err := service.Locate(pseudorandomForTesting(1000))
+	Require(t, err)
+	if provable {
+		Fail(t, "unknown send is provable")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// describeNode labels a node by its type, level, and capacity, along with its size if it's partially filled
+func describeNode(tree MerkleTree) string {
+	kind := fmt.Sprintf("%T", tree)
+	switch tree.(type) {
+	case *merkleTreeLeaf:
+		kind = "leaf"
+	case *merkleEmpty:
+		kind = "∅"
+	case *merkleInternal, *merklePadded:
+		kind = "internal"
+	case *merkleCompleteSubtreeSummary:
+		kind = "summary"
+	}
+	level := arbmath.Log2ceil(tree.Capacity()) - 1
+	label := fmt.Sprintf("%v level %v capacity %v", kind, level, tree.Capacity())
+	if size := tree.Size(); size != 0 && size != tree.Capacity() {
+		label += fmt.Sprintf(" size %v", size)
+	}
+	return label
+}
+
+// renderTree implements MerkleTree's String. Empty subtrees hash to zero and are drawn as a single node,
+// however large, so only the leaves appended show up in tall trees.
+func renderTree(tree MerkleTree) string {
+	var sb strings.Builder
+	var render func(tree MerkleTree, depth int)
+	render = func(tree MerkleTree, depth int) {
+		sb.WriteString(strings.Repeat("  ", depth))
+		sb.WriteString(describeNode(tree))
+		if _, ok := tree.(*merkleEmpty); !ok {
+			sb.WriteString(" " + tree.Hash().Hex())
+		}
+		sb.WriteString("\n")
+		if node, ok := internalNode(tree); ok {
+			render(node.left, depth+1)
+			render(node.right, depth+1)
+		}
+	}
+	render(tree, 0)
+	return sb.String()
+}
+
+// DumpDOT writes the tree as a Graphviz digraph for inspecting it visually, with nodes labeled as in String
+// but with their hashes abbreviated
+func DumpDOT(tree MerkleTree, w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph merkletree {\n\tnode [shape=box];"); err != nil {
+		return err
+	}
+	nodes := 0
+	var dump func(tree MerkleTree) (int, error)
+	dump = func(tree MerkleTree) (int, error) {
+		id := nodes
+		nodes++
+		var err error
+		if _, ok := tree.(*merkleEmpty); ok {
+			_, err = fmt.Fprintf(w, "\tn%v [label=%q, shape=circle];\n", id, "∅")
+		} else {
+			hex := tree.Hash().Hex()
+			label := describeNode(tree) + "\n" + hex[:8] + "…" + hex[len(hex)-6:]
+			_, err = fmt.Fprintf(w, "\tn%v [label=%q];\n", id, label)
+		}
+		if err != nil {
+			return 0, err
+		}
+		node, ok := internalNode(tree)
+		if !ok {
+			return id, nil
+		}
+		for _, child := range []MerkleTree{node.left, node.right} {
+			childID, err := dump(child)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := fmt.Fprintf(w, "\tn%v -> n%v;\n", id, childID); err != nil {
+				return 0, err
+			}
+		}
+		return id, nil
+	}
+	if _, err := dump(tree); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
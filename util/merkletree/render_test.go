@@ -0,0 +1,30 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderGoldens(t *testing.T) {
+	tree := NewMerkleTreeFromLeaves(leavesForTesting(5))
+	compareBytesToGolden(t, []byte(tree.String()), filepath.Join("testdata", "tree_size5.txt"))
+
+	var dot bytes.Buffer
+	Require(t, DumpDOT(tree.SummarizeUpTo(4), &dot))
+	compareBytesToGolden(t, dot.Bytes(), filepath.Join("testdata", "tree_size5_summarized.dot"))
+
+	// empty subtrees aren't expanded, so a tall tree with one leaf has a line for it and two for each level above
+	tall := NewMerkleEmpty(1 << 20).Append(pseudorandomForTesting(0))
+	lines := strings.Split(strings.TrimSuffix(tall.String(), "\n"), "\n")
+	if len(lines) != 41 {
+		Fail(t, "expected 41 lines, got", len(lines))
+	}
+	if last := lines[len(lines)-1]; last != "  ∅ level 19 capacity 524288" {
+		Fail(t, "the empty half of the tree isn't a single node", last)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+)
+
+// ProofRoot is a historical root of the send tree, taken when it had Size leaves
+type ProofRoot struct {
+	Root common.Hash
+	Size uint64
+}
+
+// RootHistory records the roots of a growing send tree, oldest first
+type RootHistory struct {
+	roots []ProofRoot
+}
+
+// Add records the tree's root at the given size, which can't be smaller than that of any root already recorded
+func (h *RootHistory) Add(root common.Hash, size uint64) error {
+	if len(h.roots) > 0 {
+		last := h.roots[len(h.roots)-1]
+		if size < last.Size {
+			return fmt.Errorf("root for size %v added after one for size %v", size, last.Size)
+		}
+		if size == last.Size {
+			if root != last.Root {
+				return fmt.Errorf("conflicting roots %v and %v for size %v", last.Root, root, size)
+			}
+			return nil
+		}
+	}
+	h.roots = append(h.roots, ProofRoot{root, size})
+	return nil
+}
+
+// Roots returns a copy of the roots recorded, oldest first, so that appending to it or changing it doesn't
+// change the history
+func (h *RootHistory) Roots() []ProofRoot {
+	return append([]ProofRoot{}, h.roots...)
+}
+
+// RootsProving returns a copy of the roots of trees large enough to include the given leaf
+func (h *RootHistory) RootsProving(leaf uint64) []ProofRoot {
+	first := sort.Search(len(h.roots), func(i int) bool {
+		return h.roots[i].Size > leaf
+	})
+	return append([]ProofRoot{}, h.roots[first:]...)
+}
+
+// PartialsHistory records snapshots of an accumulator's partials by size, from which its root at each of those
+// sizes can be recomputed. A snapshot is at most 64 hashes, far less than keeping a whole accumulator around.
+type PartialsHistory struct {
+	snapshots map[uint64][]common.Hash
+}
+
+func NewPartialsHistory() *PartialsHistory {
+	return &PartialsHistory{
+		snapshots: make(map[uint64][]common.Hash),
+	}
+}
+
+// Record snapshots the accumulator's partials at its current size
+func (h *PartialsHistory) Record(acc *merkleAccumulator.MerkleAccumulator) error {
+	size, _, partials, err := acc.StateForExport()
+	if err != nil {
+		return err
+	}
+	h.snapshots[size] = partials
+	return nil
+}
+
+// RootAt recomputes the root of the tree when it had the given size, which must have been recorded
+func (h *PartialsHistory) RootAt(size uint64) (common.Hash, error) {
+	partials, ok := h.snapshots[size]
+	if !ok {
+		return common.Hash{}, fmt.Errorf("no partials recorded for size %v", size)
+	}
+	acc, err := accumulatorFromPartials(partials, size, Keccak256Hasher)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return acc.Root()
+}
+
+// ProveAcrossRoots proves the leaf against each of the roots, which must be past versions of the tree.
+// Proofs are built by up to concurrency goroutines at once, sharing the tree, which is only read.
+func ProveAcrossRoots(leaf uint64, roots []ProofRoot, tree MerkleTree, concurrency int) (map[common.Hash]*MerkleProof, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	proofs := make([]*MerkleProof, len(roots))
+	errs := make([]error, len(roots))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				proofs[j], errs[j] = ProveLeafAtSize(tree, leaf, roots[j].Size)
+			}
+		}()
+	}
+	for i := range roots {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	result := make(map[common.Hash]*MerkleProof, len(roots))
+	for i, root := range roots {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("failed to prove leaf %v against the root of size %v: %w", leaf, root.Size, errs[i])
+		}
+		if proofs[i].RootHash != root.Root {
+			return nil, fmt.Errorf("tree at size %v has root %v rather than %v", root.Size, proofs[i].RootHash, root.Root)
+		}
+		result[root.Root] = proofs[i]
+	}
+	return result, nil
+}
+
+// HistoryDivergenceError reports the first size at which replaying appends produced a root other than the
+// one the history expects
+type HistoryDivergenceError struct {
+	Size     uint64
+	Expected common.Hash
+	Actual   common.Hash
+}
+
+func (e *HistoryDivergenceError) Error() string {
+	return fmt.Sprintf("root at size %v is %v rather than %v", e.Size, e.Actual, e.Expected)
+}
+
+// VerifyAgainstHistory replays appending the send hashes to a clone of the accumulator, checking the root at each
+// size the history has an entry for, and returns a *HistoryDivergenceError for the smallest size that disagrees.
+// Every entry must be for a size the replay passes through, from the accumulator's own size to its size once
+// all the hashes are appended. It lives here rather than on the accumulator, which can't depend on ProofRoot.
+func VerifyAgainstHistory(acc *merkleAccumulator.MerkleAccumulator, sendHashes []common.Hash, history []ProofRoot) error {
+	replay, err := acc.NonPersistentClone()
+	if err != nil {
+		return err
+	}
+	start, err := replay.Size()
+	if err != nil {
+		return err
+	}
+	entries := append([]ProofRoot{}, history...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Size < entries[j].Size
+	})
+	if len(entries) > 0 {
+		if first := entries[0].Size; first < start {
+			return fmt.Errorf("history has size %v, before the accumulator's size %v", first, start)
+		}
+		if last := entries[len(entries)-1].Size; last > start+uint64(len(sendHashes)) {
+			return fmt.Errorf("history has size %v, beyond the %v leaves replayed", last, start+uint64(len(sendHashes)))
+		}
+	}
+
+	next := 0
+	for size := start; next < len(entries); size++ {
+		if size > start {
+			if _, err := replay.Append(sendHashes[size-start-1]); err != nil {
+				return err
+			}
+		}
+		if entries[next].Size != size {
+			continue
+		}
+		root, err := replay.Root()
+		if err != nil {
+			return err
+		}
+		for ; next < len(entries) && entries[next].Size == size; next++ {
+			if entries[next].Root != root {
+				return &HistoryDivergenceError{size, entries[next].Root, root}
+			}
+		}
+	}
+	return nil
+}
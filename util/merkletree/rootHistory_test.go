@@ -0,0 +1,169 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRootsProving(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	history := &RootHistory{}
+	for i := uint64(0); i < 12; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+		if i%3 == 0 {
+			Require(t, history.Add(root(t, acc), size(t, acc)))
+		}
+	}
+	// sizes 1, 4, 7, and 10 were recorded
+
+	for leaf := uint64(0); leaf < 12; leaf++ {
+		eligible := history.RootsProving(leaf)
+		expected := 0
+		for _, root := range history.Roots() {
+			if root.Size > leaf {
+				expected++
+			}
+		}
+		if len(eligible) != expected {
+			Fail(t, "wrong number of roots for leaf", leaf, len(eligible), expected)
+		}
+		for _, root := range eligible {
+			if root.Size <= leaf {
+				Fail(t, "root of size", root.Size, "can't prove leaf", leaf)
+			}
+		}
+	}
+	if len(history.RootsProving(10)) != 0 {
+		Fail(t, "no recorded root is large enough to prove leaf 10")
+	}
+
+	// changing the roots returned doesn't change the history
+	roots := history.Roots()
+	roots[0] = ProofRoot{}
+	proving := history.RootsProving(0)
+	proving[0] = ProofRoot{}
+	if history.Roots()[0].Size != 1 || history.RootsProving(0)[0].Size != 1 {
+		Fail(t, "changing the returned roots changed the history")
+	}
+
+	if err := history.Add(root(t, acc), 5); err == nil {
+		Fail(t, "added an older root out of order")
+	}
+	if err := history.Add(pseudorandomForTesting(100), 10); err == nil {
+		Fail(t, "added a conflicting root")
+	}
+}
+
+func TestPartialsHistoryRootAt(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	history := NewPartialsHistory()
+	live := make(map[uint64]common.Hash)
+	for i := uint64(0); i < 20; i++ {
+		Require(t, history.Record(acc))
+		live[size(t, acc)] = root(t, acc)
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	for size, expected := range live {
+		root, err := history.RootAt(size)
+		Require(t, err)
+		if root != expected {
+			Fail(t, "historical root differs at size", size)
+		}
+	}
+	if _, err := history.RootAt(20); err == nil {
+		Fail(t, "got a root for a size that wasn't recorded")
+	}
+}
+
+func TestProveAcrossRoots(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	mt := NewEmptyMerkleTree()
+	roots := []ProofRoot{}
+	for i := uint64(0); i < 37; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+		mt = mt.Append(pseudorandomForTesting(i))
+		if i >= 5 {
+			roots = append(roots, ProofRoot{root(t, acc), size(t, acc)})
+		}
+	}
+	for _, concurrency := range []int{1, 4, 64} {
+		proofs, err := ProveAcrossRoots(5, roots, mt, concurrency)
+		Require(t, err)
+		if len(proofs) != len(roots) {
+			Fail(t, "got", len(proofs), "proofs for", len(roots), "roots")
+		}
+		for _, root := range roots {
+			proof := proofs[root.Root]
+			if proof == nil || proof.RootHash != root.Root || proof.LeafIndex != 5 || !proof.IsCorrect() {
+				Fail(t, "bad proof against the root of size", root.Size, "with concurrency", concurrency)
+			}
+		}
+	}
+
+	// the leaf must be in every version of the tree
+	if _, err := ProveAcrossRoots(10, roots, mt, 4); err == nil {
+		Fail(t, "proved a leaf against roots from before it was added")
+	}
+	wrong := append([]ProofRoot{}, roots...)
+	wrong[3].Root = pseudorandomForTesting(1000)
+	if _, err := ProveAcrossRoots(5, wrong, mt, 4); err == nil {
+		Fail(t, "proved a leaf against a root the tree never had")
+	}
+}
+
+func TestVerifyAgainstHistory(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 3; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	start := root(t, acc)
+	replayed, err := acc.NonPersistentClone()
+	Require(t, err)
+	sendHashes := []common.Hash{}
+	history := []ProofRoot{{start, 3}}
+	for i := uint64(3); i < 20; i++ {
+		sendHashes = append(sendHashes, pseudorandomForTesting(i))
+		accAppend(t, replayed, pseudorandomForTesting(i))
+		if i%4 == 0 || i == 19 {
+			history = append(history, ProofRoot{root(t, replayed), size(t, replayed)})
+		}
+	}
+	Require(t, VerifyAgainstHistory(acc, sendHashes, history))
+	Require(t, VerifyAgainstHistory(acc, sendHashes, nil))
+	if size(t, acc) != 3 || root(t, acc) != start {
+		Fail(t, "verifying modified the accumulator")
+	}
+
+	// the first divergent size is reported, even when later ones diverge too
+	diverging := append([]ProofRoot{}, history...)
+	diverging[2].Root = pseudorandomForTesting(1000)
+	diverging[4].Root = pseudorandomForTesting(1001)
+	err = VerifyAgainstHistory(acc, sendHashes, diverging)
+	var divergence *HistoryDivergenceError
+	if !errors.As(err, &divergence) {
+		Fail(t, "wrong error for divergent history", err)
+	}
+	if divergence.Size != diverging[2].Size || divergence.Expected != diverging[2].Root || divergence.Actual != history[2].Root {
+		Fail(t, "wrong divergence reported", divergence)
+	}
+
+	// a leaf that was replaced moves the divergence to the size that includes it
+	tampered := append([]common.Hash{}, sendHashes...)
+	tampered[7] = pseudorandomForTesting(1000)
+	err = VerifyAgainstHistory(acc, tampered, history)
+	if !errors.As(err, &divergence) || divergence.Size != 13 {
+		Fail(t, "the leaf making size 11 was replaced, so the next recorded size 13 should diverge", err)
+	}
+
+	if err := VerifyAgainstHistory(acc, sendHashes, []ProofRoot{{start, 2}}); err == nil {
+		Fail(t, "checked a size before the accumulator's")
+	}
+	if err := VerifyAgainstHistory(acc, sendHashes[:5], history); err == nil {
+		Fail(t, "checked a size beyond the replayed leaves")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// VerifyAgainstPartials checks a proof against the root of the tree with the given partials and size,
+// letting verifiers that only store an accumulator's partials check proofs. The partials are taken to be made with
+// the proof's hasher. As with VerifyAgainstRootMap, the number of siblings must match the size, so that a node
+// above the leaves can't pass as one.
+func VerifyAgainstPartials(partials []common.Hash, size uint64, proof *MerkleProof) error {
+	acc, err := accumulatorFromPartials(partials, size, proof.Hasher())
+	if err != nil {
+		return err
+	}
+	if err := checkProofDepth(size, proof.LeafIndex, len(proof.Proof)); err != nil {
+		return err
+	}
+	root, err := acc.Root()
+	if err != nil {
+		return err
+	}
+	if proof.RootHash != root {
+		return fmt.Errorf("proof is for root %v rather than the partials' root %v", proof.RootHash, root)
+	}
+	if !proof.IsCorrect() {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// ErrUnknownSize is returned by VerifyAgainstRootMap when no root is stored for the tree size
+var ErrUnknownSize = errors.New("no root for the tree size")
+
+// VerifyAgainstRootMap checks the proof of the leaf, whose hash is as it appears in the tree, against the root
+// stored for the size of the tree, as services that keep roots keyed by size have them
+func VerifyAgainstRootMap(roots map[uint64]common.Hash, size, leafIndex uint64, leafHash common.Hash, proof []common.Hash) error {
+	root, ok := roots[size]
+	if !ok {
+		return fmt.Errorf("%w %v", ErrUnknownSize, size)
+	}
+	return verifyLeaf(root, size, leafIndex, leafHash, proof)
+}
+
+// verifyLeaf checks the proof of the leaf, whose hash is as it appears in the tree, against the root of the
+// tree of the given size, which the number of siblings must match
+func verifyLeaf(root common.Hash, size, leafIndex uint64, leafHash common.Hash, proof []common.Hash) error {
+	if err := checkProofDepth(size, leafIndex, len(proof)); err != nil {
+		return err
+	}
+	merkleProof := &MerkleProof{
+		RootHash:  root,
+		LeafHash:  leafHash,
+		LeafIndex: leafIndex,
+		Proof:     proof,
+	}
+	if !merkleProof.IsCorrect() {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// checkProofDepth checks the leaf is in the tree of the given size and its proof has a sibling for each level
+// of that tree
+func checkProofDepth(size, leafIndex uint64, siblings int) error {
+	if leafIndex >= size {
+		return fmt.Errorf("leaf %v isn't in a tree of size %v", leafIndex, size)
+	}
+	if expected := ProofHashOps(size, leafIndex); siblings != expected {
+		return fmt.Errorf("proof has %v siblings rather than the %v a tree of size %v needs", siblings, expected, size)
+	}
+	return nil
+}
+
+// accumulatorFromPartials loads the partials into a non-persistent accumulator combining nodes with the hasher,
+// checking they're for the given size
+func accumulatorFromPartials(partials []common.Hash, size uint64, hasher Hasher) (*merkleAccumulator.MerkleAccumulator, error) {
+	acc, err := merkleAccumulator.NewNonpersistentMerkleAccumulatorFromPartialsWithHasher(partials, hasher)
+	if err != nil {
+		return nil, err
+	}
+	accSize, err := acc.Size()
+	if err != nil {
+		return nil, err
+	}
+	if accSize != size {
+		return nil, fmt.Errorf("partials are for a tree of size %v rather than %v", accSize, size)
+	}
+	return acc, nil
+}
+
+// VerifySubtreeInclusion checks that subtreeRoot is the node at the given position of the tree with parentRoot,
+// where proof holds the node's siblings bottom-up from its level. A leaf is the level 0 case.
+func VerifySubtreeInclusion(parentRoot common.Hash, subtreeRoot common.Hash, position LevelAndLeaf, proof []common.Hash) error {
+	if position.Level >= 64 {
+		return fmt.Errorf("level %v is too deep for the tree", position.Level)
+	}
+	subtreeProof := MerkleProof{
+		RootHash:  parentRoot,
+		LeafHash:  subtreeRoot,
+		LeafIndex: position.Leaf >> position.Level,
+		Proof:     proof,
+	}
+	if !subtreeProof.IsCorrect() {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyAppendProof checks a proof that nextHash is the next item appended to an accumulator, where Proof holds
+// the accumulator's partials as they were before the append.
+//
+// The partials are exactly the next leaf's siblings: a level's partial is set when the next leaf is in the right
+// half of the subtree at that level, and is empty when its sibling is the empty subtree to its right.
+// So IsCorrect folds them correctly too; what it can't tell is whether the proof is an append at all.
+// This additionally checks that the partials are shaped like those of a tree of LeafIndex leaves.
+func VerifyAppendProof(proof *MerkleProof, nextHash common.Hash) error {
+	if proof.LeafHash != crypto.Keccak256Hash(nextHash.Bytes()) {
+		return fmt.Errorf("proof is for leaf %v rather than the hash of %v", proof.LeafHash, nextHash)
+	}
+	return verifyAppendProof(proof)
+}
+
+// verifyAppendProof is VerifyAppendProof for whatever leaf the proof is of
+func verifyAppendProof(proof *MerkleProof) error {
+	numPartials := merkleAccumulator.CalcNumPartials(proof.LeafIndex)
+	if uint64(len(proof.Proof)) != numPartials {
+		return fmt.Errorf("proof has %v partials but an accumulator of size %v has %v", len(proof.Proof), proof.LeafIndex, numPartials)
+	}
+	for level, partial := range proof.Proof {
+		if (proof.LeafIndex&(1<<level) != 0) != (partial != common.Hash{}) {
+			return fmt.Errorf("partial at level %v doesn't match an accumulator of size %v", level, proof.LeafIndex)
+		}
+	}
+	if !proof.IsCorrect() {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyAppendChain checks a sequence of append proofs, each as VerifyAppendProof would, and that they're for
+// consecutive leaves with each proof's partials being those the previous append left behind
+func VerifyAppendChain(proofs []*MerkleProof) error {
+	for i, proof := range proofs {
+		if err := verifyAppendProof(proof); err != nil {
+			return fmt.Errorf("append proof %v: %w", i, err)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := proofs[i-1]
+		if proof.LeafIndex != prev.LeafIndex+1 {
+			return fmt.Errorf("append proof %v is for leaf %v rather than %v", i, proof.LeafIndex, prev.LeafIndex+1)
+		}
+		expected := appendToPartials(prev.Proof, prev.LeafHash, prev.Hasher())
+		for level := range expected {
+			if proof.Proof[level] != expected[level] {
+				return fmt.Errorf("append proof %v doesn't follow from the previous one at level %v", i, level)
+			}
+		}
+	}
+	return nil
+}
+
+// appendToPartials finds the partials after appending a leaf, already hashed, the way an accumulator combining
+// nodes with the hasher does
+func appendToPartials(partials []common.Hash, leafHash common.Hash, hasher Hasher) []common.Hash {
+	result := make([]common.Hash, len(partials))
+	copy(result, partials)
+	soFar := leafHash
+	for level := range result {
+		if result[level] == (common.Hash{}) {
+			result[level] = soFar
+			return result
+		}
+		soFar = hasher(result[level], soFar)
+		result[level] = common.Hash{}
+	}
+	return append(result, soFar)
+}
+
+// HashMode is a convention for combining a node with its sibling when verifying a proof
+type HashMode uint8
+
+const (
+	// HashModePositional puts the left node first, as the outbox and IsCorrect do
+	HashModePositional HashMode = iota
+	// HashModeSorted puts the smaller hash first regardless of position, as some other merkle libraries do
+	HashModeSorted
+)
+
+func (mode HashMode) String() string {
+	switch mode {
+	case HashModePositional:
+		return "positional"
+	case HashModeSorted:
+		return "sorted"
+	default:
+		return fmt.Sprintf("HashMode(%d)", uint8(mode))
+	}
+}
+
+// VerifyAutoDetect tries each known hash mode, positional first, and returns the one the proof verifies under.
+// It's meant for debugging proofs from other clients; the outbox only accepts positional proofs.
+func VerifyAutoDetect(root, leafHash common.Hash, leafIndex uint64, siblings []common.Hash) (mode HashMode, err error) {
+	positional := MerkleProof{
+		RootHash:  root,
+		LeafHash:  leafHash,
+		LeafIndex: leafIndex,
+		Proof:     siblings,
+	}
+	if positional.IsCorrect() {
+		return HashModePositional, nil
+	}
+	hash := leafHash
+	for _, sibling := range siblings {
+		if bytes.Compare(hash.Bytes(), sibling.Bytes()) <= 0 {
+			hash = crypto.Keccak256Hash(hash.Bytes(), sibling.Bytes())
+		} else {
+			hash = crypto.Keccak256Hash(sibling.Bytes(), hash.Bytes())
+		}
+	}
+	if hash == root {
+		return HashModeSorted, nil
+	}
+	return 0, ErrInvalidProof
+}
+
+// CanonicalizeProof normalizes a proof from an untrusted source to the form this package builds: siblings
+// bottom-up, one per level of the tree of the given size, with empty subtrees as zero hashes. It undoes
+// trailing zero padding, a top-down ordering, and omitted empty siblings, erroring with ErrInvalidProof if no
+// normalization verifies. The input isn't modified.
+func CanonicalizeProof(p *MerkleProof, treeSize uint64) (*MerkleProof, error) {
+	if p.LeafIndex >= treeSize {
+		return nil, fmt.Errorf("leaf %v isn't in a tree of size %v", p.LeafIndex, treeSize)
+	}
+	expected := ProofHashOps(treeSize, p.LeafIndex)
+	reversed := make([]common.Hash, len(p.Proof))
+	for i, sibling := range p.Proof {
+		reversed[len(p.Proof)-1-i] = sibling
+	}
+	for _, siblings := range [][]common.Hash{p.Proof, reversed} {
+		for len(siblings) > expected && siblings[len(siblings)-1] == (common.Hash{}) {
+			siblings = siblings[:len(siblings)-1]
+		}
+		candidate := &MerkleProof{
+			RootHash:  p.RootHash,
+			LeafHash:  p.LeafHash,
+			LeafIndex: p.LeafIndex,
+			Proof:     append([]common.Hash{}, siblings...),
+			hasher:    p.hasher,
+		}
+		if len(siblings) < expected {
+			var err error
+			candidate, err = ExpandEmptySiblings(candidate, treeSize)
+			if err != nil {
+				continue
+			}
+		}
+		if len(candidate.Proof) == expected && candidate.IsCorrect() {
+			return candidate, nil
+		}
+	}
+	return nil, ErrInvalidProof
+}
+
+// InferTreeSize guesses the size of the tree a proof is for from its number of siblings, which gives the tree's
+// height, and its zero siblings, which mark empty subtrees. The largest consistent size is returned, along with
+// whether it's the only one. A real subtree never hashes to zero, so the end of the tree can only be pinned down
+// where the proof passes an empty subtree or the leaf is at the end, as the last leaf always is.
+// Balanced trees are always inferred correctly, if not always unambiguously.
+func InferTreeSize(leafIndex uint64, proof []common.Hash) (uint64, bool) {
+	height := len(proof)
+	if height > 64 || height < 64 && leafIndex >= 1<<height {
+		return 0, false
+	}
+	// the size is in [lowest, highest]
+	lowest, highest := leafIndex+1, uint64(math.MaxUint64)
+	if height < 64 {
+		highest = 1 << height
+	}
+	if height > 0 && lowest <= 1<<(height-1) {
+		lowest = 1<<(height-1) + 1
+	}
+	for level, sibling := range proof {
+		if leafIndex&(1<<level) != 0 {
+			// siblings to the left are complete
+			if sibling == (common.Hash{}) {
+				return 0, false
+			}
+			continue
+		}
+		start := (leafIndex>>level | 1) << level // the first leaf of the sibling to the right
+		if sibling == (common.Hash{}) {
+			highest = arbmath.MinInt(highest, start)
+		} else {
+			lowest = arbmath.MaxInt(lowest, start+1)
+		}
+	}
+	if lowest > highest {
+		return 0, false
+	}
+	return highest, lowest == highest
+}
@@ -0,0 +1,58 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+var ErrInvalidProof = errors.New("merkle proof is not correct")
+
+// VerifyCache remembers proofs that have already verified, so that checking the same proof again
+// (as a relayer retrying a submission will) doesn't recompute the path to the root.
+// Only good proofs are cached, so an invalid proof is rechecked every time. Proofs with a hasher other than
+// Keccak256 are neither cached nor looked up, as their IDs don't commit to the hasher.
+// Safe for concurrent use.
+type VerifyCache struct {
+	mutex     sync.Mutex
+	verified  *containers.LruCache[common.Hash, struct{}]
+	isCorrect func(*MerkleProof) bool
+}
+
+func NewVerifyCache(size int) *VerifyCache {
+	return &VerifyCache{
+		verified:  containers.NewLruCache[common.Hash, struct{}](size),
+		isCorrect: (*MerkleProof).IsCorrect,
+	}
+}
+
+func (c *VerifyCache) Verify(proof *MerkleProof) error {
+	if proof.hasher != nil {
+		if !c.isCorrect(proof) {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+	key := proof.ID()
+
+	c.mutex.Lock()
+	seen := c.verified.Contains(key)
+	c.mutex.Unlock()
+	if seen {
+		return nil
+	}
+
+	if !c.isCorrect(proof) {
+		return ErrInvalidProof
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.verified.Add(key, struct{}{})
+	return nil
+}
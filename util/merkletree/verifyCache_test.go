@@ -0,0 +1,52 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyCache(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 5; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	proof, err := ProofFromAccumulator(acc, pseudorandomForTesting(5))
+	Require(t, err)
+
+	cache := NewVerifyCache(16)
+	verifications := 0
+	cache.isCorrect = func(proof *MerkleProof) bool {
+		verifications++
+		return proof.IsCorrect()
+	}
+
+	Require(t, cache.Verify(proof))
+	Require(t, cache.Verify(proof))
+	if verifications != 1 {
+		Fail(t, "repeated proof was verified", verifications, "times")
+	}
+
+	bad := *proof
+	bad.LeafIndex += 1
+	for i := 0; i < 2; i++ {
+		if err := cache.Verify(&bad); !errors.Is(err, ErrInvalidProof) {
+			Fail(t, "bad proof accepted", err)
+		}
+	}
+	if verifications != 3 {
+		Fail(t, "bad proofs shouldn't be cached", verifications)
+	}
+
+	// the same proof under another hasher shares its ID, but must not hit the cache
+	other := *proof
+	other.hasher = sha256HasherForTesting
+	if err := cache.Verify(&other); !errors.Is(err, ErrInvalidProof) {
+		Fail(t, "proof with another hasher accepted from the cache", err)
+	}
+	if verifications != 4 {
+		Fail(t, "proofs with another hasher should always be verified", verifications)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+func TestVerifyAgainstPartials(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 9; i++ {
+		proof, err := ProofFromAccumulator(acc, pseudorandomForTesting(i))
+		Require(t, err)
+		accAppend(t, acc, pseudorandomForTesting(i))
+
+		size, _, partials, err := acc.StateForExport()
+		Require(t, err)
+		Require(t, VerifyAgainstPartials(partials, size, proof), "size", size)
+
+		// a proof from another state must be rejected
+		accAppend(t, acc, pseudorandomForTesting(1000+i))
+		size, _, partials, err = acc.StateForExport()
+		Require(t, err)
+		if err := VerifyAgainstPartials(partials, size, proof); err == nil {
+			Fail(t, "accepted a proof from a different state", size)
+		}
+		if err := VerifyAgainstPartials(partials, size+1, proof); err == nil {
+			Fail(t, "accepted partials for the wrong size", size)
+		}
+		acc = initializedMerkleAccumulatorForTesting()
+		for j := uint64(0); j <= i; j++ {
+			accAppend(t, acc, pseudorandomForTesting(j))
+		}
+	}
+
+	// the node above the first two leaves, with the one to its right as its sibling, isn't a leaf
+	tree := NewMerkleTreeFromLeaves(leavesForTesting(4))
+	node := tree.(*merkleInternal).left
+	sibling := tree.(*merkleInternal).right
+	internal := &MerkleProof{RootHash: tree.Hash(), LeafHash: node.Hash(), LeafIndex: 0, Proof: []common.Hash{sibling.Hash()}}
+	if !internal.IsCorrect() {
+		Fail(t, "expected the internal node's proof to fold to the root")
+	}
+	acc = initializedMerkleAccumulatorForTesting()
+	for _, leaf := range leavesForTesting(4) {
+		accAppend(t, acc, leaf)
+	}
+	partials, err := acc.Partials()
+	Require(t, err)
+	if err := VerifyAgainstPartials(partials, 4, internal); err == nil {
+		Fail(t, "accepted an internal node as a leaf")
+	}
+}
+
+func TestVerifyAgainstRootMap(t *testing.T) {
+	roots := make(map[uint64]common.Hash)
+	leaves := []common.Hash{}
+	for size := uint64(1); size <= 12; size++ {
+		leaves = append(leaves, pseudorandomForTesting(size))
+		if size%3 != 0 {
+			roots[size] = NewMerkleTreeFromLeaves(leaves).Hash()
+		}
+	}
+	mt := NewMerkleTreeFromLeaves(leaves[:8])
+	for leaf := uint64(0); leaf < 8; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		Require(t, VerifyAgainstRootMap(roots, 8, leaf, proof.LeafHash, proof.Proof), "leaf", leaf)
+
+		if err := VerifyAgainstRootMap(roots, 7, leaf, proof.LeafHash, proof.Proof); err == nil {
+			Fail(t, "accepted a proof against the root of another size", leaf)
+		}
+		if err := VerifyAgainstRootMap(roots, 8, leaf, pseudorandomForTesting(1000), proof.Proof); !errors.Is(err, ErrInvalidProof) {
+			Fail(t, "wrong error for a bad leaf", leaf, err)
+		}
+		if err := VerifyAgainstRootMap(roots, 9, leaf, proof.LeafHash, proof.Proof); !errors.Is(err, ErrUnknownSize) {
+			Fail(t, "wrong error for a size with no root", leaf, err)
+		}
+	}
+	if err := VerifyAgainstRootMap(roots, 4, 4, common.Hash{}, nil); err == nil || errors.Is(err, ErrUnknownSize) {
+		Fail(t, "wrong error for a leaf beyond the tree", err)
+	}
+}
+
+func TestVerifySubtreeInclusion(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 13; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	for first := uint64(0); first+4 <= 13; first += 4 {
+		subtree := NewEmptyMerkleTree()
+		for i := first; i < first+4; i++ {
+			subtree = subtree.Append(pseudorandomForTesting(i))
+		}
+		leafProof, err := ProveLeaf(mt, first)
+		Require(t, err)
+		proof := leafProof.Proof[2:]
+
+		position := NewLevelAndLeaf(2, first+3)
+		Require(t, VerifySubtreeInclusion(mt.Hash(), subtree.Hash(), position, proof), "subtree at", first)
+
+		wrongPosition := NewLevelAndLeaf(2, (first+7)%16)
+		if err := VerifySubtreeInclusion(mt.Hash(), subtree.Hash(), wrongPosition, proof); err == nil {
+			Fail(t, "accepted a subtree at the wrong position", first)
+		}
+		if err := VerifySubtreeInclusion(mt.Hash(), subtree.Hash(), NewLevelAndLeaf(1, first+3), proof); err == nil {
+			Fail(t, "accepted a subtree at the wrong level", first)
+		}
+	}
+}
+
+func TestVerifyAppendProof(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 13; i++ {
+		next := pseudorandomForTesting(i)
+		proof, err := ProofFromAccumulator(acc, next)
+		Require(t, err)
+		Require(t, VerifyAppendProof(proof, next), "size", i)
+		if err := VerifyAppendProof(proof, pseudorandomForTesting(1000+i)); err == nil {
+			Fail(t, "accepted an append proof for the wrong item", i)
+		}
+		accAppend(t, acc, next)
+		mt = mt.Append(next)
+	}
+
+	// sibling-chain proofs of leaves other than the last aren't appends, even though they're correct
+	for leaf := uint64(0); leaf < 12; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		if !proof.IsCorrect() {
+			Fail(t, "bad sibling-chain proof", leaf)
+		}
+		if err := VerifyAppendProof(proof, pseudorandomForTesting(leaf)); err == nil {
+			Fail(t, "accepted a sibling-chain proof as an append", leaf)
+		}
+	}
+}
+
+func TestVerifyAutoDetect(t *testing.T) {
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < 11; i++ {
+		mt = mt.Append(pseudorandomForTesting(i))
+	}
+	for leaf := uint64(0); leaf < 11; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		mode, err := VerifyAutoDetect(proof.RootHash, proof.LeafHash, proof.LeafIndex, proof.Proof)
+		Require(t, err)
+		if mode != HashModePositional {
+			Fail(t, "positional proof detected as", mode, leaf)
+		}
+
+		// fold the same siblings in sorted order to get the root a sorted tree would have
+		sortedRoot := proof.LeafHash
+		for _, sibling := range proof.Proof {
+			if bytes.Compare(sortedRoot.Bytes(), sibling.Bytes()) <= 0 {
+				sortedRoot = crypto.Keccak256Hash(sortedRoot.Bytes(), sibling.Bytes())
+			} else {
+				sortedRoot = crypto.Keccak256Hash(sibling.Bytes(), sortedRoot.Bytes())
+			}
+		}
+		if sortedRoot == proof.RootHash {
+			continue // this leaf's siblings happen to be in sorted order
+		}
+		mode, err = VerifyAutoDetect(sortedRoot, proof.LeafHash, proof.LeafIndex, proof.Proof)
+		Require(t, err)
+		if mode != HashModeSorted {
+			Fail(t, "sorted proof detected as", mode, leaf)
+		}
+
+		if _, err := VerifyAutoDetect(pseudorandomForTesting(1000), proof.LeafHash, proof.LeafIndex, proof.Proof); !errors.Is(err, ErrInvalidProof) {
+			Fail(t, "wrong error for a proof that verifies under no mode", err)
+		}
+	}
+}
+
+func TestVerifyAppendChain(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 3; i++ {
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	proofs := []*MerkleProof{}
+	for i := uint64(3); i < 12; i++ {
+		proof, err := AppendProofNoClone(acc, pseudorandomForTesting(i))
+		Require(t, err)
+		proofs = append(proofs, proof)
+		accAppend(t, acc, pseudorandomForTesting(i))
+	}
+	Require(t, VerifyAppendChain(proofs))
+	Require(t, VerifyAppendChain(proofs[2:5]))
+
+	gap := append(append([]*MerkleProof{}, proofs[:3]...), proofs[4:]...)
+	if err := VerifyAppendChain(gap); err == nil {
+		Fail(t, "accepted a chain with a gap")
+	}
+	swapped := append([]*MerkleProof{}, proofs...)
+	swapped[3], swapped[4] = swapped[4], swapped[3]
+	if err := VerifyAppendChain(swapped); err == nil {
+		Fail(t, "accepted a chain out of order")
+	}
+
+	// an append proof from another history breaks the chain even at the right index
+	other := initializedMerkleAccumulatorForTesting()
+	for i := uint64(0); i < 6; i++ {
+		accAppend(t, other, pseudorandomForTesting(1000+i))
+	}
+	forked, err := AppendProofNoClone(other, pseudorandomForTesting(6))
+	Require(t, err)
+	mixed := append([]*MerkleProof{}, proofs...)
+	mixed[3] = forked
+	if err := VerifyAppendChain(mixed); err == nil {
+		Fail(t, "accepted a chain with a proof from another history")
+	}
+}
+
+func TestCanonicalizeProof(t *testing.T) {
+	for _, treeSize := range []uint64{1, 5, 8, 11} {
+		leaves := []common.Hash{}
+		for i := uint64(0); i < treeSize; i++ {
+			leaves = append(leaves, pseudorandomForTesting(i))
+		}
+		mt := NewMerkleTreeFromLeaves(leaves)
+		compactBuilder := NewProofBuilder(WithExplicitEmptySiblings(false))
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			canonical, err := ProveLeaf(mt, leaf)
+			Require(t, err)
+			compact, err := compactBuilder.Build(leaf, treeSize, completeNodesForTesting(leaves))
+			Require(t, err)
+
+			variants := map[string]*MerkleProof{"canonical": canonical, "compact": compact}
+			padded := *canonical
+			padded.Proof = append(append([]common.Hash{}, canonical.Proof...), common.Hash{}, common.Hash{})
+			variants["padded"] = &padded
+			for _, name := range []string{"canonical", "compact", "padded"} {
+				reordered := *variants[name]
+				reordered.Proof = make([]common.Hash, len(variants[name].Proof))
+				for i, sibling := range variants[name].Proof {
+					reordered.Proof[len(reordered.Proof)-1-i] = sibling
+				}
+				variants["reordered "+name] = &reordered
+			}
+			for name, variant := range variants {
+				before := append([]common.Hash{}, variant.Proof...)
+				normalized, err := CanonicalizeProof(variant, treeSize)
+				Require(t, err, name, "proof of leaf", leaf, "of", treeSize)
+				if !reflect.DeepEqual(normalized, canonical) {
+					Fail(t, "didn't normalize the", name, "proof of leaf", leaf, "of", treeSize)
+				}
+				if !reflect.DeepEqual(variant.Proof, before) {
+					Fail(t, "normalizing modified the", name, "proof")
+				}
+			}
+
+			if len(canonical.Proof) > 0 {
+				broken := *canonical
+				broken.Proof = append([]common.Hash{}, canonical.Proof...)
+				broken.Proof[0] = pseudorandomForTesting(1000)
+				if _, err := CanonicalizeProof(&broken, treeSize); !errors.Is(err, ErrInvalidProof) {
+					Fail(t, "normalized a proof with a wrong sibling", leaf, err)
+				}
+			}
+			junk := *canonical
+			junk.Proof = append(append([]common.Hash{}, canonical.Proof...), pseudorandomForTesting(1000))
+			if _, err := CanonicalizeProof(&junk, treeSize); !errors.Is(err, ErrInvalidProof) {
+				Fail(t, "normalized a proof padded with a nonzero hash", leaf, err)
+			}
+		}
+		if _, err := CanonicalizeProof(&MerkleProof{LeafIndex: treeSize}, treeSize); err == nil {
+			Fail(t, "normalized a proof of a leaf beyond the tree")
+		}
+	}
+}
+
+func TestInferTreeSize(t *testing.T) {
+	for treeSize := uint64(1); treeSize <= 33; treeSize++ {
+		leaves := []common.Hash{}
+		for i := uint64(0); i < treeSize; i++ {
+			leaves = append(leaves, pseudorandomForTesting(i))
+		}
+		mt := NewMerkleTreeFromLeaves(leaves)
+		balanced := treeSize == arbmath.NextOrCurrentPowerOf2(treeSize)
+		ambiguous := 0
+		for leaf := uint64(0); leaf < treeSize; leaf++ {
+			proof, err := ProveLeaf(mt, leaf)
+			Require(t, err)
+			inferred, ok := InferTreeSize(leaf, proof.Proof)
+			if balanced && inferred != treeSize {
+				Fail(t, "inferred size", inferred, "for leaf", leaf, "of balanced tree", treeSize)
+			}
+			if ok && inferred != treeSize {
+				Fail(t, "unambiguously inferred size", inferred, "for leaf", leaf, "of", treeSize)
+			}
+			if !ok {
+				ambiguous++
+			}
+			if leaf == treeSize-1 && !ok {
+				Fail(t, "the last leaf of", treeSize, "should pin down the size")
+			}
+		}
+		if !balanced && ambiguous == 0 {
+			Fail(t, "no ambiguity reported for unbalanced tree", treeSize)
+		}
+	}
+
+	// leaf 0 of 5 looks just like leaf 0 of 8
+	mt := NewMerkleTreeFromLeaves([]common.Hash{{1}, {2}, {3}, {4}, {5}})
+	proof, err := ProveLeaf(mt, 0)
+	Require(t, err)
+	if inferred, ok := InferTreeSize(0, proof.Proof); inferred != 8 || ok {
+		Fail(t, "expected an ambiguous size of 8, got", inferred, ok)
+	}
+
+	if _, ok := InferTreeSize(4, make([]common.Hash, 2)); ok {
+		Fail(t, "inferred a size for a leaf too large for the proof")
+	}
+	if _, ok := InferTreeSize(1, []common.Hash{{}}); ok {
+		Fail(t, "inferred a size with an empty sibling on the left")
+	}
+	if _, ok := InferTreeSize(0, []common.Hash{{}, {1}}); ok {
+		Fail(t, "inferred a size from contradictory siblings")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+// Withdrawal is an L2 to L1 transaction, with the fields ArbSys hashes into its send hash
+// and emits in its L2ToL1Tx log
+type Withdrawal struct {
+	Caller      common.Address
+	Destination common.Address
+	ArbBlockNum *big.Int
+	EthBlockNum *big.Int
+	Timestamp   *big.Int
+	CallValue   *big.Int
+	Data        []byte
+}
+
+// ComputeSendHash hashes the withdrawal the way ArbSys's sendTxToL1 does, giving the send hash it appends to the
+// send tree. The tree hashes send hashes again to form its leaves.
+func ComputeSendHash(w Withdrawal) common.Hash {
+	return crypto.Keccak256Hash(
+		w.Caller.Bytes(),
+		w.Destination.Bytes(),
+		arbmath.U256Bytes(w.ArbBlockNum),
+		arbmath.U256Bytes(w.EthBlockNum),
+		arbmath.U256Bytes(w.Timestamp),
+		common.BigToHash(w.CallValue).Bytes(),
+		w.Data,
+	)
+}
+
+// VerifyOutboxProof checks the send hash is at the leaf index of the send tree with the given root and size,
+// as the outbox does when executing a withdrawal
+func VerifyOutboxProof(root common.Hash, sendHash common.Hash, leafIndex uint64, proof []common.Hash, treeSize uint64) error {
+	return verifyLeaf(root, treeSize, leafIndex, crypto.Keccak256Hash(sendHash.Bytes()), proof)
+}
+
+// VerifyWithdrawalAgainstRoot checks the withdrawal is at the leaf index of the send tree with the trusted root
+// and size, which is all a light client needs to know it can be executed
+func VerifyWithdrawalAgainstRoot(w Withdrawal, leafIndex uint64, proof []common.Hash, root common.Hash, treeSize uint64) error {
+	return VerifyOutboxProof(root, ComputeSendHash(w), leafIndex, proof, treeSize)
+}
+
+// WithdrawalLeaf is where a withdrawal's send is in the send tree, as found in its L2ToL1Tx log
+type WithdrawalLeaf struct {
+	Hash      common.Hash // the send hash, which the tree hashes again to form the leaf
+	LeafIndex uint64
+	TxHash    common.Hash // of the transaction that made the withdrawal
+}
+
+// WithdrawalsFromReceipts finds the withdrawals in the receipts' L2ToL1Tx logs, in the order they were made.
+// Logs of other events or contracts are skipped, but a failed receipt is an error, as its sends were reverted.
+func WithdrawalsFromReceipts(receipts []*types.Receipt, arbSys *precompilesgen.ArbSys) ([]WithdrawalLeaf, error) {
+	_, withdrawTopic, err := arbSysLogTopics()
+	if err != nil {
+		return nil, err
+	}
+	withdrawals := []WithdrawalLeaf{}
+	for _, receipt := range receipts {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return nil, fmt.Errorf("transaction %v failed with status %v", receipt.TxHash, receipt.Status)
+		}
+		for _, log := range receipt.Logs {
+			if log.Address != types.ArbSysAddress || len(log.Topics) == 0 || log.Topics[0] != withdrawTopic {
+				continue
+			}
+			parsed, err := arbSys.ParseL2ToL1Tx(*log)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse L2ToL1Tx log of transaction %v: %w", receipt.TxHash, err)
+			}
+			if !parsed.Position.IsUint64() {
+				return nil, fmt.Errorf("withdrawal in transaction %v has position %v", receipt.TxHash, parsed.Position)
+			}
+			withdrawals = append(withdrawals, WithdrawalLeaf{
+				Hash:      common.BigToHash(parsed.Hash),
+				LeafIndex: parsed.Position.Uint64(),
+				TxHash:    receipt.TxHash,
+			})
+		}
+	}
+	return withdrawals, nil
+}
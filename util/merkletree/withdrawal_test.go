@@ -0,0 +1,120 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+func withdrawalForTesting(i uint64) Withdrawal {
+	return Withdrawal{
+		Caller:      common.BytesToAddress(pseudorandomForTesting(i).Bytes()),
+		Destination: common.BytesToAddress(pseudorandomForTesting(i + 1000).Bytes()),
+		ArbBlockNum: new(big.Int).SetUint64(100 + i),
+		EthBlockNum: new(big.Int).SetUint64(20 + i),
+		Timestamp:   new(big.Int).SetUint64(1700000000 + 12*i),
+		CallValue:   new(big.Int).Lsh(big.NewInt(int64(i)), 60),
+		Data:        pseudorandomForTesting(i + 2000).Bytes()[:i%32],
+	}
+}
+
+func TestComputeSendHash(t *testing.T) {
+	w := withdrawalForTesting(7)
+	word := func(n *big.Int) []byte {
+		return common.BigToHash(n).Bytes()
+	}
+	packed := bytes.Join([][]byte{
+		w.Caller.Bytes(), w.Destination.Bytes(),
+		word(w.ArbBlockNum), word(w.EthBlockNum), word(w.Timestamp), word(w.CallValue),
+		w.Data,
+	}, nil)
+	if ComputeSendHash(w) != crypto.Keccak256Hash(packed) {
+		Fail(t, "send hash isn't the hash of the packed withdrawal")
+	}
+}
+
+func TestVerifyWithdrawalAgainstRoot(t *testing.T) {
+	acc := initializedMerkleAccumulatorForTesting()
+	withdrawals := []Withdrawal{}
+	sendHashes := []common.Hash{}
+	for i := uint64(0); i < 11; i++ {
+		withdrawals = append(withdrawals, withdrawalForTesting(i))
+		sendHashes = append(sendHashes, ComputeSendHash(withdrawals[i]))
+		accAppend(t, acc, sendHashes[i])
+	}
+	treeSize := size(t, acc)
+	mt := NewMerkleTreeFromLeaves(sendHashes)
+	for leaf := uint64(0); leaf < treeSize; leaf++ {
+		proof, err := ProveLeaf(mt, leaf)
+		Require(t, err)
+		Require(t, VerifyWithdrawalAgainstRoot(withdrawals[leaf], leaf, proof.Proof, root(t, acc), treeSize), "leaf", leaf)
+
+		changed := withdrawals[leaf]
+		changed.CallValue = new(big.Int).Add(changed.CallValue, big.NewInt(1))
+		if err := VerifyWithdrawalAgainstRoot(changed, leaf, proof.Proof, root(t, acc), treeSize); !errors.Is(err, ErrInvalidProof) {
+			Fail(t, "wrong error for a changed withdrawal", leaf, err)
+		}
+		other := (leaf + 1) % treeSize
+		if err := VerifyWithdrawalAgainstRoot(withdrawals[other], leaf, proof.Proof, root(t, acc), treeSize); err == nil {
+			Fail(t, "verified withdrawal", other, "at leaf", leaf)
+		}
+		if err := VerifyWithdrawalAgainstRoot(withdrawals[leaf], leaf, proof.Proof, root(t, acc), treeSize+8); err == nil {
+			Fail(t, "verified against the wrong tree size", leaf)
+		}
+	}
+}
+
+func TestWithdrawalsFromReceipts(t *testing.T) {
+	arbSys, err := precompilesgen.NewArbSys(types.ArbSysAddress, nil)
+	Require(t, err)
+	_, logs := sendTreeForTesting(t, 7)
+	receipts := []*types.Receipt{}
+	for i := range logs {
+		log := &logs[i]
+		if log.Topics[0] != withdrawTopicForTesting {
+			continue
+		}
+		leaf := PositionTopic(log.Topics[3]).Leaf()
+		elsewhere := *log
+		elsewhere.Address = common.Address{1}
+		receipts = append(receipts, &types.Receipt{
+			Status: types.ReceiptStatusSuccessful,
+			TxHash: pseudorandomForTesting(100 + leaf),
+			Logs: []*types.Log{
+				{Address: types.ArbSysAddress, Topics: []common.Hash{merkleTopicForTesting, {}, {}, {}}},
+				&elsewhere,
+				{Address: types.ArbSysAddress},
+				log,
+			},
+		})
+	}
+	// a transaction without any sends
+	receipts = append(receipts, &types.Receipt{Status: types.ReceiptStatusSuccessful})
+
+	withdrawals, err := WithdrawalsFromReceipts(receipts, arbSys)
+	Require(t, err)
+	if len(withdrawals) != 7 {
+		Fail(t, "found", len(withdrawals), "withdrawals among 7 receipts")
+	}
+	for i, withdrawal := range withdrawals {
+		leaf := uint64(i)
+		expected := WithdrawalLeaf{pseudorandomForTesting(leaf), leaf, pseudorandomForTesting(100 + leaf)}
+		if withdrawal != expected {
+			Fail(t, "found", withdrawal, "rather than", expected)
+		}
+	}
+
+	failed := &types.Receipt{Status: types.ReceiptStatusFailed, TxHash: pseudorandomForTesting(1000)}
+	if _, err := WithdrawalsFromReceipts(append(receipts, failed), arbSys); err == nil {
+		Fail(t, "found withdrawals in a failed transaction")
+	}
+}